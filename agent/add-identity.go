@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// AddIdentity is a parsed SSH_AGENTC_ADD_IDENTITY or SSH_AGENTC_ADD_ID_CONSTRAINED message
+type AddIdentity struct {
+	KeyType string
+	// PublicKey is the public key blob of the added key, the certificate for certificate keys
+	PublicKey []byte
+	Comment   []byte
+	// Key is the key type, private key fields and comment, as found in the message
+	Key         []byte
+	Constraints []KeyConstraint
+}
+
+// KeyConstraint is a key constraint of SSH_AGENTC_ADD_ID_CONSTRAINED
+type KeyConstraint struct {
+	Type byte
+	// Extension is the extension name for SSH_AGENT_CONSTRAIN_EXTENSION
+	Extension string
+	// Data is the encoded constraint including its type
+	Data []byte
+	// Details is the content of the constraint after its type and extension name
+	Details []byte
+}
+
+// readStrings reads count strings and returns them
+func readStrings(buf []byte, count int) ([][]byte, []byte, error) {
+	values := make([][]byte, count)
+	for i := range values {
+		var err error
+		if values[i], buf, err = ReadString(buf); err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, buf, nil
+}
+
+func marshalStrings(values ...[]byte) []byte {
+	var buf []byte
+	for _, value := range values {
+		buf = append(buf, MarshalString(value)...)
+	}
+	return buf
+}
+
+// parsePrivateKey parses the private key fields after the key type and returns the public key blob
+func parsePrivateKey(keyType string, buf []byte) (publicKey []byte, rest []byte, err error) {
+	keyTypeBytes := []byte(keyType)
+
+	if strings.HasSuffix(keyType, "-cert-v01@openssh.com") {
+		// Certificate followed by the private fields of the underlying key
+		certificate, rest, err := ReadString(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if strings.HasPrefix(keyType, "sk-") {
+			// application, flags byte, key handle, reserved
+			if _, rest, err = ReadString(rest); err != nil {
+				return nil, nil, err
+			}
+			if len(rest) < 1 {
+				return nil, nil, ErrMalformedMessage
+			}
+			_, rest, err = readStrings(rest[1:], 2)
+			return certificate, rest, err
+		}
+
+		privateFields := map[string]int{
+			"ssh-rsa-cert-v01@openssh.com":             4, // d, iqmp, p, q
+			"ssh-dss-cert-v01@openssh.com":             1, // x
+			"ecdsa-sha2-nistp256-cert-v01@openssh.com": 1, // d
+			"ecdsa-sha2-nistp384-cert-v01@openssh.com": 1,
+			"ecdsa-sha2-nistp521-cert-v01@openssh.com": 1,
+			"ssh-ed25519-cert-v01@openssh.com":         2, // public, private
+		}
+		count, ok := privateFields[keyType]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported key type %s", keyType)
+		}
+
+		_, rest, err = readStrings(rest, count)
+		return certificate, rest, err
+	}
+
+	switch keyType {
+	case "ssh-rsa":
+		// n, e, d, iqmp, p, q
+		fields, rest, err := readStrings(buf, 6)
+		if err != nil {
+			return nil, nil, err
+		}
+		return marshalStrings(keyTypeBytes, fields[1], fields[0]), rest, nil
+
+	case "ssh-dss":
+		// p, q, g, y, x
+		fields, rest, err := readStrings(buf, 5)
+		if err != nil {
+			return nil, nil, err
+		}
+		return marshalStrings(keyTypeBytes, fields[0], fields[1], fields[2], fields[3]), rest, nil
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		// curve, Q, d
+		fields, rest, err := readStrings(buf, 3)
+		if err != nil {
+			return nil, nil, err
+		}
+		return marshalStrings(keyTypeBytes, fields[0], fields[1]), rest, nil
+
+	case "ssh-ed25519":
+		// public, private
+		fields, rest, err := readStrings(buf, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return marshalStrings(keyTypeBytes, fields[0]), rest, nil
+
+	case "sk-ecdsa-sha2-nistp256@openssh.com", "sk-ssh-ed25519@openssh.com":
+		// [curve,] public, application, flags, key handle, reserved
+		publicFieldCount := 3
+		if keyType == "sk-ssh-ed25519@openssh.com" {
+			publicFieldCount = 2
+		}
+
+		fields, rest, err := readStrings(buf, publicFieldCount)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) < 1 {
+			return nil, nil, ErrMalformedMessage
+		}
+		_, rest, err = readStrings(rest[1:], 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return marshalStrings(append([][]byte{keyTypeBytes}, fields...)...), rest, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %s", keyType)
+	}
+}
+
+func parseConstraints(buf []byte) ([]KeyConstraint, error) {
+	var constraints []KeyConstraint
+
+	for len(buf) > 0 {
+		constraint := KeyConstraint{Type: buf[0]}
+		rest := buf[1:]
+
+		switch constraint.Type {
+		case SSH_AGENT_CONSTRAIN_LIFETIME, SSH_AGENT_CONSTRAIN_MAXSIGN:
+			if len(rest) < 4 {
+				return nil, ErrMalformedMessage
+			}
+			constraint.Details = rest[:4]
+			rest = rest[4:]
+
+		case SSH_AGENT_CONSTRAIN_CONFIRM:
+
+		case SSH_AGENT_CONSTRAIN_EXTENSION:
+			name, extensionRest, err := ReadString(rest)
+			if err != nil {
+				return nil, err
+			}
+			constraint.Extension = string(name)
+
+			detailsLength := 0
+			switch constraint.Extension {
+			case "restrict-destination-v00@openssh.com", "sk-provider@openssh.com":
+				_, after, err := ReadString(extensionRest)
+				if err != nil {
+					return nil, err
+				}
+				detailsLength = len(extensionRest) - len(after)
+			case "associated-certs-v01@openssh.com":
+				if len(extensionRest) < 1 {
+					return nil, ErrMalformedMessage
+				}
+				_, after, err := ReadString(extensionRest[1:])
+				if err != nil {
+					return nil, err
+				}
+				detailsLength = len(extensionRest) - len(after)
+			default:
+				return nil, fmt.Errorf("unsupported constraint extension %s", constraint.Extension)
+			}
+
+			constraint.Details = extensionRest[:detailsLength]
+			rest = extensionRest[detailsLength:]
+
+		default:
+			return nil, fmt.Errorf("unsupported constraint %d", constraint.Type)
+		}
+
+		constraint.Data = buf[:len(buf)-len(rest)]
+		constraints = append(constraints, constraint)
+		buf = rest
+	}
+
+	return constraints, nil
+}
+
+// ParseAddIdentity parses a SSH_AGENTC_ADD_IDENTITY or SSH_AGENTC_ADD_ID_CONSTRAINED message
+func ParseAddIdentity(message []byte) (*AddIdentity, error) {
+	messageType := MessageType(message)
+	if messageType != SSH_AGENTC_ADD_IDENTITY && messageType != SSH_AGENTC_ADD_ID_CONSTRAINED {
+		return nil, ErrMalformedMessage
+	}
+
+	payload := MessagePayload(message)
+	keyType, rest, err := ReadString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &AddIdentity{KeyType: string(keyType)}
+
+	identity.PublicKey, rest, err = parsePrivateKey(identity.KeyType, rest)
+	if err != nil {
+		return nil, err
+	}
+
+	identity.Comment, rest, err = ReadString(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	identity.Key = payload[:len(payload)-len(rest)]
+
+	if messageType == SSH_AGENTC_ADD_ID_CONSTRAINED {
+		identity.Constraints, err = parseConstraints(rest)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(rest) != 0 {
+		return nil, ErrMalformedMessage
+	}
+
+	return identity, nil
+}
+
+// Marshal builds the add identity message, using SSH_AGENTC_ADD_IDENTITY if there is no constraint
+func (a *AddIdentity) Marshal() []byte {
+	if len(a.Constraints) == 0 {
+		return NewAgentMessage(SSH_AGENTC_ADD_IDENTITY, a.Key)
+	}
+
+	parts := [][]byte{a.Key}
+	for _, constraint := range a.Constraints {
+		parts = append(parts, constraint.Data)
+	}
+	return NewAgentMessage(SSH_AGENTC_ADD_ID_CONSTRAINED, parts...)
+}
+
+// Uint32 returns the value of a lifetime or maxsign constraint
+func (c *KeyConstraint) Uint32() uint32 {
+	if len(c.Details) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(c.Details)
+}
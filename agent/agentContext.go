@@ -3,24 +3,75 @@ package agent
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/amurzeau/ssh-agent-bridge/log"
 )
 
+// DEFAULT_SHUTDOWN_GRACE_PERIOD is the time given to in-flight queries to complete when stopping
+const DEFAULT_SHUTDOWN_GRACE_PERIOD = 5 * time.Second
+
 type AgentContext struct {
+	// ctx is canceled when stopping, listeners stop accepting and connections stop reading new queries
 	ctx            context.Context
 	cancelFunction context.CancelFunc
-	wg             sync.WaitGroup
+	// upstreamCtx is canceled once in-flight queries are drained or the grace period expired
+	upstreamCtx            context.Context
+	upstreamCancelFunction context.CancelFunc
+	wg                     sync.WaitGroup
+
+	// ShutdownGracePeriod is the maximum time Stop waits for in-flight queries before failing them
+	ShutdownGracePeriod time.Duration
+	// ListenerRestartMinDelay and ListenerRestartMaxDelay bound the delay before restarting a failed listener
+	ListenerRestartMinDelay time.Duration
+	ListenerRestartMaxDelay time.Duration
+	// ListenerRestartMaxAttempts is the number of restarts of a listener failing in a row before giving up, 0 to never give up
+	ListenerRestartMaxAttempts int
 
 	QueryChannel chan AgentMessageQuery
+	// sendLock is held for reading while sending to QueryChannel and for writing while closing it
+	sendLock sync.RWMutex
+	stopLock sync.RWMutex
+	stopping bool
+	stopOnce sync.Once
+	inFlight sync.WaitGroup
+
+	// activeConnections counts connected clients, lastDisconnection is the time the last one disconnected
+	connectionsLock   sync.Mutex
+	activeConnections int
+	lastDisconnection time.Time
+
+	listenersLock     sync.Mutex
+	listeners         map[string]*supervisedListener
+	listenerObservers []func(status ListenerStatus)
+	// listenerNotifyLock keeps notifications in order, each one sends the current status of the listener
+	listenerNotifyLock sync.Mutex
+
+	upstreamLock sync.Mutex
+	upstream     UpstreamStatus
+	// upstreamReported is set once the result of a query was notified to upstreamObservers
+	upstreamReported  bool
+	upstreamObservers []func(status UpstreamStatus)
+
+	middlewares []Middleware
+	handlerOnce sync.Once
+	handler     QueryHandler
 }
 
 func CreateAgent() AgentContext {
 	ctx, cancelFunc := context.WithCancel(context.Background())
+	upstreamCtx, upstreamCancelFunc := context.WithCancel(context.Background())
 	return AgentContext{
-		ctx:            ctx,
-		cancelFunction: cancelFunc,
-		wg:             sync.WaitGroup{},
+		ctx:                    ctx,
+		cancelFunction:         cancelFunc,
+		upstreamCtx:            upstreamCtx,
+		upstreamCancelFunction: upstreamCancelFunc,
+		wg:                     sync.WaitGroup{},
+
+		ShutdownGracePeriod:     DEFAULT_SHUTDOWN_GRACE_PERIOD,
+		ListenerRestartMinDelay: LISTENER_RESTART_MIN_DELAY,
+		ListenerRestartMaxDelay: LISTENER_RESTART_MAX_DELAY,
+		lastDisconnection:       time.Now(),
 
 		QueryChannel: make(chan AgentMessageQuery),
 	}
@@ -34,19 +85,82 @@ func (a *AgentContext) Go(routine func()) {
 	}()
 }
 
+// Done is closed when stopping, listeners must stop accepting new connections
 func (a *AgentContext) Done() <-chan struct{} {
 	return a.ctx.Done()
 }
 
+// Stop starts a graceful shutdown: new queries are refused with a failure,
+// in-flight queries are given ShutdownGracePeriod to complete, then upstream agents are stopped.
+// Stop doesn't wait for the shutdown, use Wait for this.
 func (a *AgentContext) Stop() {
-	select {
-	case <-a.QueryChannel:
-		// channel already closed
-	default:
+	a.stopOnce.Do(func() {
 		log.Debugf("agentContext: stopping forwarding")
-		close(a.QueryChannel)
+
+		a.stopLock.Lock()
+		a.stopping = true
+		a.stopLock.Unlock()
+
 		a.cancelFunction()
+
+		a.Go(a.drain)
+	})
+}
+
+func (a *AgentContext) drain() {
+	drained := make(chan struct{})
+	go func() {
+		a.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Debugf("agentContext: in-flight queries completed")
+	case <-time.After(a.ShutdownGracePeriod):
+		log.Errorf("agentContext: in-flight queries not completed after %v, replying failure", a.ShutdownGracePeriod)
+	}
+
+	// Unblock queries still waiting for upstream agents
+	a.upstreamCancelFunction()
+
+	// No query can be sending to QueryChannel once the write lock is held,
+	// senders blocked on QueryChannel were released by the upstreamCtx cancel
+	a.sendLock.Lock()
+	close(a.QueryChannel)
+	a.sendLock.Unlock()
+
+	log.Debugf("agentContext: stopping upstream agents")
+}
+
+// ConnectionOpened is called by listeners when a client connects
+func (a *AgentContext) ConnectionOpened() {
+	a.connectionsLock.Lock()
+	defer a.connectionsLock.Unlock()
+
+	a.activeConnections++
+}
+
+// ConnectionClosed is called by listeners when a client disconnects
+func (a *AgentContext) ConnectionClosed() {
+	a.connectionsLock.Lock()
+	defer a.connectionsLock.Unlock()
+
+	a.activeConnections--
+	if a.activeConnections == 0 {
+		a.lastDisconnection = time.Now()
+	}
+}
+
+// IdleSince returns since when no client is connected, or false if clients are connected
+func (a *AgentContext) IdleSince() (time.Time, bool) {
+	a.connectionsLock.Lock()
+	defer a.connectionsLock.Unlock()
+
+	if a.activeConnections > 0 {
+		return time.Time{}, false
 	}
+	return a.lastDisconnection, true
 }
 
 func (a *AgentContext) Wait() {
@@ -0,0 +1,155 @@
+package agent_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+var identitiesQuery = agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES)
+
+// upstream answers the queries of ctx like an upstream agent client, after release is closed.
+// The first received queries are sent to the returned channel.
+func upstream(ctx *agent.AgentContext, release <-chan struct{}) chan agent.AgentMessageQuery {
+	received := make(chan agent.AgentMessageQuery, 16)
+	ctx.Go(func() {
+		for message := range ctx.QueryChannel {
+			select {
+			case received <- message:
+			default:
+			}
+			go func(message agent.AgentMessageQuery) {
+				<-release
+				message.ReplyChannel <- agent.AGENT_MESSAGE_SUCCESS_REPLY
+			}(message)
+		}
+	})
+	return received
+}
+
+// query sends a query in the background and returns the channel receiving its reply
+func query(ctx *agent.AgentContext) chan agent.AgentMessageReply {
+	reply := make(chan agent.AgentMessageReply, 1)
+	go func() {
+		reply <- ctx.Query(agent.NewConnection("test", agent.PeerInfo{}), identitiesQuery)
+	}()
+	return reply
+}
+
+// waitStopped waits for ctx.Wait with a timeout
+func waitStopped(t *testing.T, ctx *agent.AgentContext, timeout time.Duration) {
+	t.Helper()
+
+	stopped := make(chan struct{})
+	go func() {
+		ctx.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		t.Fatalf("not stopped after %v", timeout)
+	}
+}
+
+func replyType(t *testing.T, reply chan agent.AgentMessageReply) byte {
+	t.Helper()
+
+	select {
+	case message := <-reply:
+		return agent.MessageType(message.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+		return 0
+	}
+}
+
+func TestStopWaitsInFlightQuery(t *testing.T) {
+	ctx := agent.CreateAgent()
+	ctx.ShutdownGracePeriod = 5 * time.Second
+	release := make(chan struct{})
+	received := upstream(&ctx, release)
+
+	reply := query(&ctx)
+	<-received
+
+	ctx.Stop()
+
+	// New queries are refused while the in-flight one is completing
+	if messageType := replyType(t, query(&ctx)); messageType != agent.SSH_AGENT_FAILURE {
+		t.Errorf("query after Stop replied %d, want a failure", messageType)
+	}
+
+	close(release)
+	if messageType := replyType(t, reply); messageType != agent.SSH_AGENT_SUCCESS {
+		t.Errorf("in-flight query replied %d, want the upstream reply", messageType)
+	}
+	waitStopped(t, &ctx, time.Second)
+}
+
+func TestStopWithHangingUpstream(t *testing.T) {
+	ctx := agent.CreateAgent()
+	ctx.ShutdownGracePeriod = 100 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	received := upstream(&ctx, release)
+
+	reply := query(&ctx)
+	<-received
+
+	start := time.Now()
+	ctx.Stop()
+
+	if messageType := replyType(t, reply); messageType != agent.SSH_AGENT_FAILURE {
+		t.Errorf("hanging query replied %d, want a failure", messageType)
+	}
+	if elapsed := time.Since(start); elapsed < ctx.ShutdownGracePeriod {
+		t.Errorf("hanging query failed after %v, before the grace period", elapsed)
+	}
+	waitStopped(t, &ctx, time.Second)
+}
+
+func TestStopWithoutUpstream(t *testing.T) {
+	ctx := agent.CreateAgent()
+	ctx.ShutdownGracePeriod = 100 * time.Millisecond
+
+	// Nobody reads QueryChannel, the query is blocked sending to it
+	reply := query(&ctx)
+	time.Sleep(10 * time.Millisecond)
+	ctx.Stop()
+
+	if messageType := replyType(t, reply); messageType != agent.SSH_AGENT_FAILURE {
+		t.Errorf("blocked query replied %d, want a failure", messageType)
+	}
+	waitStopped(t, &ctx, time.Second)
+}
+
+func TestStopDuringQueries(t *testing.T) {
+	ctx := agent.CreateAgent()
+	ctx.ShutdownGracePeriod = 100 * time.Millisecond
+	release := make(chan struct{})
+	close(release)
+	upstream(&ctx, release)
+
+	// Queries racing with Stop must all get a reply, without sending to the closed QueryChannel
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ctx.Query(agent.NewConnection("test", agent.PeerInfo{}), identitiesQuery)
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond)
+	ctx.Stop()
+	ctx.Stop()
+
+	wg.Wait()
+	waitStopped(t, &ctx, time.Second)
+}
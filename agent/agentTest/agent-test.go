@@ -0,0 +1,117 @@
+// Package agentTest provides an in-process upstream agent and clients for tests
+package agentTest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"golang.org/x/crypto/ssh"
+	xagent "golang.org/x/crypto/ssh/agent"
+)
+
+const PackageName = "agent-test"
+
+// NewKeyring returns an agent holding one new Ed25519 key with comment
+func NewKeyring(t testing.TB, comment string) xagent.Agent {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := xagent.NewKeyring()
+	if err := keyring.Add(xagent.AddedKey{PrivateKey: privateKey, Comment: comment}); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// ServeUpstream answers the queries of ctx with upstream until ctx is stopped, like an upstream agent client
+func ServeUpstream(ctx *agent.AgentContext, upstream xagent.Agent) {
+	dialFunction := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			xagent.ServeAgent(upstream, server)
+			server.Close()
+		}()
+		return client, nil
+	}
+
+	ctx.Go(func() {
+		common.GenericNetClient(PackageName, dialFunction, ctx)
+	})
+}
+
+// WaitListener waits until a listener of ctx is running
+func WaitListener(t testing.TB, ctx *agent.AgentContext, name string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, status := range ctx.Listeners() {
+			if status.Name == name && status.State == agent.ListenerRunning {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("listener %s not running: %v", name, ctx.Listeners())
+}
+
+// FreeAddress returns a loopback address with a port available for listening
+func FreeAddress(t testing.TB) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// CheckSign lists the identities of client and checks that the first one signs data
+func CheckSign(t testing.TB, client xagent.ExtendedAgent) {
+	t.Helper()
+
+	keys, err := client.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(keys) == 0 {
+		t.Fatal("list: no identity")
+	}
+
+	data := []byte("test data")
+	signature, err := client.Sign(keys[0], data)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(keys[0].Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKey.Verify(data, signature); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+// Stop stops ctx and waits for its listeners and upstream clients
+func Stop(ctx *agent.AgentContext) {
+	ctx.Stop()
+	ctx.Wait()
+}
+
+// Client returns an agent client connected to ctx as if it came from listener
+func Client(ctx *agent.AgentContext, listener string) xagent.ExtendedAgent {
+	client, server := net.Pipe()
+	common.HandleAgentConnection(PackageName, server, agent.NewConnection(listener, agent.PeerInfo{}), ctx)
+	return xagent.NewClient(client)
+}
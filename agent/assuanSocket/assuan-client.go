@@ -0,0 +1,54 @@
+package assuanSocket
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// connectAssuanSocket connects to the TCP port of a socket file and sends its nonce
+func connectAssuanSocket(socketPath string) (net.Conn, error) {
+	// The file is read for each connection as the port and nonce change when the agent restarts
+	socket, err := readSocketFile(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("%s: connecting to %s", PackageName, socket.address())
+	conn, err := net.DialTimeout("tcp", socket.address(), HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if _, err := conn.Write(socket.nonce); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: can't send nonce: %w", PackageName, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func ClientAssuanSocket(socketPath string, ctx *agent.AgentContext) error {
+	if socketPath == "" {
+		return fmt.Errorf("%s: empty socket path, use --assuan-socket", PackageName)
+	}
+
+	log.Infof("%s: forwarding to agent at %s", PackageName, socketPath)
+
+	dialFunction := func() (net.Conn, error) {
+		conn, err := connectAssuanSocket(socketPath)
+		if err != nil {
+			err = fmt.Errorf("%s: can't connect to %s: %w", PackageName, socketPath, err)
+		}
+
+		return conn, err
+	}
+
+	return common.GenericNetClient(PackageName, dialFunction, ctx)
+}
@@ -0,0 +1,130 @@
+package assuanSocket
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// checkNonce reads the nonce sent by a client, the agent protocol starts right after it
+func checkNonce(conn net.Conn, expectedNonce []byte) error {
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return fmt.Errorf("%s: couldn't read nonce: %w", PackageName, err)
+	}
+
+	if subtle.ConstantTimeCompare(nonce, expectedNonce) != 1 {
+		return fmt.Errorf("%s: invalid nonce from %s", PackageName, conn.RemoteAddr())
+	}
+
+	return nil
+}
+
+// checkIfAvailableSocketFile removes a stale socket file, and refuses to overwrite other files or a socket in use
+func checkIfAvailableSocketFile(socketPath string) error {
+	result, err := os.Stat(socketPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: error while checking socket path %s: %w", PackageName, socketPath, err)
+	} else if (result.Mode() & fs.ModeType) != 0 {
+		return fmt.Errorf("%s: socket file is not a regular file, won't overwrite it: %s", PackageName, socketPath)
+	}
+
+	socket, err := readSocketFile(socketPath)
+	if err != nil {
+		return fmt.Errorf("%s: can't parse socket file, is it an unrelated file ? won't overwrite it: %w", PackageName, err)
+	}
+
+	conn, err := net.DialTimeout("tcp", socket.address(), HANDSHAKE_TIMEOUT)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: socket file already exists and is active: %s", PackageName, socketPath)
+	}
+
+	// Valid socket file but nobody is listening, it was left by an agent which didn't stop properly
+	if err := os.Remove(socketPath); err != nil {
+		return fmt.Errorf("%s: failed to remove a supposed unused socket file: %s: %w", PackageName, socketPath, err)
+	}
+	log.Debugf("%s: socket file was stale and was deleted", PackageName)
+
+	return nil
+}
+
+func ServeAssuanSocket(socketPath string, ctx *agent.AgentContext) error {
+	if socketPath == "" {
+		log.Errorf("%s: empty socket path, skipping serving for ssh-agent queries", PackageName)
+		return nil
+	}
+
+	if err := checkIfAvailableSocketFile(socketPath); err != nil {
+		return err
+	}
+
+	log.Infof("%s: listening for ssh-agent requests on %s", PackageName, socketPath)
+
+	// Use 0 as the port to listen on a random available port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("%s: failed to listen a TCP port: %w", PackageName, err)
+	}
+	defer listener.Close()
+
+	socket, err := writeSocketFile(socketPath, listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	ctx.ListenerReady(EndpointName)
+
+	doneChannel := make(chan bool)
+	defer close(doneChannel)
+
+	// On cancel, close the listener which will cause defers to remove the socket file
+	go func() {
+		select {
+		case <-ctx.ListenerDone(EndpointName):
+			log.Debugf("%s: stopping", PackageName)
+			listener.Close()
+		case <-doneChannel:
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// intentional closing of network socket
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: accept error: %w", PackageName, err)
+		}
+
+		// Check the nonce out of the accept loop so a silent client doesn't block the others
+		ctx.Go(func() {
+			if err := checkNonce(conn, socket.nonce); err != nil {
+				log.Errorf("%s: handshake failed: %v", PackageName, err)
+				conn.Close()
+				return
+			}
+
+			common.HandleAgentConnection(PackageName, conn, agent.NewConnection(EndpointName, common.LoopbackTcpPeer(conn)), ctx)
+		})
+	}
+
+	log.Debugf("%s: stopped", PackageName)
+
+	return nil
+}
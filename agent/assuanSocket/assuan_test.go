@@ -0,0 +1,222 @@
+package assuanSocket
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+)
+
+var testNonce = []byte("0123456789abcdef")
+
+func TestParseSocketFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		port  int
+		valid bool
+	}{
+		{name: "valid", data: append([]byte("4242\n"), testNonce...), port: 4242, valid: true},
+		{name: "nonce with newline", data: []byte("1\n0123456789\nbcdef"), port: 1, valid: true},
+		{name: "no newline", data: []byte("4242"), valid: false},
+		{name: "short nonce", data: append([]byte("4242\n"), testNonce[:NONCE_SIZE-1]...), valid: false},
+		{name: "long nonce", data: append(append([]byte("4242\n"), testNonce...), '\n'), valid: false},
+		{name: "port not a number", data: append([]byte("port\n"), testNonce...), valid: false},
+		{name: "port zero", data: append([]byte("0\n"), testNonce...), valid: false},
+		{name: "port too large", data: append([]byte("65536\n"), testNonce...), valid: false},
+		{name: "unix socket path", data: []byte("/run/user/1000/gnupg/S.gpg-agent.ssh\n"), valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket, err := parseSocketFile(test.data)
+			if !test.valid {
+				if !errors.Is(err, ErrBadSocketFile) {
+					t.Fatalf("parseSocketFile() = %v, %v, want ErrBadSocketFile", socket, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if socket.port != test.port {
+				t.Errorf("port = %d, want %d", socket.port, test.port)
+			}
+		})
+	}
+}
+
+func TestWriteSocketFile(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "S.gpg-agent.ssh")
+
+	written, err := writeSocketFile(socketPath, 4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readSocketFile(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.port != 4242 || !bytes.Equal(read.nonce, written.nonce) {
+		t.Errorf("read %d %x, want %d %x", read.port, read.nonce, 4242, written.nonce)
+	}
+
+	// A new file gets a new nonce and leaves no temporary file
+	rewritten, err := writeSocketFile(socketPath, 4242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rewritten.nonce, written.nonce) {
+		t.Error("nonce reused")
+	}
+	entries, err := os.ReadDir(filepath.Dir(socketPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the socket file", len(entries))
+	}
+}
+
+// serve serves an upstream keyring with ServeAssuanSocket on socketPath
+func serve(t *testing.T, socketPath string) *agent.AgentContext {
+	t.Helper()
+
+	serverCtx := agent.CreateAgent()
+	agentTest.ServeUpstream(&serverCtx, agentTest.NewKeyring(t, "assuan-key"))
+	serverCtx.Serve(EndpointName, func(ctx *agent.AgentContext) error {
+		return ServeAssuanSocket(socketPath, ctx)
+	})
+	t.Cleanup(func() { agentTest.Stop(&serverCtx) })
+	agentTest.WaitListener(t, &serverCtx, EndpointName)
+
+	return &serverCtx
+}
+
+func TestForward(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "S.gpg-agent.ssh")
+	serverCtx := serve(t, socketPath)
+
+	clientCtx := agent.CreateAgent()
+	clientCtx.Go(func() {
+		if err := ClientAssuanSocket(socketPath, &clientCtx); err != nil {
+			t.Errorf("client: %v", err)
+		}
+	})
+	t.Cleanup(func() { agentTest.Stop(&clientCtx) })
+
+	agentTest.CheckSign(t, agentTest.Client(&clientCtx, "test"))
+
+	// The socket file is removed when the agent stops
+	agentTest.Stop(serverCtx)
+	if _, err := os.Stat(socketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file left after stop: %v", err)
+	}
+}
+
+func TestWrongNonce(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "S.gpg-agent.ssh")
+	serve(t, socketPath)
+
+	socket, err := readSocketFile(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", socket.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wrong nonce followed by a request identities message
+	nonce := bytes.Repeat([]byte{0}, NONCE_SIZE)
+	if _, err := conn.Write(append(nonce, 0, 0, 0, 1, agent.SSH_AGENTC_REQUEST_IDENTITIES)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server closes the connection without answering, it may be reset as the request wasn't read
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(make([]byte, 64))
+	var netError net.Error
+	if err == nil || errors.As(err, &netError) && netError.Timeout() {
+		t.Fatalf("read %d bytes, %v, want the connection closed", n, err)
+	}
+}
+
+func TestStaleSocketFile(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "S.gpg-agent.ssh")
+
+	// Socket file of an agent which didn't stop properly, nothing listens on its port anymore
+	_, portText, err := net.SplitHostPort(agentTest.FreeAddress(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := writeSocketFile(socketPath, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve(t, socketPath)
+
+	socket, err := readSocketFile(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(socket.nonce, stale.nonce) {
+		t.Error("stale socket file not replaced")
+	}
+}
+
+func TestUnavailableSocketFile(t *testing.T) {
+	activePath := filepath.Join(t.TempDir(), "S.gpg-agent.ssh")
+	serve(t, activePath)
+
+	unrelatedPath := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(unrelatedPath, []byte("not a socket file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "directory", path: t.TempDir()},
+		{name: "unrelated file", path: unrelatedPath},
+		{name: "active socket file", path: activePath},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, err := os.Stat(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := os.ReadFile(test.path)
+
+			ctx := agent.CreateAgent()
+			if err := ServeAssuanSocket(test.path, &ctx); err == nil {
+				t.Fatal("ServeAssuanSocket() succeeded, want an error")
+			}
+
+			after, err := os.Stat(test.path)
+			if err != nil {
+				t.Fatalf("%s removed: %v", test.path, err)
+			}
+			newContent, _ := os.ReadFile(test.path)
+			if after.Mode() != before.Mode() || !bytes.Equal(newContent, content) {
+				t.Errorf("%s modified", test.path)
+			}
+		})
+	}
+}
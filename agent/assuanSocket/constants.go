@@ -0,0 +1,15 @@
+package assuanSocket
+
+import "time"
+
+const (
+	PackageName  = "assuan-socket"
+	EndpointName = "assuan"
+)
+
+const (
+	// NONCE_SIZE is the size of the nonce sent by clients before the agent protocol
+	NONCE_SIZE = 16
+	// HANDSHAKE_TIMEOUT is the time given to clients to send the nonce
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+)
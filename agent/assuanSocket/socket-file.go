@@ -0,0 +1,87 @@
+package assuanSocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var ErrBadSocketFile = errors.New("not an assuan socket file")
+
+// socketFile is the content of a libassuan emulated socket file: the TCP port on loopback
+// as a decimal number and a newline, followed by the nonce
+type socketFile struct {
+	port  int
+	nonce []byte
+}
+
+func parseSocketFile(data []byte) (*socketFile, error) {
+	portText, nonce, found := bytes.Cut(data, []byte("\n"))
+	if !found || len(nonce) != NONCE_SIZE {
+		return nil, ErrBadSocketFile
+	}
+
+	port, err := strconv.Atoi(string(portText))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, ErrBadSocketFile
+	}
+
+	return &socketFile{port: port, nonce: nonce}, nil
+}
+
+func readSocketFile(socketPath string) (*socketFile, error) {
+	data, err := os.ReadFile(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: opening %q: %w", PackageName, socketPath, err)
+	}
+
+	socket, err := parseSocketFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", PackageName, socketPath, err)
+	}
+
+	return socket, nil
+}
+
+func (s *socketFile) address() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(s.port))
+}
+
+func (s *socketFile) marshal() []byte {
+	return append([]byte(strconv.Itoa(s.port)+"\n"), s.nonce...)
+}
+
+// writeSocketFile writes a socket file with a new nonce for a listener on port
+func writeSocketFile(socketPath string, port int) (*socketFile, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("%s: failed to generate a random nonce: %w", PackageName, err)
+	}
+	socket := &socketFile{port: port, nonce: nonce}
+
+	// Write then rename so clients never read a partial file
+	temporaryFile, err := os.CreateTemp(filepath.Dir(socketPath), filepath.Base(socketPath)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to create socket file: %w", PackageName, err)
+	}
+	defer os.Remove(temporaryFile.Name())
+
+	_, err = temporaryFile.Write(socket.marshal())
+	if closeErr := temporaryFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to write socket file: %w", PackageName, err)
+	}
+
+	if err := os.Rename(temporaryFile.Name(), socketPath); err != nil {
+		return nil, fmt.Errorf("%s: failed to write file %s: %w", PackageName, socketPath, err)
+	}
+
+	return socket, nil
+}
@@ -0,0 +1,229 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/amurzeau/ssh-agent-bridge/paths"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DEFAULT_CERTIFICATE_VALIDITY = time.Hour
+	// Certificates are valid a bit before being issued, in case the server clock is late
+	CERTIFICATE_BACKDATE = 5 * time.Minute
+)
+
+// Extensions of certificates issued by ssh-keygen by default
+var DefaultExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// AuthorityConfig is the certificate-authority section of the configuration file
+type AuthorityConfig struct {
+	// KeyFile is the unencrypted private key of the certificate authority
+	KeyFile    string   `json:"key-file"`
+	Principals []string `json:"principals"`
+	// Validity is a duration like "1h", default to DEFAULT_CERTIFICATE_VALIDITY
+	Validity string `json:"validity"`
+	// Extensions default to DefaultExtensions, an empty list gives no extension
+	Extensions      []string          `json:"extensions"`
+	CriticalOptions map[string]string `json:"critical-options"`
+}
+
+// authority issues short-lived user certificates for the upstream keys
+type authority struct {
+	signer          ssh.Signer
+	principals      []string
+	validity        time.Duration
+	extensions      map[string]string
+	criticalOptions map[string]string
+
+	lock sync.Mutex
+	// issued certificates by key fingerprint, previous ones are kept for clients that listed them before the renewal
+	issued   map[string]*certificateFile
+	previous map[string]*certificateFile
+}
+
+func newAuthority(config *AuthorityConfig) (*authority, error) {
+	keyFile, err := paths.ExpandHome(config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't find %s: %w", PackageName, config.KeyFile, err)
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't read certificate authority key: %w", PackageName, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't parse certificate authority key %s, encrypted keys are not supported: %w", PackageName, keyFile, err)
+	}
+
+	// ssh-rsa signatures use SHA-1, refused by recent OpenSSH servers
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		signer = &rsaSHA512Signer{algorithmSigner}
+	}
+
+	if len(config.Principals) == 0 {
+		return nil, fmt.Errorf("%s: certificate authority without principals", PackageName)
+	}
+
+	validity := DEFAULT_CERTIFICATE_VALIDITY
+	if config.Validity != "" {
+		if validity, err = time.ParseDuration(config.Validity); err != nil || validity <= 0 {
+			return nil, fmt.Errorf("%s: bad certificate validity %s", PackageName, config.Validity)
+		}
+	}
+
+	extensionNames := config.Extensions
+	if extensionNames == nil {
+		extensionNames = DefaultExtensions
+	}
+	extensions := map[string]string{}
+	for _, extension := range extensionNames {
+		extensions[extension] = ""
+	}
+
+	return &authority{
+		signer:          signer,
+		principals:      config.Principals,
+		validity:        validity,
+		extensions:      extensions,
+		criticalOptions: config.CriticalOptions,
+		issued:          map[string]*certificateFile{},
+		previous:        map[string]*certificateFile{},
+	}, nil
+}
+
+func (a *authority) issue(identity *agent.Identity) (*certificateFile, error) {
+	key, err := ssh.ParsePublicKey(identity.KeyBlob)
+	if err != nil {
+		return nil, err
+	}
+	if _, isCertificate := key.(*ssh.Certificate); isCertificate {
+		return nil, nil
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	fingerprint := agent.Fingerprint(identity.KeyBlob)
+	certificate := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("ssh-agent-bridge %s %s", fingerprint, identity.Comment),
+		ValidPrincipals: a.principals,
+		ValidAfter:      uint64(now.Add(-CERTIFICATE_BACKDATE).Unix()),
+		ValidBefore:     uint64(now.Add(a.validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: a.criticalOptions,
+			Extensions:      a.extensions,
+		},
+	}
+	if err := certificate.SignCert(rand.Reader, a.signer); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("%s: issued certificate for %s valid until %v", PackageName, fingerprint, now.Add(a.validity).Format(time.RFC3339))
+
+	return &certificateFile{
+		modTime:     now,
+		certificate: certificate,
+		blob:        certificate.Marshal(),
+		comment:     string(identity.Comment),
+	}, nil
+}
+
+// currentLocked returns the certificate of identity, issuing a new one when a quarter of the validity is left.
+// It returns nil for identities which are already certificates. a.lock must be held.
+func (a *authority) currentLocked(identity *agent.Identity) (*certificateFile, error) {
+	fingerprint := agent.Fingerprint(identity.KeyBlob)
+
+	issued, ok := a.issued[fingerprint]
+	if ok && issued.valid(time.Now().Add(a.validity/4)) {
+		return issued, nil
+	}
+
+	certificate, err := a.issue(identity)
+	if err != nil || certificate == nil {
+		return nil, err
+	}
+	if ok {
+		a.previous[fingerprint] = issued
+	}
+	a.issued[fingerprint] = certificate
+
+	return certificate, nil
+}
+
+// certificatesFor returns the certificates of the identities, issuing new ones when a quarter of the validity is left
+func (a *authority) certificatesFor(identities []agent.Identity) []*certificateFile {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var certificates []*certificateFile
+	for i := range identities {
+		certificate, err := a.currentLocked(&identities[i])
+		if err != nil {
+			log.Errorf("%s: can't issue certificate for %s: %v", PackageName, agent.Fingerprint(identities[i].KeyBlob), err)
+			continue
+		}
+		if certificate != nil {
+			certificates = append(certificates, certificate)
+		}
+	}
+
+	return certificates
+}
+
+// find returns an issued certificate by blob.
+// A certificate used inside its renewal window is renewed, for clients which don't list identities again before it expires.
+func (a *authority) find(blob []byte) *certificateFile {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, certificate := range a.issued {
+		if !bytes.Equal(certificate.blob, blob) {
+			continue
+		}
+
+		identity := agent.Identity{KeyBlob: certificate.certificate.Key.Marshal(), Comment: []byte(certificate.comment)}
+		if _, err := a.currentLocked(&identity); err != nil {
+			log.Errorf("%s: can't renew certificate for %s: %v", PackageName, agent.Fingerprint(identity.KeyBlob), err)
+		}
+		return certificate
+	}
+
+	for _, certificate := range a.previous {
+		if bytes.Equal(certificate.blob, blob) {
+			return certificate
+		}
+	}
+	return nil
+}
+
+// rsaSHA512Signer signs with rsa-sha2-512 instead of ssh-rsa
+type rsaSHA512Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s *rsaSHA512Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2512)
+}
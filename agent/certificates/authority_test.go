@@ -0,0 +1,246 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+	"golang.org/x/crypto/ssh"
+	xagent "golang.org/x/crypto/ssh/agent"
+)
+
+// newAuthorityKey writes a certificate authority key and returns its file and public key
+func newAuthorityKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "ca")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, publicKey
+}
+
+// newCertificateAgent returns a client of an agent adding certificates issued by a new authority to an upstream keyring
+func newCertificateAgent(t *testing.T, validity string) (xagent.ExtendedAgent, *Certificates, ssh.PublicKey) {
+	t.Helper()
+
+	keyFile, caKey := newAuthorityKey(t)
+	c, err := New(nil, &AuthorityConfig{KeyFile: keyFile, Principals: []string{"me"}, Validity: validity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := agent.CreateAgent()
+	ctx.Use(c.Middleware)
+	agentTest.ServeUpstream(&ctx, agentTest.NewKeyring(t, "key"))
+	t.Cleanup(func() { agentTest.Stop(&ctx) })
+
+	return agentTest.Client(&ctx, "test"), c, caKey
+}
+
+// serveSsh runs an in-process sshd accepting user certificates of caKey for me, and returns its address
+func serveSsh(t *testing.T, caKey ssh.PublicKey) string {
+	t.Helper()
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caKey.Marshal())
+		},
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					newChannel.Reject(ssh.Prohibited, "no channel")
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// login authenticates to address as me with the keys of client, only certificates are offered
+func login(client xagent.ExtendedAgent, address string) error {
+	certificateSigners := func() ([]ssh.Signer, error) {
+		signers, err := client.Signers()
+		if err != nil {
+			return nil, err
+		}
+		var certificates []ssh.Signer
+		for _, signer := range signers {
+			// Agent signers keys are *xagent.Key, not *ssh.Certificate
+			if strings.HasSuffix(signer.PublicKey().Type(), "-cert-v01@openssh.com") {
+				certificates = append(certificates, signer)
+			}
+		}
+		return certificates, nil
+	}
+
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "me",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(certificateSigners)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// listedCertificate returns the only certificate listed by client
+func listedCertificate(t *testing.T, client xagent.ExtendedAgent) *ssh.Certificate {
+	t.Helper()
+
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certificates []*ssh.Certificate
+	for _, key := range keys {
+		publicKey, err := ssh.ParsePublicKey(key.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certificate, ok := publicKey.(*ssh.Certificate); ok {
+			certificates = append(certificates, certificate)
+		}
+	}
+	if len(certificates) != 1 || len(keys) != 2 {
+		t.Fatalf("listed %d keys with %d certificates, want the key and its certificate", len(keys), len(certificates))
+	}
+	return certificates[0]
+}
+
+func TestIssuedCertificateLogin(t *testing.T) {
+	client, _, caKey := newCertificateAgent(t, "1h")
+	address := serveSsh(t, caKey)
+
+	certificate := listedCertificate(t, client)
+	if len(certificate.ValidPrincipals) != 1 || certificate.ValidPrincipals[0] != "me" {
+		t.Errorf("principals = %v", certificate.ValidPrincipals)
+	}
+	if validity := time.Until(time.Unix(int64(certificate.ValidBefore), 0)); validity > time.Hour || validity < 59*time.Minute {
+		t.Errorf("certificate valid for %v, want 1h", validity)
+	}
+
+	if err := login(client, address); err != nil {
+		t.Fatalf("login with the issued certificate: %v", err)
+	}
+
+	// Another certificate authority isn't trusted
+	_, otherCaKey := newAuthorityKey(t)
+	if err := login(client, serveSsh(t, otherCaKey)); err == nil {
+		t.Error("login worked with an untrusted certificate authority")
+	}
+}
+
+func TestRenewOnSign(t *testing.T) {
+	client, c, caKey := newCertificateAgent(t, "1h")
+	address := serveSsh(t, caKey)
+
+	certificate := listedCertificate(t, client)
+
+	// The certificate is now in the renewal window, without listing identities again
+	c.authority.lock.Lock()
+	c.authority.validity = 8 * time.Hour
+	c.authority.lock.Unlock()
+
+	data := []byte("data")
+	signature, err := client.Sign(certificate, data)
+	if err != nil {
+		t.Fatalf("sign with the certificate inside its renewal window: %v", err)
+	}
+	if err := certificate.Key.Verify(data, signature); err != nil {
+		t.Errorf("signature not made by the certified key: %v", err)
+	}
+
+	c.authority.lock.Lock()
+	renewed := c.authority.issued[agent.Fingerprint(certificate.Key.Marshal())]
+	c.authority.lock.Unlock()
+	if renewed == nil || bytes.Equal(renewed.blob, certificate.Marshal()) {
+		t.Fatal("certificate not renewed after a signature inside its renewal window")
+	}
+	if renewed.certificate.ValidBefore <= certificate.ValidBefore {
+		t.Errorf("renewed certificate valid before %d, not after %d", renewed.certificate.ValidBefore, certificate.ValidBefore)
+	}
+
+	// The previous certificate still works, the renewed one is listed
+	if _, err := client.Sign(certificate, data); err != nil {
+		t.Errorf("sign with the previous certificate: %v", err)
+	}
+	if listed := listedCertificate(t, client); !bytes.Equal(listed.Marshal(), renewed.blob) {
+		t.Error("renewed certificate not listed")
+	}
+	if err := login(client, address); err != nil {
+		t.Fatalf("login with the renewed certificate: %v", err)
+	}
+}
+
+func TestExpiredCertificate(t *testing.T) {
+	client, c, _ := newCertificateAgent(t, "1h")
+	certificate := listedCertificate(t, client)
+
+	// Expire the issued certificate
+	c.authority.lock.Lock()
+	for _, issued := range c.authority.issued {
+		issued.certificate.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+	}
+	c.authority.lock.Unlock()
+
+	if _, err := client.Sign(certificate, []byte("data")); err == nil {
+		t.Error("signature with an expired certificate worked")
+	}
+}
@@ -0,0 +1,243 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/amurzeau/ssh-agent-bridge/paths"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateFile is a *-cert.pub file, reloaded when it changes
+type certificateFile struct {
+	modTime     time.Time
+	certificate *ssh.Certificate
+	blob        []byte
+	comment     string
+}
+
+func (c *certificateFile) valid(now time.Time) bool {
+	unix := uint64(now.Unix())
+	return c.certificate.ValidAfter <= unix && (c.certificate.ValidBefore == ssh.CertTimeInfinity || unix < c.certificate.ValidBefore)
+}
+
+// Certificates lists OpenSSH certificates next to the upstream keys they certify,
+// and translates sign requests of certificates to sign requests of their key
+type Certificates struct {
+	// patterns are file paths or glob patterns like ~/.ssh/*-cert.pub
+	patterns []string
+	// authority issues certificates for all upstream keys, can be nil
+	authority *authority
+
+	lock  sync.Mutex
+	files map[string]*certificateFile
+}
+
+// New loads the certificates of the files matching the patterns, and issues certificates for
+// the upstream keys if authorityConfig is not nil
+func New(patterns []string, authorityConfig *AuthorityConfig) (*Certificates, error) {
+	c := &Certificates{
+		files: map[string]*certificateFile{},
+	}
+
+	if authorityConfig != nil {
+		var err error
+		if c.authority, err = newAuthority(authorityConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pattern := range patterns {
+		expanded, err := paths.ExpandHome(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't find %s: %w", PackageName, pattern, err)
+		}
+		if _, err := filepath.Match(expanded, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %s: %w", PackageName, pattern, err)
+		}
+		c.patterns = append(c.patterns, expanded)
+	}
+
+	c.reload()
+
+	return c, nil
+}
+
+func loadCertificate(path string, modTime time.Time) (*certificateFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate")
+	}
+	if certificate.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+
+	return &certificateFile{
+		modTime:     modTime,
+		certificate: certificate,
+		blob:        certificate.Marshal(),
+		comment:     comment,
+	}, nil
+}
+
+// reload reads new and modified certificate files
+func (c *Certificates) reload() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files := map[string]*certificateFile{}
+	for _, pattern := range c.patterns {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if previous, ok := c.files[path]; ok && previous.modTime.Equal(info.ModTime()) {
+				files[path] = previous
+				continue
+			}
+
+			file, err := loadCertificate(path, info.ModTime())
+			if err != nil {
+				log.Errorf("%s: can't load %s: %v", PackageName, path, err)
+				continue
+			}
+			log.Infof("%s: loaded %s for key %s", PackageName, path, agent.Fingerprint(file.certificate.Key.Marshal()))
+			files[path] = file
+		}
+	}
+
+	c.files = files
+}
+
+// valid returns the certificates currently valid
+func (c *Certificates) valid() []*certificateFile {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	var valid []*certificateFile
+	for _, file := range c.files {
+		if file.valid(now) {
+			valid = append(valid, file)
+		}
+	}
+	return valid
+}
+
+// addCertificates lists each valid certificate before the upstream key it certifies
+func (c *Certificates) addCertificates(reply agent.AgentMessageReply) agent.AgentMessageReply {
+	identities, err := agent.ParseIdentitiesAnswer(reply.Data)
+	if err != nil {
+		return reply
+	}
+
+	c.reload()
+	certificates := c.valid()
+	if c.authority != nil {
+		certificates = append(certificates, c.authority.certificatesFor(identities)...)
+	}
+	if len(certificates) == 0 {
+		return reply
+	}
+
+	withCertificates := make([]agent.Identity, 0, len(identities)+len(certificates))
+	for _, identity := range identities {
+		for _, certificate := range certificates {
+			if bytes.Equal(certificate.certificate.Key.Marshal(), identity.KeyBlob) {
+				comment := []byte(certificate.comment)
+				if len(comment) == 0 {
+					comment = identity.Comment
+				}
+				withCertificates = append(withCertificates, agent.Identity{KeyBlob: certificate.blob, Comment: comment})
+			}
+		}
+		withCertificates = append(withCertificates, identity)
+	}
+
+	return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(withCertificates)}
+}
+
+// find returns a certificate by blob and its origin, or nil
+func (c *Certificates) find(blob []byte) (*certificateFile, string) {
+	c.lock.Lock()
+	for path, file := range c.files {
+		if bytes.Equal(file.blob, blob) {
+			c.lock.Unlock()
+			return file, path
+		}
+	}
+	c.lock.Unlock()
+
+	if c.authority != nil {
+		if issued := c.authority.find(blob); issued != nil {
+			return issued, "issued certificate"
+		}
+	}
+	return nil, ""
+}
+
+// translateSignRequest returns the sign request for the key of a certificate, or nil if the query doesn't use a certificate
+func (c *Certificates) translateSignRequest(conn *agent.Connection, query []byte) ([]byte, error) {
+	keyBlob, data, flags, err := agent.ParseSignRequest(query)
+	if err != nil {
+		return nil, nil
+	}
+
+	file, origin := c.find(keyBlob)
+	if file == nil {
+		return nil, nil
+	}
+	if !file.valid(time.Now()) {
+		return nil, fmt.Errorf("%s: certificate %s is expired", PackageName, origin)
+	}
+
+	log.Debugf("%s: signing with the key of %s for %s", PackageName, origin, conn)
+
+	flagsBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(flagsBytes, flags)
+	return agent.NewAgentMessage(agent.SSH_AGENTC_SIGN_REQUEST,
+		agent.MarshalString(file.certificate.Key.Marshal()),
+		agent.MarshalString(data),
+		flagsBytes), nil
+}
+
+func (c *Certificates) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		switch agent.MessageType(query) {
+		case agent.SSH_AGENTC_REQUEST_IDENTITIES:
+			return c.addCertificates(next(conn, query))
+
+		case agent.SSH_AGENTC_SIGN_REQUEST:
+			translated, err := c.translateSignRequest(conn, query)
+			if err != nil {
+				log.Infof("%s: refusing signature for %s: %v", PackageName, conn, err)
+				return agent.AGENT_MESSAGE_ERROR_REPLY
+			}
+			if translated != nil {
+				return next(conn, translated)
+			}
+		}
+
+		return next(conn, query)
+	}
+}
@@ -0,0 +1,112 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeCertificate writes a user certificate of key signed by ca, valid until validBefore, with a modification time of modTime
+func writeCertificate(t *testing.T, file string, key ssh.PublicKey, ca ssh.Signer, validBefore time.Time, modTime time.Time) *ssh.Certificate {
+	t.Helper()
+
+	certificate := &ssh.Certificate{
+		Key:             key,
+		Serial:          uint64(modTime.UnixNano()),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"me"},
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := certificate.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	line := append(bytes.TrimSpace(ssh.MarshalAuthorizedKey(certificate)), []byte(" file-cert\n")...)
+	if err := os.WriteFile(file, line, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestCertificateFile(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agentTest.NewKeyring(t, "key")
+	keys, err := keyring.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("upstream keys %v: %v", keys, err)
+	}
+	key, err := ssh.ParsePublicKey(keys[0].Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certificateFile := filepath.Join(dir, "id_ed25519-cert.pub")
+	now := time.Now()
+	certificate := writeCertificate(t, certificateFile, key, ca, now.Add(time.Hour), now)
+
+	c, err := New([]string{filepath.Join(dir, "*-cert.pub")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := agent.CreateAgent()
+	ctx.Use(c.Middleware)
+	agentTest.ServeUpstream(&ctx, keyring)
+	t.Cleanup(func() { agentTest.Stop(&ctx) })
+	client := agentTest.Client(&ctx, "test")
+
+	listed, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || !bytes.Equal(listed[0].Blob, certificate.Marshal()) || listed[0].Comment != "file-cert" {
+		t.Fatalf("listed %v, want the certificate before its key", listed)
+	}
+
+	// Sign requests of the certificate are made with its key
+	data := []byte("data")
+	signature, err := client.Sign(certificate, data)
+	if err != nil {
+		t.Fatalf("sign with the certificate: %v", err)
+	}
+	if err := key.Verify(data, signature); err != nil {
+		t.Errorf("signature not made by the certified key: %v", err)
+	}
+
+	// Expired certificates are hidden and can't sign
+	expired := writeCertificate(t, certificateFile, key, ca, now.Add(-time.Minute), now.Add(time.Second))
+	if listed, err := client.List(); err != nil || len(listed) != 1 {
+		t.Errorf("listed %v after the certificate expired: %v", listed, err)
+	}
+	if _, err := client.Sign(expired, data); err == nil {
+		t.Error("signature with an expired certificate worked")
+	}
+
+	// Rewritten certificates are reloaded
+	renewed := writeCertificate(t, certificateFile, key, ca, now.Add(time.Hour), now.Add(2*time.Second))
+	if listed := listedCertificate(t, client); !bytes.Equal(listed.Marshal(), renewed.Marshal()) {
+		t.Error("rewritten certificate not listed")
+	}
+	if _, err := client.Sign(renewed, data); err != nil {
+		t.Errorf("sign with the rewritten certificate: %v", err)
+	}
+}
@@ -0,0 +1,3 @@
+package certificates
+
+const PackageName = "certificates"
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	activatedFilesLock sync.Mutex
+	activatedFiles     map[string]*os.File
+)
+
+// ActivationName returns the name of the socket passed by the service manager for a listener.
+// Names can't contain ':', so container:name is container.name
+func ActivationName(listenerName string) string {
+	return strings.Replace(listenerName, ":", ".", 1)
+}
+
+// ListenerName is the inverse of ActivationName
+func ListenerName(activationName string) string {
+	return strings.Replace(activationName, ".", ":", 1)
+}
+
+// SetActivatedFiles registers the sockets passed by the service manager indexed by their activation name
+func SetActivatedFiles(files map[string]*os.File) {
+	activatedFilesLock.Lock()
+	defer activatedFilesLock.Unlock()
+
+	activatedFiles = files
+}
+
+// ActivatedFile returns the socket passed by the service manager for a listener.
+// The file stays open so the listener can be created again after a restart, listeners must be created from a copy.
+func ActivatedFile(listenerName string) (*os.File, bool) {
+	activatedFilesLock.Lock()
+	defer activatedFilesLock.Unlock()
+
+	file, ok := activatedFiles[ActivationName(listenerName)]
+	return file, ok
+}
@@ -2,18 +2,20 @@ package common
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"time"
 
-	"github.com/Microsoft/go-winio"
 	"github.com/amurzeau/ssh-agent-bridge/agent"
 	"github.com/amurzeau/ssh-agent-bridge/log"
 )
 
 var ErrConnectionFailedMustRetry = errors.New("connection failed but should be retried")
 
-func handleClientRead(processName string, c net.Conn, ctx *agent.AgentContext, replyChannel chan agent.AgentMessageReply) {
-	defer c.Close()
+func handleClientRead(logger *log.Logger, c net.Conn, client *agent.Connection, ctx *agent.AgentContext, replyChannel chan agent.AgentMessageReply) {
+	// The connection is closed by handleClientWrite once the last reply is written
 	defer close(replyChannel)
 
 	doneChannel := make(chan bool)
@@ -22,58 +24,73 @@ func handleClientRead(processName string, c net.Conn, ctx *agent.AgentContext, r
 	go func() {
 		select {
 		case <-ctx.Done():
-			log.Debugf("%s: stopping connection", processName)
-			c.Close()
+			// Interrupt the pending read but keep the connection open so an in-flight query still gets its reply
+			logger.Debugf("stopping connection")
+			if err := c.SetReadDeadline(time.Now()); err != nil {
+				c.Close()
+			}
 		case <-doneChannel:
 		}
 	}()
 
-	log.Debugf("%s: client connected [%s]", processName, c.RemoteAddr().Network())
+	logger.Debugf("client connected [%s] from %s", c.RemoteAddr().Network(), client)
 
 	buf := make([]byte, 262144)
 	for {
 		n, err := agent.ReadAgentMessage(c, buf)
-		if errors.Is(err, net.ErrClosed) {
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
 			// intentional closing of network socket
 			break
 		} else if err != nil {
 			if err != io.EOF {
-				log.Debugf("%s: read error: %v\n", processName, err)
+				logger.Debugf("read error: %v", err)
 			}
 			break
 		}
 
-		message := agent.AgentMessageQuery{Data: buf[:n], ReplyChannel: replyChannel}
+		logger.Debugf("read %d data", n)
 
-		log.Debugf("%s: read %d data\n", processName, len(message.Data))
-
-		ctx.QueryChannel <- message
+		replyChannel <- ctx.Query(client, buf[:n])
 	}
-	log.Debugf("%s: client disconnected", processName)
+	logger.Debugf("client disconnected")
 }
 
-func handleClientWrite(processName string, c net.Conn, replyChannel chan agent.AgentMessageReply) {
+func handleClientWrite(logger *log.Logger, c net.Conn, replyChannel chan agent.AgentMessageReply) {
+	defer c.Close()
+
+	writeFailed := false
 	for message := range replyChannel {
-		log.Debugf("%s: write %d data\n", processName, len(message.Data))
+		// Keep receiving replies after a failure so handleClientRead is never blocked
+		if writeFailed {
+			continue
+		}
+
+		logger.Debugf("write %d data", len(message.Data))
 
 		_, err := c.Write(message.Data)
 		if err != nil {
 			if err != io.EOF {
-				log.Debugf("%s: write error: %v\n", processName, err)
+				logger.Debugf("write error: %v", err)
 			}
-			break
+			// Closing the connection interrupts the pending read
+			writeFailed = true
+			c.Close()
 		}
 	}
 }
 
-func HandleAgentConnection(processName string, conn net.Conn, ctx *agent.AgentContext) {
+func HandleAgentConnection(processName string, conn net.Conn, client *agent.Connection, ctx *agent.AgentContext) {
 	replyChannel := make(chan agent.AgentMessageReply)
+	logger := log.With(log.KEY_PACKAGE, processName, log.KEY_LISTENER, client.Listener, log.KEY_CONNECTION, client.ID)
+
+	ctx.ConnectionOpened()
 
 	ctx.Go(func() {
-		handleClientRead(processName, conn, ctx, replyChannel)
+		handleClientRead(logger, conn, client, ctx, replyChannel)
 	})
 	ctx.Go(func() {
-		handleClientWrite(processName, conn, replyChannel)
+		defer ctx.ConnectionClosed()
+		handleClientWrite(logger, conn, replyChannel)
 	})
 }
 
@@ -86,6 +103,7 @@ func GenericNetClient(packageName string, dialFunction func() (net.Conn, error),
 			conn, err := dialFunction()
 			if err != nil {
 				log.Errorf("%s: can't connect: %v", packageName, err)
+				ctx.UpstreamResult(err)
 				message.ReplyChannel <- agent.AGENT_MESSAGE_ERROR_REPLY
 				return
 			}
@@ -95,6 +113,7 @@ func GenericNetClient(packageName string, dialFunction func() (net.Conn, error),
 			n, err := conn.Write(message.Data)
 			if err != nil {
 				log.Errorf("%s: write failed, can't handle query, will try to reconnect: %v\n", packageName, err)
+				ctx.UpstreamResult(err)
 				message.ReplyChannel <- agent.AGENT_MESSAGE_ERROR_REPLY
 				return
 			}
@@ -103,12 +122,15 @@ func GenericNetClient(packageName string, dialFunction func() (net.Conn, error),
 			n, err = agent.ReadAgentMessage(conn, buf)
 			if err != nil {
 				log.Errorf("%s: reply read error, will try to reconnect: %v\n", packageName, err)
+				ctx.UpstreamResult(err)
 				message.ReplyChannel <- agent.AGENT_MESSAGE_ERROR_REPLY
 				return
 			}
 			log.Debugf("%s: read %d bytes", packageName, n)
+			ctx.UpstreamResult(nil)
 
-			message.ReplyChannel <- agent.AgentMessageReply{Data: buf[:n]}
+			// Copy the reply as buf is reused for the next query
+			message.ReplyChannel <- agent.AgentMessageReply{Data: append([]byte(nil), buf[:n]...)}
 		}()
 	}
 
@@ -117,32 +139,68 @@ func GenericNetClient(packageName string, dialFunction func() (net.Conn, error),
 	return nil
 }
 
-func GenericNetServer(packageName string, listenFunction func() (net.Listener, error), ctx *agent.AgentContext) {
+// PeerFunction retrieves information about the process connected to conn
+type PeerFunction func(conn net.Conn) agent.PeerInfo
+
+// lookupPeer runs peerFunction, the connection is closed to interrupt it when ctx is stopping
+func lookupPeer(conn net.Conn, peerFunction PeerFunction, ctx *agent.AgentContext) agent.PeerInfo {
+	doneChannel := make(chan bool)
+	defer close(doneChannel)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-doneChannel:
+		}
+	}()
+
+	return peerFunction(conn)
+}
+
+// GenericNetServer accepts agent connections until ctx is stopping, it returns an error if it can't accept anymore
+func GenericNetServer(packageName string, listenerName string, listenFunction func() (net.Listener, error), peerFunction PeerFunction, ctx *agent.AgentContext) error {
 	listener, err := listenFunction()
 	if err != nil {
-		log.Errorf("%s: listen error: %v", packageName, err)
-		return
+		return fmt.Errorf("%s: listen error: %w", packageName, err)
 	}
 	defer listener.Close()
 
+	ctx.ListenerReady(listenerName)
+
+	doneChannel := make(chan bool)
+	defer close(doneChannel)
+
 	go func() {
-		<-ctx.Done()
-		log.Debugf("%s: stopping", packageName)
-		listener.Close()
+		select {
+		case <-ctx.ListenerDone(listenerName):
+			log.Debugf("%s: stopping", packageName)
+			listener.Close()
+		case <-doneChannel:
+		}
 	}()
 
 	for {
 		conn, err := listener.Accept()
-		if errors.Is(err, net.ErrClosed) || errors.Is(err, winio.ErrPipeListenerClosed) {
+		if isListenerClosed(err) {
 			// intentional closing of network socket
 			break
 		} else if err != nil {
-			log.Errorf("%s: accept error: %v", packageName, err)
-			break
+			return fmt.Errorf("%s: accept error: %w", packageName, err)
 		}
 
-		HandleAgentConnection(packageName, conn, ctx)
+		// Look up the peer out of the accept loop, a TLS handshake with a silent client would block the others
+		ctx.Go(func() {
+			var peer agent.PeerInfo
+			if peerFunction != nil {
+				peer = lookupPeer(conn, peerFunction, ctx)
+			}
+
+			HandleAgentConnection(packageName, conn, agent.NewConnection(listenerName, peer), ctx)
+		})
 	}
 
 	log.Debugf("%s: stopped", packageName)
+
+	return nil
 }
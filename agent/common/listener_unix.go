@@ -0,0 +1,13 @@
+//go:build !windows
+
+package common
+
+import (
+	"errors"
+	"net"
+)
+
+// isListenerClosed returns true for errors returned by Accept when the listener was intentionally closed
+func isListenerClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
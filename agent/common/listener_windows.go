@@ -0,0 +1,13 @@
+package common
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// isListenerClosed returns true for errors returned by Accept when the listener was intentionally closed
+func isListenerClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, winio.ErrPipeListenerClosed)
+}
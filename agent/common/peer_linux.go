@@ -0,0 +1,37 @@
+package common
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"golang.org/x/sys/unix"
+)
+
+// UnixSocketPeer returns the client process of a unix socket connection using SO_PEERCRED
+func UnixSocketPeer(conn net.Conn) agent.PeerInfo {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return agent.PeerInfo{}
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return agent.PeerInfo{}
+	}
+
+	var cred *unix.Ucred
+	controlErr := rawConn.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if controlErr != nil || err != nil {
+		log.Debugf("common: can't get unix socket peer credentials: %v %v", controlErr, err)
+		return agent.PeerInfo{}
+	}
+
+	return agent.LookupPeer(agent.PeerInfo{
+		Pid: int(cred.Pid),
+		Uid: strconv.FormatUint(uint64(cred.Uid), 10),
+	})
+}
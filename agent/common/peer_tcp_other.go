@@ -0,0 +1,14 @@
+//go:build !windows
+
+package common
+
+import (
+	"net"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// LoopbackTcpPeer is not supported outside of Windows, TCP connections don't carry the client credentials
+func LoopbackTcpPeer(conn net.Conn) agent.PeerInfo {
+	return agent.PeerInfo{}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+const (
+	_AF_INET                         = 2
+	_TCP_TABLE_OWNER_PID_CONNECTIONS = 4
+	_ERROR_INSUFFICIENT_BUFFER       = 122
+)
+
+type _MIB_TCPROW_OWNER_PID struct {
+	dwState      uint32
+	dwLocalAddr  uint32
+	dwLocalPort  uint32
+	dwRemoteAddr uint32
+	dwRemotePort uint32
+	dwOwningPid  uint32
+}
+
+var winGetExtendedTcpTable = syscall.NewLazyDLL("iphlpapi.dll").NewProc("GetExtendedTcpTable")
+
+func tcpTablePort(port uint32) int {
+	// Ports are stored in network byte order in the low 16 bits
+	return int((port&0xff)<<8 | (port>>8)&0xff)
+}
+
+// TcpConnectionOwner returns the pid of the process owning the remote end of a loopback TCP connection
+func TcpConnectionOwner(conn net.Conn) (int, error) {
+	localAddr, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return 0, errors.New("not a TCP connection")
+	}
+
+	var tableSize uint32
+	var table []byte
+	for {
+		var tablePtr uintptr
+		if len(table) > 0 {
+			tablePtr = uintptr(unsafe.Pointer(&table[0]))
+		}
+
+		result, _, _ := winGetExtendedTcpTable.Call(tablePtr, uintptr(unsafe.Pointer(&tableSize)), 0, _AF_INET, _TCP_TABLE_OWNER_PID_CONNECTIONS, 0)
+		if result == 0 {
+			break
+		} else if result != _ERROR_INSUFFICIENT_BUFFER {
+			return 0, fmt.Errorf("GetExtendedTcpTable failed: %w", syscall.Errno(result))
+		}
+
+		table = make([]byte, tableSize)
+	}
+
+	if len(table) < 4 {
+		return 0, errors.New("empty TCP table")
+	}
+
+	numEntries := binary.LittleEndian.Uint32(table)
+	rowSize := unsafe.Sizeof(_MIB_TCPROW_OWNER_PID{})
+	for i := uintptr(0); i < uintptr(numEntries) && 4+(i+1)*rowSize <= uintptr(len(table)); i++ {
+		row := (*_MIB_TCPROW_OWNER_PID)(unsafe.Pointer(&table[4+i*rowSize]))
+
+		// The client side of the connection has our remote port as its local port
+		if tcpTablePort(row.dwLocalPort) == remoteAddr.Port && tcpTablePort(row.dwRemotePort) == localAddr.Port {
+			return int(row.dwOwningPid), nil
+		}
+	}
+
+	return 0, fmt.Errorf("no process found for connection from %s", remoteAddr)
+}
+
+// LoopbackTcpPeer returns the client process of a loopback TCP connection
+func LoopbackTcpPeer(conn net.Conn) agent.PeerInfo {
+	pid, err := TcpConnectionOwner(conn)
+	if err != nil {
+		log.Debugf("common: can't find TCP client process: %v", err)
+		return agent.PeerInfo{}
+	}
+
+	return agent.LookupPeer(agent.PeerInfo{Pid: pid})
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !linux
+
+package common
+
+import (
+	"net"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// UnixSocketPeer is not supported on this platform
+func UnixSocketPeer(conn net.Conn) agent.PeerInfo {
+	return agent.PeerInfo{}
+}
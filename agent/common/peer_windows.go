@@ -0,0 +1,34 @@
+package common
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+var winGetNamedPipeClientProcessId = syscall.NewLazyDLL("kernel32.dll").NewProc("GetNamedPipeClientProcessId")
+
+// NamedPipePeer returns the client process of a named pipe connection
+func NamedPipePeer(conn net.Conn) agent.PeerInfo {
+	pipe, ok := conn.(interface{ Fd() uintptr })
+	if !ok {
+		return agent.PeerInfo{}
+	}
+
+	var pid uint32
+	result, _, err := winGetNamedPipeClientProcessId.Call(pipe.Fd(), uintptr(unsafe.Pointer(&pid)))
+	if result == 0 {
+		log.Debugf("common: can't get named pipe client process: %v", err)
+		return agent.PeerInfo{}
+	}
+
+	return agent.LookupPeer(agent.PeerInfo{Pid: int(pid)})
+}
+
+// UnixSocketPeer is not supported for Windows AF_UNIX sockets
+func UnixSocketPeer(conn net.Conn) agent.PeerInfo {
+	return agent.PeerInfo{}
+}
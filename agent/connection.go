@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// PeerInfo describes the process on the other side of a client connection.
+// Fields are left empty when the listener can't retrieve them.
+type PeerInfo struct {
+	Pid              int
+	Uid              string
+	Executable       string
+	ParentPid        int
+	ParentExecutable string
+}
+
+// SessionBind is a binding of the connection to a SSH session sent with session-bind@openssh.com
+type SessionBind struct {
+	HostKey    []byte
+	SessionID  []byte
+	Forwarding bool
+}
+
+// Connection holds the state of a client connected to one of the listeners.
+// Queries of a connection are processed sequentially.
+type Connection struct {
+	// ID identifies the connection in logs
+	ID       uint64
+	Listener string
+	Peer     PeerInfo
+
+	SessionBinds []SessionBind
+	// SessionBindFailed is set when a session-bind was refused, later signatures must be refused too
+	SessionBindFailed bool
+
+	// queryCtx is the context of the query being processed, see QueryContext
+	queryCtx context.Context
+}
+
+var lastConnectionID uint64
+
+func NewConnection(listener string, peer PeerInfo) *Connection {
+	return &Connection{
+		ID:       atomic.AddUint64(&lastConnectionID, 1),
+		Listener: listener,
+		Peer:     peer,
+	}
+}
+
+func (c *Connection) queryContext() context.Context {
+	if c.queryCtx == nil {
+		return context.Background()
+	}
+	return c.queryCtx
+}
+
+func (c *Connection) String() string {
+	if c.Peer.Executable != "" {
+		return fmt.Sprintf("%s (pid %d, %s)", c.Listener, c.Peer.Pid, c.Peer.Executable)
+	} else if c.Peer.Pid != 0 {
+		return fmt.Sprintf("%s (pid %d)", c.Listener, c.Peer.Pid)
+	}
+	return c.Listener
+}
+
+// LookupPeer completes a PeerInfo with the user, executable and parent process of peer.Pid
+func LookupPeer(peer PeerInfo) PeerInfo {
+	if peer.Pid <= 0 {
+		return peer
+	}
+
+	lookupProcess(&peer)
+	if peer.ParentPid > 0 {
+		parent := PeerInfo{Pid: peer.ParentPid}
+		lookupProcess(&parent)
+		peer.ParentExecutable = parent.Executable
+	}
+
+	return peer
+}
@@ -0,0 +1,9 @@
+package containerSocket
+
+const (
+	PackageName  = "container-socket"
+	EndpointName = "container"
+
+	// SocketName is the name of the socket file created in the directory of each container
+	SocketName = "agent.sock"
+)
@@ -0,0 +1,125 @@
+package containerSocket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// ListenerName returns the listener name of a container, used to configure it like other listeners
+func ListenerName(container string) string {
+	return EndpointName + ":" + container
+}
+
+// SocketPath returns the socket of a container, its directory is meant to be mounted in the container
+func SocketPath(directory string, container string) string {
+	return filepath.Join(directory, container, SocketName)
+}
+
+func CheckContainerName(container string) error {
+	if container == "" || container == "." || container == ".." || strings.ContainsAny(container, `/\:`) {
+		return fmt.Errorf("%s: invalid container name %q", PackageName, container)
+	}
+	return nil
+}
+
+// prepareSocket creates the container directory and removes a stale socket
+func prepareSocket(socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("%s: can't create directory for %s: %w", PackageName, socketPath, err)
+	}
+
+	if _, err := os.Stat(socketPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: error while checking socket path %s: %w", PackageName, socketPath, err)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: socket %s already exists and is active", PackageName, socketPath)
+	}
+
+	log.Debugf("%s: removing stale socket %s", PackageName, socketPath)
+	if err := os.Remove(socketPath); err != nil {
+		return fmt.Errorf("%s: failed to remove stale socket %s: %w", PackageName, socketPath, err)
+	}
+
+	return nil
+}
+
+func serveContainer(directory string, container string, ctx *agent.AgentContext) error {
+	if activatedFile, ok := common.ActivatedFile(ListenerName(container)); ok {
+		log.Infof("%s: listening for agent requests of container %s on socket passed by systemd", PackageName, container)
+
+		listenFunction := func() (net.Listener, error) {
+			return net.FileListener(activatedFile)
+		}
+		return common.GenericNetServer(PackageName, ListenerName(container), listenFunction, common.UnixSocketPeer, ctx)
+	}
+
+	if directory == "" {
+		log.Errorf("%s: empty container directory, skipping serving for container %s", PackageName, container)
+		return nil
+	}
+
+	socketPath := SocketPath(directory, container)
+
+	if err := prepareSocket(socketPath); err != nil {
+		return fmt.Errorf("%s: container %s: %w", PackageName, container, err)
+	}
+
+	log.Infof("%s: listening for agent requests of container %s on %s", PackageName, container, socketPath)
+
+	// On cancel, remove the socket file
+	defer os.Remove(socketPath)
+
+	listenFunction := func() (net.Listener, error) {
+		return net.Listen("unix", socketPath)
+	}
+	return common.GenericNetServer(PackageName, ListenerName(container), listenFunction, common.UnixSocketPeer, ctx)
+}
+
+// ServeContainers creates a dedicated socket for each container in directory, each one is supervised as its own listener
+func ServeContainers(directory string, containers []string, ctx *agent.AgentContext) error {
+	if len(containers) == 0 {
+		log.Errorf("%s: no container configured, skipping serving for containers", PackageName)
+		return nil
+	}
+
+	var listenerNames []string
+	for _, container := range containers {
+		if err := CheckContainerName(container); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+
+		container := container
+		listenerNames = append(listenerNames, ListenerName(container))
+		ctx.Serve(ListenerName(container), func(ctx *agent.AgentContext) error {
+			return serveContainer(directory, container, ctx)
+		})
+	}
+
+	ctx.ListenerReady(EndpointName)
+	<-ctx.ListenerDone(EndpointName)
+
+	// Disabling the container listener disables all containers
+	select {
+	case <-ctx.Done():
+	default:
+		for _, name := range listenerNames {
+			ctx.DisableListener(name)
+		}
+	}
+
+	return nil
+}
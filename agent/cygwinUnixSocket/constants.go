@@ -1,3 +1,6 @@
 package cygwinUnixSocket
 
-const PackageName = "cygwin-unix-socket"
+const (
+	PackageName  = "cygwin-unix-socket"
+	EndpointName = "cygwin"
+)
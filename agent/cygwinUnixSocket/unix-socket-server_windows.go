@@ -15,21 +15,24 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
 
 	"github.com/amurzeau/ssh-agent-bridge/agent"
 	"github.com/amurzeau/ssh-agent-bridge/agent/common"
 	"github.com/amurzeau/ssh-agent-bridge/log"
 )
 
-func handshakeConnection(conn net.Conn, expectedCookie []byte) error {
+// handshakeConnection does the cygwin socket handshake and returns the peer process
+// information sent by the client
+func handshakeConnection(conn net.Conn, expectedCookie []byte) (agent.PeerInfo, error) {
 	cookie := make([]byte, 16)
 	_, err := io.ReadFull(conn, cookie)
 	if err != nil {
-		return fmt.Errorf("%s: couldn't read cookie: %w", PackageName, err)
+		return agent.PeerInfo{}, fmt.Errorf("%s: couldn't read cookie: %w", PackageName, err)
 	}
 
 	if !bytes.Equal(cookie, expectedCookie) {
-		return fmt.Errorf("%s: invalid cookie,\n"+
+		return agent.PeerInfo{}, fmt.Errorf("%s: invalid cookie,\n"+
 			"received: %s\n"+
 			"expected: %s",
 			PackageName,
@@ -43,7 +46,7 @@ func handshakeConnection(conn net.Conn, expectedCookie []byte) error {
 	identificationData := make([]byte, 12)
 	_, err = io.ReadFull(conn, identificationData)
 	if err != nil {
-		return fmt.Errorf("%s: couldn't read identification data: %w", PackageName, err)
+		return agent.PeerInfo{}, fmt.Errorf("%s: couldn't read identification data: %w", PackageName, err)
 	}
 
 	// Send back identification data
@@ -54,7 +57,16 @@ func handshakeConnection(conn net.Conn, expectedCookie []byte) error {
 	binary.LittleEndian.PutUint32(pidsUids[8:], 0)
 	conn.Write(pidsUids)
 
-	return nil
+	// The pid sent by the client is a cygwin pid, find the Windows process from the TCP connection
+	var peer agent.PeerInfo
+	if windowsPid, err := common.TcpConnectionOwner(conn); err == nil {
+		peer.Pid = windowsPid
+	} else {
+		log.Debugf("%s: can't find client process: %v", PackageName, err)
+	}
+	peer.Uid = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(identificationData[4:])), 10)
+
+	return agent.LookupPeer(peer), nil
 }
 
 func checkIfAvailableUnixSocket(socketPath string) error {
@@ -122,16 +134,15 @@ func writeSocketFile(socketPath string, listenPort int) ([]byte, error) {
 	return cookie, nil
 }
 
-func ServeUnixSocket(socketPath string, ctx *agent.AgentContext) {
+func ServeUnixSocket(socketPath string, ctx *agent.AgentContext) error {
 	if socketPath == "" {
 		log.Errorf("%s: empty socket path, skipping serving for ssh-agent queries", PackageName)
-		return
+		return nil
 	}
 
 	err := checkIfAvailableUnixSocket(socketPath)
 	if err != nil {
-		log.Errorf("%s: can't use this file as socket file: %s: %v", PackageName, socketPath, err)
-		return
+		return fmt.Errorf("%s: can't use this file as socket file: %s: %w", PackageName, socketPath, err)
 	}
 
 	log.Infof("%s: listening for ssh-agent requests on %s", PackageName, socketPath)
@@ -139,23 +150,29 @@ func ServeUnixSocket(socketPath string, ctx *agent.AgentContext) {
 	// Use 0 as the port to listen on a random available port
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Errorf("%s: failed to listen a TCP port: %v", PackageName, err)
-		return
+		return fmt.Errorf("%s: failed to listen a TCP port: %w", PackageName, err)
 	}
 	defer listener.Close()
 
 	cookie, err := writeSocketFile(socketPath, listener.Addr().(*net.TCPAddr).Port)
 	defer os.Remove(socketPath)
 	if err != nil {
-		log.Errorf("%s: failed create socket file %s: %v", PackageName, socketPath, err)
-		return
+		return fmt.Errorf("%s: failed create socket file %s: %w", PackageName, socketPath, err)
 	}
 
+	ctx.ListenerReady(EndpointName)
+
+	doneChannel := make(chan bool)
+	defer close(doneChannel)
+
 	// On cancel, close the listener which will cause defers to remove the socket file
 	go func() {
-		<-ctx.Done()
-		log.Debugf("%s: stopping", PackageName)
-		listener.Close()
+		select {
+		case <-ctx.ListenerDone(EndpointName):
+			log.Debugf("%s: stopping", PackageName)
+			listener.Close()
+		case <-doneChannel:
+		}
 	}()
 
 	for {
@@ -164,19 +181,20 @@ func ServeUnixSocket(socketPath string, ctx *agent.AgentContext) {
 			// intentional closing of network socket
 			break
 		} else if err != nil {
-			log.Errorf("%s: accept error: %v", PackageName, err)
-			break
+			return fmt.Errorf("%s: accept error: %w", PackageName, err)
 		}
 
-		err = handshakeConnection(conn, cookie)
+		peer, err := handshakeConnection(conn, cookie)
 		if err != nil {
 			log.Errorf("%s: handshake failed: %v", PackageName, err)
 			conn.Close()
 			continue
 		}
 
-		common.HandleAgentConnection(PackageName, conn, ctx)
+		common.HandleAgentConnection(PackageName, conn, agent.NewConnection(EndpointName, peer), ctx)
 	}
 
 	log.Debugf("%s: stopped", PackageName)
+
+	return nil
 }
@@ -5,6 +5,7 @@ import "encoding/binary"
 type AgentMessageQuery struct {
 	Data         []byte
 	ReplyChannel chan AgentMessageReply
+	Connection   *Connection
 }
 
 type AgentMessageReply struct {
@@ -14,10 +15,10 @@ type AgentMessageReply struct {
 const MAX_AGENT_MESSAGE_SIZE = 262144
 
 var AGENT_MESSAGE_ERROR_REPLY = agentMessageErrorReply()
+var AGENT_MESSAGE_SUCCESS_REPLY = AgentMessageReply{Data: NewAgentMessage(SSH_AGENT_SUCCESS)}
+var AGENT_MESSAGE_EXTENSION_FAILURE_REPLY = AgentMessageReply{Data: NewAgentMessage(SSH_AGENT_EXTENSION_FAILURE)}
 
 func agentMessageErrorReply() AgentMessageReply {
-	const SSH_AGENT_FAILURE = 5
-
 	failure := make([]byte, 5)
 	binary.BigEndian.PutUint32(failure, (uint32)(len(failure)-4))
 	failure[4] = SSH_AGENT_FAILURE
@@ -0,0 +1,5 @@
+package destinationConstraints
+
+const PackageName = "destination-constraints"
+
+const EXTENSION_RESTRICT_DESTINATION = "restrict-destination-v00@openssh.com"
@@ -0,0 +1,236 @@
+package destinationConstraints
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+// HopKey is a host key, or a certificate authority key trusted to sign host keys
+type HopKey struct {
+	Key  ssh.PublicKey
+	IsCA bool
+}
+
+// Hop identifies a host by its keys, User is a pattern only used for destination hops
+type Hop struct {
+	User     string
+	Hostname string
+	Keys     []HopKey
+}
+
+// Constraint allows a key to be used from one host to another.
+// A From hop without keys is the local machine.
+type Constraint struct {
+	From Hop
+	To   Hop
+}
+
+func parseHop(buf []byte) (Hop, error) {
+	var hop Hop
+
+	user, rest, err := agent.ReadString(buf)
+	if err != nil {
+		return hop, err
+	}
+	hostname, rest, err := agent.ReadString(rest)
+	if err != nil {
+		return hop, err
+	}
+	// reserved
+	if _, rest, err = agent.ReadString(rest); err != nil {
+		return hop, err
+	}
+
+	hop.User = string(user)
+	hop.Hostname = string(hostname)
+
+	for len(rest) > 0 {
+		keyBlob, after, err := agent.ReadString(rest)
+		if err != nil {
+			return hop, err
+		}
+		if len(after) < 1 {
+			return hop, agent.ErrMalformedMessage
+		}
+
+		key, err := ssh.ParsePublicKey(keyBlob)
+		if err != nil {
+			return hop, fmt.Errorf("bad hop key: %w", err)
+		}
+
+		hop.Keys = append(hop.Keys, HopKey{Key: key, IsCA: after[0] != 0})
+		rest = after[1:]
+	}
+
+	return hop, nil
+}
+
+// parseRestrictDestination parses the details of a restrict-destination-v00@openssh.com key constraint
+func parseRestrictDestination(details []byte) ([]Constraint, error) {
+	var constraints []Constraint
+
+	rest, after, err := agent.ReadString(details)
+	if err != nil {
+		return nil, err
+	}
+	if len(after) != 0 {
+		return nil, agent.ErrMalformedMessage
+	}
+
+	for len(rest) > 0 {
+		var constraintData []byte
+		constraintData, rest, err = agent.ReadString(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		fromData, constraintRest, err := agent.ReadString(constraintData)
+		if err != nil {
+			return nil, err
+		}
+		toData, _, err := agent.ReadString(constraintRest)
+		if err != nil {
+			return nil, err
+		}
+
+		var constraint Constraint
+		if constraint.From, err = parseHop(fromData); err != nil {
+			return nil, err
+		}
+		if constraint.To, err = parseHop(toData); err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, constraint)
+	}
+
+	return constraints, nil
+}
+
+// matchKey checks a host key bound with session-bind against the keys of a hop
+func (h *Hop) matchKey(hostKeyBlob []byte) bool {
+	if hostKeyBlob == nil {
+		return false
+	}
+
+	hostKey, err := ssh.ParsePublicKey(hostKeyBlob)
+	if err != nil {
+		return false
+	}
+
+	for _, hopKey := range h.Keys {
+		if !hopKey.IsCA {
+			if bytes.Equal(hopKey.Key.Marshal(), hostKeyBlob) {
+				return true
+			}
+			continue
+		}
+
+		cert, ok := hostKey.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert || !bytes.Equal(cert.SignatureKey.Marshal(), hopKey.Key.Marshal()) {
+			continue
+		}
+
+		now := uint64(time.Now().Unix())
+		if now < cert.ValidAfter || (cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore) {
+			continue
+		}
+
+		if h.Hostname != "" {
+			principalFound := false
+			for _, principal := range cert.ValidPrincipals {
+				if principal == h.Hostname {
+					principalFound = true
+					break
+				}
+			}
+			if !principalFound {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// permitted checks if one of the constraints allows going from fromKey to toKey.
+// fromKey is nil for the local machine, toKey is nil when checking only the origin,
+// user is empty when not checking a user authentication.
+func permitted(constraints []Constraint, fromKey []byte, toKey []byte, user string) bool {
+	for i := range constraints {
+		constraint := &constraints[i]
+
+		if fromKey == nil {
+			if constraint.From.Hostname != "" || len(constraint.From.Keys) != 0 {
+				continue
+			}
+		} else if !constraint.From.matchKey(fromKey) {
+			continue
+		}
+
+		if toKey != nil && !constraint.To.matchKey(toKey) {
+			continue
+		}
+
+		if constraint.To.User != "" && user != "" {
+			if matched, _ := path.Match(constraint.To.User, user); !matched {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// identityPermitted walks the hops bound to the connection and checks that each of them is allowed
+// by the constraints, in the same way as OpenSSH's ssh-agent.
+// user is the user being authenticated for sign requests, empty when listing identities.
+func identityPermitted(conn *agent.Connection, constraints []Constraint, user string) error {
+	if conn.SessionBindFailed {
+		return fmt.Errorf("a previous session-bind failed on this connection")
+	}
+
+	if len(conn.SessionBinds) == 0 {
+		// local use
+		return nil
+	}
+
+	for i := range conn.SessionBinds {
+		bind := &conn.SessionBinds[i]
+
+		var fromKey []byte
+		if i > 0 {
+			fromKey = conn.SessionBinds[i-1].HostKey
+		}
+
+		testUser := ""
+		if i == len(conn.SessionBinds)-1 {
+			testUser = user
+			if bind.Forwarding && user != "" {
+				return fmt.Errorf("signature requested on a forwarding hop")
+			}
+		} else if !bind.Forwarding {
+			return fmt.Errorf("key forwarded through a session bound for authentication")
+		}
+
+		if !permitted(constraints, fromKey, bind.HostKey, testUser) {
+			return fmt.Errorf("destination %s not permitted", agent.Fingerprint(bind.HostKey))
+		}
+	}
+
+	// When the agent is forwarded, only list keys that can be used beyond the last host
+	lastBind := &conn.SessionBinds[len(conn.SessionBinds)-1]
+	if lastBind.Forwarding && user == "" && !permitted(constraints, lastBind.HostKey, nil, "") {
+		return fmt.Errorf("key not usable beyond forwarding host %s", agent.Fingerprint(lastBind.HostKey))
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package destinationConstraints
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// HopConfig is a host in the configuration file, keys use the authorized_keys format
+type HopConfig struct {
+	User     string   `json:"user"`
+	Hostname string   `json:"hostname"`
+	HostKeys []string `json:"host-keys"`
+	CAKeys   []string `json:"ca-keys"`
+}
+
+type DestinationConfig struct {
+	// From is nil for the local machine
+	From *HopConfig `json:"from"`
+	To   HopConfig  `json:"to"`
+}
+
+// KeyConfig restricts a key, given by its SHA256 fingerprint, to some destinations
+type KeyConfig struct {
+	Key          string              `json:"key"`
+	Destinations []DestinationConfig `json:"destinations"`
+}
+
+type keyConstraints struct {
+	constraints []Constraint
+	// fromConfig is false for constraints intercepted from ADD_ID_CONSTRAINED queries
+	fromConfig bool
+}
+
+// DestinationConstraints enforces destination constraints of keys using the session-bind data of
+// each connection, so they work even with upstream agents that don't support them
+type DestinationConstraints struct {
+	// InterceptAddedConstraints accepts keys added with destination constraints. As the constraints are
+	// removed before adding the key upstream, they are lost when the bridge restarts and not enforced
+	// for the other clients of the upstream agent.
+	InterceptAddedConstraints bool
+
+	lock sync.Mutex
+	// constraints by key fingerprint
+	keys map[string]*keyConstraints
+}
+
+func parseHopConfig(config *HopConfig) (Hop, error) {
+	hop := Hop{
+		User:     config.User,
+		Hostname: config.Hostname,
+	}
+
+	for i, keys := range [][]string{config.HostKeys, config.CAKeys} {
+		for _, keyString := range keys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
+			if err != nil {
+				return hop, fmt.Errorf("%s: bad key %q: %w", PackageName, keyString, err)
+			}
+			hop.Keys = append(hop.Keys, HopKey{Key: key, IsCA: i == 1})
+		}
+	}
+
+	return hop, nil
+}
+
+func New(config []KeyConfig) (*DestinationConstraints, error) {
+	d := &DestinationConstraints{
+		keys: map[string]*keyConstraints{},
+	}
+
+	for _, keyConfig := range config {
+		entry := &keyConstraints{fromConfig: true}
+
+		for _, destination := range keyConfig.Destinations {
+			var constraint Constraint
+			var err error
+
+			if destination.From != nil {
+				if constraint.From, err = parseHopConfig(destination.From); err != nil {
+					return nil, err
+				}
+			}
+			if constraint.To, err = parseHopConfig(&destination.To); err != nil {
+				return nil, err
+			}
+			if len(constraint.To.Keys) == 0 {
+				return nil, fmt.Errorf("%s: key %s: destination without host key", PackageName, keyConfig.Key)
+			}
+
+			entry.constraints = append(entry.constraints, constraint)
+		}
+
+		d.keys[keyConfig.Key] = entry
+	}
+
+	return d, nil
+}
+
+func (d *DestinationConstraints) get(fingerprint string) []Constraint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if entry, ok := d.keys[fingerprint]; ok {
+		return entry.constraints
+	}
+	return nil
+}
+
+func (d *DestinationConstraints) setIntercepted(fingerprint string, constraints []Constraint) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if entry, ok := d.keys[fingerprint]; ok && entry.fromConfig {
+		if constraints != nil {
+			log.Infof("%s: keeping configured constraints for key %s", PackageName, fingerprint)
+		}
+		return
+	}
+
+	if constraints == nil {
+		delete(d.keys, fingerprint)
+	} else {
+		d.keys[fingerprint] = &keyConstraints{constraints: constraints}
+	}
+}
+
+func (d *DestinationConstraints) removeAllIntercepted() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for fingerprint, entry := range d.keys {
+		if !entry.fromConfig {
+			delete(d.keys, fingerprint)
+		}
+	}
+}
+
+// handleAddIdentity strips the destination constraint before forwarding the key upstream
+// and records it once the key is added, if InterceptAddedConstraints is set
+func (d *DestinationConstraints) handleAddIdentity(conn *agent.Connection, query []byte, next agent.QueryHandler) agent.AgentMessageReply {
+	identity, err := agent.ParseAddIdentity(query)
+	if err != nil {
+		log.Debugf("%s: can't parse added identity, forwarding it as is: %v", PackageName, err)
+		return next(conn, query)
+	}
+
+	var constraints []Constraint
+	var otherConstraints []agent.KeyConstraint
+	for _, keyConstraint := range identity.Constraints {
+		if keyConstraint.Type == agent.SSH_AGENT_CONSTRAIN_EXTENSION && keyConstraint.Extension == EXTENSION_RESTRICT_DESTINATION {
+			parsed, err := parseRestrictDestination(keyConstraint.Details)
+			if err != nil {
+				log.Errorf("%s: bad destination constraint from %s: %v", PackageName, conn, err)
+				return agent.AGENT_MESSAGE_ERROR_REPLY
+			}
+			constraints = append(constraints, parsed...)
+		} else {
+			otherConstraints = append(otherConstraints, keyConstraint)
+		}
+	}
+
+	if constraints != nil {
+		if !d.InterceptAddedConstraints {
+			log.Errorf("%s: refusing key with destination constraints from %s, the upstream agent wouldn't enforce them, see --intercept-destination-constraints", PackageName, conn)
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+		identity.Constraints = otherConstraints
+		query = identity.Marshal()
+	}
+
+	reply := next(conn, query)
+	if agent.MessageType(reply.Data) == agent.SSH_AGENT_SUCCESS {
+		fingerprint := agent.Fingerprint(identity.PublicKey)
+		if constraints != nil {
+			log.Warnf("%s: key %s restricted to %d destinations by the bridge only, the constraints are lost when it restarts and the key is unrestricted for other clients of the upstream agent",
+				PackageName, fingerprint, len(constraints))
+		}
+		d.setIntercepted(fingerprint, constraints)
+	}
+
+	return reply
+}
+
+func (d *DestinationConstraints) checkSignRequest(conn *agent.Connection, query []byte) error {
+	keyBlob, data, _, err := agent.ParseSignRequest(query)
+	if err != nil {
+		return err
+	}
+
+	constraints := d.get(agent.Fingerprint(keyBlob))
+	if constraints == nil {
+		return nil
+	}
+
+	request, ok := agent.ParseUserauthRequest(data)
+	if !ok {
+		return fmt.Errorf("destination constrained key used to sign something else than a user authentication")
+	}
+
+	if request.User == "" {
+		return fmt.Errorf("empty user in user authentication")
+	}
+
+	// Unlike listing identities, signing with a constrained key needs a bound session, as in OpenSSH
+	if conn.SessionBindFailed {
+		return fmt.Errorf("a previous session-bind failed on this connection")
+	}
+	if len(conn.SessionBinds) == 0 {
+		return fmt.Errorf("destination constrained key used on a connection without session-bind")
+	}
+
+	lastBind := &conn.SessionBinds[len(conn.SessionBinds)-1]
+	if !bytes.Equal(request.SessionID, lastBind.SessionID) {
+		return fmt.Errorf("user authentication session doesn't match the last session-bind")
+	}
+	// Plain publickey authentications carry no host key, they are only accepted on the first hop
+	if request.HostKey == nil {
+		if len(conn.SessionBinds) > 1 {
+			return fmt.Errorf("user authentication without host key on a forwarded connection")
+		}
+	} else if !bytes.Equal(request.HostKey, lastBind.HostKey) {
+		return fmt.Errorf("user authentication host key doesn't match the last session-bind")
+	}
+
+	return identityPermitted(conn, constraints, request.User)
+}
+
+// filterIdentities hides keys that can't be used from this connection
+func (d *DestinationConstraints) filterIdentities(conn *agent.Connection, reply agent.AgentMessageReply) agent.AgentMessageReply {
+	identities, err := agent.ParseIdentitiesAnswer(reply.Data)
+	if err != nil {
+		return reply
+	}
+
+	filtered := identities[:0]
+	for _, identity := range identities {
+		fingerprint := agent.Fingerprint(identity.KeyBlob)
+		if constraints := d.get(fingerprint); constraints != nil {
+			if err := identityPermitted(conn, constraints, ""); err != nil {
+				log.Debugf("%s: hiding key %s from %s: %v", PackageName, fingerprint, conn, err)
+				continue
+			}
+		}
+		filtered = append(filtered, identity)
+	}
+
+	return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(filtered)}
+}
+
+func (d *DestinationConstraints) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		switch agent.MessageType(query) {
+		case agent.SSH_AGENTC_ADD_IDENTITY, agent.SSH_AGENTC_ADD_ID_CONSTRAINED:
+			return d.handleAddIdentity(conn, query, next)
+
+		case agent.SSH_AGENTC_SIGN_REQUEST:
+			if err := d.checkSignRequest(conn, query); err != nil {
+				log.Infof("%s: refusing signature from %s: %v", PackageName, conn, err)
+				return agent.AGENT_MESSAGE_ERROR_REPLY
+			}
+
+		case agent.SSH_AGENTC_REQUEST_IDENTITIES:
+			return d.filterIdentities(conn, next(conn, query))
+
+		case agent.SSH_AGENTC_REMOVE_IDENTITY:
+			reply := next(conn, query)
+			if keyBlob, err := agent.RequestKeyBlob(query); err == nil && agent.MessageType(reply.Data) == agent.SSH_AGENT_SUCCESS {
+				d.setIntercepted(agent.Fingerprint(keyBlob), nil)
+			}
+			return reply
+
+		case agent.SSH_AGENTC_REMOVE_ALL_IDENTITIES:
+			reply := next(conn, query)
+			if agent.MessageType(reply.Data) == agent.SSH_AGENT_SUCCESS {
+				d.removeAllIntercepted()
+			}
+			return reply
+		}
+
+		return next(conn, query)
+	}
+}
@@ -0,0 +1,185 @@
+package destinationConstraints
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// userauthData builds the data signed for a publickey-hostbound-v00@openssh.com user authentication,
+// or for a plain publickey one when hostKey is nil
+func userauthData(sessionID []byte, user string, key ssh.PublicKey, hostKey ssh.PublicKey) []byte {
+	method := "publickey"
+	if hostKey != nil {
+		method = "publickey-hostbound-v00@openssh.com"
+	}
+
+	data := agent.MarshalString(sessionID)
+	data = append(data, 50)
+	data = append(data, agent.MarshalString([]byte(user))...)
+	data = append(data, agent.MarshalString([]byte("ssh-connection"))...)
+	data = append(data, agent.MarshalString([]byte(method))...)
+	data = append(data, 1)
+	data = append(data, agent.MarshalString([]byte(key.Type()))...)
+	data = append(data, agent.MarshalString(key.Marshal())...)
+	if hostKey != nil {
+		data = append(data, agent.MarshalString(hostKey.Marshal())...)
+	}
+	return data
+}
+
+func signRequest(key ssh.PublicKey, data []byte) []byte {
+	return agent.NewAgentMessage(agent.SSH_AGENTC_SIGN_REQUEST, agent.MarshalString(key.Marshal()), agent.MarshalString(data), []byte{0, 0, 0, 0})
+}
+
+func TestCheckSignRequest(t *testing.T) {
+	key := newTestKey(t)
+	hostKey := newTestKey(t)
+	otherHostKey := newTestKey(t)
+	sessionID := []byte("session-1")
+
+	d := &DestinationConstraints{keys: map[string]*keyConstraints{
+		agent.Fingerprint(key.Marshal()): {
+			constraints: []Constraint{
+				{To: Hop{Keys: []HopKey{{Key: hostKey}}}},
+				{From: Hop{Keys: []HopKey{{Key: hostKey}}}, To: Hop{Keys: []HopKey{{Key: otherHostKey}}}},
+			},
+			fromConfig: true,
+		},
+	}}
+
+	bound := []agent.SessionBind{{HostKey: hostKey.Marshal(), SessionID: sessionID}}
+	forwarded := []agent.SessionBind{
+		{HostKey: hostKey.Marshal(), SessionID: []byte("session-0"), Forwarding: true},
+		{HostKey: otherHostKey.Marshal(), SessionID: sessionID},
+	}
+
+	tests := []struct {
+		name    string
+		binds   []agent.SessionBind
+		data    []byte
+		allowed bool
+	}{
+		{"bound session", bound, userauthData(sessionID, "me", key, hostKey), true},
+		{"no session-bind", nil, userauthData(sessionID, "me", key, hostKey), false},
+		{"other session", bound, userauthData([]byte("session-2"), "me", key, hostKey), false},
+		{"other host key", bound, userauthData(sessionID, "me", key, otherHostKey), false},
+		{"not hostbound", bound, userauthData(sessionID, "me", key, nil), true},
+		{"forwarded", forwarded, userauthData(sessionID, "me", key, otherHostKey), true},
+		{"forwarded not hostbound", forwarded, userauthData(sessionID, "me", key, nil), false},
+		{"other destination", []agent.SessionBind{{HostKey: otherHostKey.Marshal(), SessionID: sessionID}}, userauthData(sessionID, "me", key, otherHostKey), false},
+		{"not a user authentication", bound, []byte("data"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := agent.NewConnection("test", agent.PeerInfo{})
+			conn.SessionBinds = test.binds
+
+			err := d.checkSignRequest(conn, signRequest(key, test.data))
+			if (err == nil) != test.allowed {
+				t.Errorf("allowed = %v, want %v (%v)", err == nil, test.allowed, err)
+			}
+		})
+	}
+
+	// Keys without constraints are not checked
+	conn := agent.NewConnection("test", agent.PeerInfo{})
+	other := newTestKey(t)
+	if err := d.checkSignRequest(conn, signRequest(other, []byte("data"))); err != nil {
+		t.Errorf("unconstrained key refused: %v", err)
+	}
+}
+
+// addConstrainedQuery builds an ADD_ID_CONSTRAINED query for a new ed25519 key restricted to hostKey
+func addConstrainedQuery(t *testing.T, hostKey ssh.PublicKey) ([]byte, ssh.PublicKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hop := func(hostname string, keys ...ssh.PublicKey) []byte {
+		data := append(agent.MarshalString(nil), agent.MarshalString([]byte(hostname))...)
+		data = append(data, agent.MarshalString(nil)...)
+		for _, key := range keys {
+			data = append(data, agent.MarshalString(key.Marshal())...)
+			data = append(data, 0)
+		}
+		return data
+	}
+	constraint := append(agent.MarshalString(hop("")), agent.MarshalString(hop("host", hostKey))...)
+	constraint = append(constraint, agent.MarshalString(nil)...)
+	details := agent.MarshalString(agent.MarshalString(constraint))
+
+	return agent.NewAgentMessage(agent.SSH_AGENTC_ADD_ID_CONSTRAINED,
+		agent.MarshalString([]byte(ssh.KeyAlgoED25519)),
+		agent.MarshalString(public),
+		agent.MarshalString(private),
+		agent.MarshalString([]byte("constrained")),
+		[]byte{agent.SSH_AGENT_CONSTRAIN_EXTENSION},
+		agent.MarshalString([]byte(EXTENSION_RESTRICT_DESTINATION)),
+		details,
+	), key
+}
+
+func TestAddConstrainedIdentity(t *testing.T) {
+	hostKey := newTestKey(t)
+
+	for _, intercept := range []bool{false, true} {
+		d, err := New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.InterceptAddedConstraints = intercept
+
+		var forwarded []byte
+		handler := d.Middleware(func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+			forwarded = query
+			return agent.AGENT_MESSAGE_SUCCESS_REPLY
+		})
+
+		query, key := addConstrainedQuery(t, hostKey)
+		reply := handler(agent.NewConnection("test", agent.PeerInfo{}), query)
+		constraints := d.get(agent.Fingerprint(key.Marshal()))
+
+		if !intercept {
+			if agent.MessageType(reply.Data) != agent.SSH_AGENT_FAILURE || forwarded != nil || constraints != nil {
+				t.Errorf("key with destination constraints added without --intercept-destination-constraints")
+			}
+			continue
+		}
+
+		if agent.MessageType(reply.Data) != agent.SSH_AGENT_SUCCESS || len(constraints) != 1 {
+			t.Fatalf("key not added with its constraints: %v", constraints)
+		}
+		identity, err := agent.ParseAddIdentity(forwarded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(identity.Constraints) != 0 {
+			t.Errorf("constraints forwarded upstream: %v", identity.Constraints)
+		}
+	}
+}
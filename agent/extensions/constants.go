@@ -0,0 +1,3 @@
+package extensions
+
+const PackageName = "extensions"
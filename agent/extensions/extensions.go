@@ -0,0 +1,114 @@
+package extensions
+
+import (
+	"sort"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+const (
+	EXTENSION_QUERY        = "query"
+	EXTENSION_SESSION_BIND = "session-bind@openssh.com"
+)
+
+// Handler processes an extension query locally, contents is the data after the extension type
+type Handler func(conn *agent.Connection, contents []byte) agent.AgentMessageReply
+
+// Extensions answers agent extensions implemented by the bridge itself instead of forwarding them upstream
+type Extensions struct {
+	handlers map[string]Handler
+
+	// EnforceSessionBind refuses signatures for a session other than the one bound to the connection
+	EnforceSessionBind bool
+}
+
+func New() *Extensions {
+	e := &Extensions{
+		handlers: map[string]Handler{},
+	}
+
+	e.Register(EXTENSION_SESSION_BIND, handleSessionBind)
+
+	return e
+}
+
+// Register adds an extension handled by the bridge
+func (e *Extensions) Register(name string, handler Handler) {
+	e.handlers[name] = handler
+}
+
+// Names returns the extensions handled by the bridge, query is always handled
+func (e *Extensions) Names() []string {
+	names := make([]string, 0, len(e.handlers)+1)
+	names = append(names, EXTENSION_QUERY)
+	for name := range e.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleQuery advertises the bridge extensions along with the ones supported by the upstream agent
+func (e *Extensions) handleQuery(conn *agent.Connection, next agent.QueryHandler) agent.AgentMessageReply {
+	names := e.Names()
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+
+	upstreamReply := next(conn, agent.NewAgentMessage(agent.SSH_AGENTC_EXTENSION, agent.MarshalString([]byte(EXTENSION_QUERY))))
+	if agent.MessageType(upstreamReply.Data) == agent.SSH_AGENT_SUCCESS {
+		rest := agent.MessagePayload(upstreamReply.Data)
+		for len(rest) > 0 {
+			name, remaining, err := agent.ReadString(rest)
+			if err != nil {
+				log.Debugf("%s: malformed query reply from upstream: %v", PackageName, err)
+				break
+			}
+			if !known[string(name)] {
+				known[string(name)] = true
+				names = append(names, string(name))
+			}
+			rest = remaining
+		}
+	}
+
+	var payload []byte
+	for _, name := range names {
+		payload = append(payload, agent.MarshalString([]byte(name))...)
+	}
+
+	return agent.AgentMessageReply{Data: agent.NewAgentMessage(agent.SSH_AGENT_SUCCESS, payload)}
+}
+
+func (e *Extensions) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		switch agent.MessageType(query) {
+		case agent.SSH_AGENTC_EXTENSION:
+			name, contents, err := agent.ParseExtension(query)
+			if err != nil {
+				log.Errorf("%s: malformed extension query from %s: %v", PackageName, conn, err)
+				return agent.AGENT_MESSAGE_ERROR_REPLY
+			}
+
+			if name == EXTENSION_QUERY {
+				log.Debugf("%s: handling %s from %s", PackageName, name, conn)
+				return e.handleQuery(conn, next)
+			}
+			if handler, ok := e.handlers[name]; ok {
+				log.Debugf("%s: handling %s from %s", PackageName, name, conn)
+				return handler(conn, contents)
+			}
+		case agent.SSH_AGENTC_SIGN_REQUEST:
+			if e.EnforceSessionBind {
+				if err := checkSessionBind(conn, query); err != nil {
+					log.Infof("%s: refusing signature from %s: %v", PackageName, conn, err)
+					return agent.AGENT_MESSAGE_ERROR_REPLY
+				}
+			}
+		}
+
+		return next(conn, query)
+	}
+}
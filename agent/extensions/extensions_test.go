@@ -0,0 +1,68 @@
+package extensions
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// queried returns the extensions advertised by handler
+func queried(t *testing.T, handler agent.QueryHandler) []string {
+	t.Helper()
+
+	reply := handler(agent.NewConnection("test", agent.PeerInfo{}), agent.NewAgentMessage(agent.SSH_AGENTC_EXTENSION, agent.MarshalString([]byte(EXTENSION_QUERY))))
+	if agent.MessageType(reply.Data) != agent.SSH_AGENT_SUCCESS {
+		t.Fatalf("query answered %x", reply.Data)
+	}
+	var names []string
+	rest := agent.MessagePayload(reply.Data)
+	for len(rest) > 0 {
+		name, remaining, err := agent.ReadString(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, string(name))
+		rest = remaining
+	}
+	return names
+}
+
+// upstreamExtensions returns a handler answering query with names
+func upstreamExtensions(names ...string) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		var payload []byte
+		for _, name := range names {
+			payload = append(payload, agent.MarshalString([]byte(name))...)
+		}
+		return agent.AgentMessageReply{Data: agent.NewAgentMessage(agent.SSH_AGENT_SUCCESS, payload)}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	e := New()
+	e.Register("local@example.com", func(conn *agent.Connection, contents []byte) agent.AgentMessageReply {
+		return agent.AGENT_MESSAGE_SUCCESS_REPLY
+	})
+
+	// Each chain queries its own upstream handler
+	first := e.Middleware(upstreamExtensions("first@example.com", EXTENSION_SESSION_BIND))
+	second := e.Middleware(upstreamExtensions("second@example.com"))
+
+	tests := []struct {
+		name    string
+		handler agent.QueryHandler
+		want    []string
+	}{
+		{"first", first, []string{"local@example.com", "query", "session-bind@openssh.com", "first@example.com"}},
+		{"second", second, []string{"local@example.com", "query", "session-bind@openssh.com", "second@example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := queried(t, test.handler); !slices.Equal(got, test.want) {
+				t.Errorf("advertised %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package extensions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Same limit as OpenSSH ssh-agent
+const maxSessionBinds = 16
+
+var (
+	ErrSessionBindFailed      = errors.New("a previous session-bind failed on this connection")
+	ErrSessionIDMismatch      = errors.New("signature requested for a session other than the bound one")
+	ErrSessionHostKeyMismatch = errors.New("signature requested for a host key other than the bound one")
+)
+
+func parseSessionBind(contents []byte) (*agent.SessionBind, error) {
+	hostKeyBlob, rest, err := agent.ReadString(contents)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, rest, err := agent.ReadString(rest)
+	if err != nil {
+		return nil, err
+	}
+	signatureBlob, rest, err := agent.ReadString(rest)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 1 {
+		return nil, agent.ErrMalformedMessage
+	}
+
+	hostKey, err := ssh.ParsePublicKey(hostKeyBlob)
+	if err != nil {
+		return nil, fmt.Errorf("bad host key: %w", err)
+	}
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(signatureBlob, &signature); err != nil {
+		return nil, fmt.Errorf("bad signature: %w", err)
+	}
+
+	if err := hostKey.Verify(sessionID, &signature); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	return &agent.SessionBind{
+		HostKey:    hostKeyBlob,
+		SessionID:  sessionID,
+		Forwarding: rest[0] != 0,
+	}, nil
+}
+
+// handleSessionBind records the session binding in the connection. It is not forwarded as upstream
+// agents either don't support it or would see a different connection for each query.
+func handleSessionBind(conn *agent.Connection, contents []byte) agent.AgentMessageReply {
+	bind, err := parseSessionBind(contents)
+	if err != nil {
+		log.Errorf("%s: refusing session-bind from %s: %v", PackageName, conn, err)
+		conn.SessionBindFailed = true
+		return agent.AGENT_MESSAGE_ERROR_REPLY
+	}
+
+	for _, other := range conn.SessionBinds {
+		if bytes.Equal(other.SessionID, bind.SessionID) {
+			if bytes.Equal(other.HostKey, bind.HostKey) {
+				log.Debugf("%s: session-bind from %s already recorded", PackageName, conn)
+				return agent.AGENT_MESSAGE_SUCCESS_REPLY
+			}
+
+			log.Errorf("%s: refusing session-bind from %s: session already bound to another host key", PackageName, conn)
+			conn.SessionBindFailed = true
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+	}
+
+	if len(conn.SessionBinds) >= maxSessionBinds {
+		log.Errorf("%s: refusing session-bind from %s: too many bindings", PackageName, conn)
+		conn.SessionBindFailed = true
+		return agent.AGENT_MESSAGE_ERROR_REPLY
+	}
+
+	log.Debugf("%s: %s bound to host key %s (forwarding: %v)",
+		PackageName,
+		conn,
+		agent.Fingerprint(bind.HostKey),
+		bind.Forwarding)
+
+	conn.SessionBinds = append(conn.SessionBinds, *bind)
+
+	return agent.AGENT_MESSAGE_SUCCESS_REPLY
+}
+
+// checkSessionBind refuses signatures of user authentications for a session
+// other than the one the connection was last bound to
+func checkSessionBind(conn *agent.Connection, query []byte) error {
+	if conn.SessionBindFailed {
+		return ErrSessionBindFailed
+	}
+
+	if len(conn.SessionBinds) == 0 {
+		return nil
+	}
+
+	_, data, _, err := agent.ParseSignRequest(query)
+	if err != nil {
+		return err
+	}
+
+	lastBind := &conn.SessionBinds[len(conn.SessionBinds)-1]
+	request, ok := agent.ParseUserauthRequest(data)
+	if !ok || lastBind.Forwarding {
+		return nil
+	}
+
+	if !bytes.Equal(request.SessionID, lastBind.SessionID) {
+		return ErrSessionIDMismatch
+	}
+	if request.HostKey != nil && !bytes.Equal(request.HostKey, lastBind.HostKey) {
+		return ErrSessionHostKeyMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package extensions
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sessionBindContents returns the contents of a session-bind of sessionID to the key of hostSigner, with a signature of signedID
+func sessionBindContents(t *testing.T, hostSigner ssh.Signer, sessionID []byte, signedID []byte, forwarding bool) []byte {
+	t.Helper()
+
+	signature, err := hostSigner.Sign(rand.Reader, signedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := agent.MarshalString(hostSigner.PublicKey().Marshal())
+	contents = append(contents, agent.MarshalString(sessionID)...)
+	contents = append(contents, agent.MarshalString(ssh.Marshal(signature))...)
+	if forwarding {
+		return append(contents, 1)
+	}
+	return append(contents, 0)
+}
+
+// userauthSignRequest returns a sign request of a publickey user authentication for sessionID
+func userauthSignRequest(sessionID []byte) []byte {
+	data := agent.MarshalString(sessionID)
+	data = append(data, 50)
+	data = append(data, agent.MarshalString([]byte("me"))...)
+	data = append(data, agent.MarshalString([]byte("ssh-connection"))...)
+	data = append(data, agent.MarshalString([]byte("publickey"))...)
+	data = append(data, 1)
+	data = append(data, agent.MarshalString([]byte("ssh-ed25519"))...)
+	data = append(data, agent.MarshalString([]byte("key"))...)
+	return agent.NewAgentMessage(agent.SSH_AGENTC_SIGN_REQUEST, agent.MarshalString([]byte("key")), agent.MarshalString(data), []byte{0, 0, 0, 0})
+}
+
+func TestParseSessionBind(t *testing.T) {
+	hostSigner := newHostSigner(t)
+	sessionID := []byte("session")
+	valid := sessionBindContents(t, hostSigner, sessionID, sessionID, false)
+
+	tests := []struct {
+		name       string
+		contents   []byte
+		valid      bool
+		forwarding bool
+	}{
+		{"valid", valid, true, false},
+		{"forwarding", sessionBindContents(t, hostSigner, sessionID, sessionID, true), true, true},
+		{"signature of another session", sessionBindContents(t, hostSigner, sessionID, []byte("other"), false), false, false},
+		{"signature of another host key", append(agent.MarshalString(newHostSigner(t).PublicKey().Marshal()), valid[len(agent.MarshalString(hostSigner.PublicKey().Marshal())):]...), false, false},
+		{"malformed signature", append(append(agent.MarshalString(hostSigner.PublicKey().Marshal()), agent.MarshalString(sessionID)...), append(agent.MarshalString([]byte("signature")), 0)...), false, false},
+		{"bad host key", append(agent.MarshalString([]byte("host key")), valid[len(agent.MarshalString(hostSigner.PublicKey().Marshal())):]...), false, false},
+		{"without forwarding flag", valid[:len(valid)-1], false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bind, err := parseSessionBind(test.contents)
+			if (err == nil) != test.valid {
+				t.Fatalf("parse error %v, want valid = %v", err, test.valid)
+			}
+			if test.valid && (string(bind.SessionID) != string(sessionID) || bind.Forwarding != test.forwarding) {
+				t.Errorf("parsed %+v", bind)
+			}
+		})
+	}
+}
+
+func TestSessionBindLimit(t *testing.T) {
+	hostSigner := newHostSigner(t)
+	conn := agent.NewConnection("test", agent.PeerInfo{})
+
+	for i := 0; i < maxSessionBinds; i++ {
+		sessionID := []byte(fmt.Sprintf("session-%d", i))
+		reply := handleSessionBind(conn, sessionBindContents(t, hostSigner, sessionID, sessionID, true))
+		if agent.MessageType(reply.Data) != agent.SSH_AGENT_SUCCESS {
+			t.Fatalf("session-bind %d refused", i)
+		}
+	}
+
+	// Binding a bound session again isn't a new binding
+	again := []byte("session-0")
+	if reply := handleSessionBind(conn, sessionBindContents(t, hostSigner, again, again, true)); agent.MessageType(reply.Data) != agent.SSH_AGENT_SUCCESS {
+		t.Error("session-bind of a bound session refused")
+	}
+	if conn.SessionBindFailed {
+		t.Fatal("session-bind failed before the limit")
+	}
+
+	sessionID := []byte("session-over")
+	if reply := handleSessionBind(conn, sessionBindContents(t, hostSigner, sessionID, sessionID, false)); agent.MessageType(reply.Data) != agent.SSH_AGENT_FAILURE {
+		t.Errorf("session-bind over the limit answered %x", reply.Data)
+	}
+	if !conn.SessionBindFailed || len(conn.SessionBinds) != maxSessionBinds {
+		t.Errorf("%d bindings, failed = %v after a session-bind over the limit", len(conn.SessionBinds), conn.SessionBindFailed)
+	}
+}
+
+func TestEnforceSessionBind(t *testing.T) {
+	hostSigner := newHostSigner(t)
+	sessionID := []byte("session")
+	bind := sessionBindContents(t, hostSigner, sessionID, sessionID, false)
+	badBind := sessionBindContents(t, hostSigner, sessionID, []byte("other"), false)
+	forwardingBind := sessionBindContents(t, hostSigner, sessionID, sessionID, true)
+
+	tests := []struct {
+		name    string
+		enforce bool
+		binds   [][]byte
+		query   []byte
+		err     error
+	}{
+		{"not bound", true, nil, userauthSignRequest([]byte("other")), nil},
+		{"bound session", true, [][]byte{bind}, userauthSignRequest(sessionID), nil},
+		{"other session", true, [][]byte{bind}, userauthSignRequest([]byte("other")), ErrSessionIDMismatch},
+		{"not a user authentication", true, [][]byte{bind}, agent.NewAgentMessage(agent.SSH_AGENTC_SIGN_REQUEST, agent.MarshalString([]byte("key")), agent.MarshalString([]byte("data")), []byte{0, 0, 0, 0}), nil},
+		{"forwarding", true, [][]byte{forwardingBind}, userauthSignRequest([]byte("other")), nil},
+		{"failed session-bind", true, [][]byte{badBind}, userauthSignRequest(sessionID), ErrSessionBindFailed},
+		{"not enforced", false, [][]byte{bind}, userauthSignRequest([]byte("other")), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := New()
+			e.EnforceSessionBind = test.enforce
+			var forwarded bool
+			handler := e.Middleware(func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+				forwarded = true
+				return agent.AGENT_MESSAGE_SUCCESS_REPLY
+			})
+
+			conn := agent.NewConnection("test", agent.PeerInfo{})
+			for _, contents := range test.binds {
+				handler(conn, agent.NewAgentMessage(agent.SSH_AGENTC_EXTENSION, agent.MarshalString([]byte(EXTENSION_SESSION_BIND)), contents))
+			}
+			if err := checkSessionBind(conn, test.query); test.enforce && !errors.Is(err, test.err) {
+				t.Errorf("checkSessionBind error %v, want %v", err, test.err)
+			}
+
+			reply := handler(conn, test.query)
+			if refused := test.err != nil; forwarded == refused || (agent.MessageType(reply.Data) == agent.SSH_AGENT_FAILURE) != refused {
+				t.Errorf("forwarded = %v, answered %x, want refused = %v", forwarded, reply.Data, refused)
+			}
+		})
+	}
+}
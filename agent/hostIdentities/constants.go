@@ -0,0 +1,3 @@
+package hostIdentities
+
+const PackageName = "host-identities"
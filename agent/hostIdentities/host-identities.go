@@ -0,0 +1,216 @@
+package hostIdentities
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/amurzeau/ssh-agent-bridge/paths"
+	"golang.org/x/crypto/ssh"
+)
+
+// RuleConfig offers some identities to hosts, given by host key or by name found in known_hosts files
+type RuleConfig struct {
+	// Hosts are host names or patterns like *.example.com, matched against the names of the host key in known_hosts
+	Hosts []string `json:"hosts"`
+	// HostKeys use the authorized_keys format
+	HostKeys []string `json:"host-keys"`
+	// Keys are SHA256 fingerprints of the offered identities
+	Keys []string `json:"keys"`
+	// Comments are patterns of the comments of the offered identities
+	Comments []string `json:"comments"`
+}
+
+// Config is the host-identities section of the configuration file
+type Config struct {
+	// KnownHosts files, default to ~/.ssh/known_hosts
+	KnownHosts []string     `json:"known-hosts"`
+	Rules      []RuleConfig `json:"rules"`
+}
+
+type rule struct {
+	hosts    []string
+	hostKeys [][]byte
+	keys     map[string]bool
+	comments []string
+}
+
+// HostIdentities only lists the identities configured for the host bound to the connection with
+// session-bind@openssh.com, so clients don't try unrelated keys
+type HostIdentities struct {
+	rules      []rule
+	knownHosts []*knownHostsFile
+}
+
+func New(config *Config) (*HostIdentities, error) {
+	h := &HostIdentities{}
+	if config == nil {
+		return h, nil
+	}
+
+	usesHosts := false
+	for i, ruleConfig := range config.Rules {
+		r := rule{
+			hosts:    ruleConfig.Hosts,
+			keys:     map[string]bool{},
+			comments: ruleConfig.Comments,
+		}
+
+		if len(ruleConfig.Hosts) == 0 && len(ruleConfig.HostKeys) == 0 {
+			return nil, fmt.Errorf("%s: rule %d: no hosts or host-keys", PackageName, i+1)
+		}
+		for _, pattern := range append(append([]string(nil), ruleConfig.Hosts...), ruleConfig.Comments...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: rule %d: bad pattern %s: %w", PackageName, i+1, pattern, err)
+			}
+		}
+		for _, keyString := range ruleConfig.HostKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d: bad host key %q: %w", PackageName, i+1, keyString, err)
+			}
+			r.hostKeys = append(r.hostKeys, key.Marshal())
+		}
+		for _, fingerprint := range ruleConfig.Keys {
+			r.keys[fingerprint] = true
+		}
+
+		usesHosts = usesHosts || len(r.hosts) > 0
+		h.rules = append(h.rules, r)
+	}
+
+	knownHosts := config.KnownHosts
+	if len(knownHosts) == 0 && usesHosts {
+		knownHosts = []string{"~/.ssh/known_hosts"}
+	}
+	for _, file := range knownHosts {
+		file, err := paths.ExpandHome(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't find %s: %w", PackageName, file, err)
+		}
+
+		knownHostsFile := &knownHostsFile{path: file}
+		if _, err := knownHostsFile.entries(); err != nil {
+			return nil, fmt.Errorf("%s: can't read %s: %w", PackageName, file, err)
+		}
+		h.knownHosts = append(h.knownHosts, knownHostsFile)
+	}
+
+	return h, nil
+}
+
+// knownHostsFor returns the known_hosts entries vouching for a host key, or nil if the key is revoked
+func (h *HostIdentities) knownHostsFor(hostKey []byte) []knownHost {
+	var matching []knownHost
+
+	for _, file := range h.knownHosts {
+		hosts, err := file.entries()
+		if err != nil {
+			log.Errorf("%s: can't read %s: %v", PackageName, file.path, err)
+			continue
+		}
+
+		for _, host := range hosts {
+			if !host.hostKeyMatches(hostKey) {
+				continue
+			}
+			if host.revoked {
+				log.Infof("%s: host key %s is revoked", PackageName, agent.Fingerprint(hostKey))
+				return nil
+			}
+			matching = append(matching, host)
+		}
+	}
+
+	return matching
+}
+
+// matchingRules returns the rules applying to a host key
+func (h *HostIdentities) matchingRules(hostKey []byte) []*rule {
+	var matching []*rule
+	var knownHosts []knownHost
+	knownHostsLoaded := false
+
+	for i := range h.rules {
+		r := &h.rules[i]
+
+		matched := false
+		for _, key := range r.hostKeys {
+			if bytes.Equal(key, hostKey) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched && len(r.hosts) > 0 {
+			if !knownHostsLoaded {
+				knownHosts = h.knownHostsFor(hostKey)
+				knownHostsLoaded = true
+			}
+			for _, knownHost := range knownHosts {
+				if knownHost.hostMatches(r.hosts) {
+					matched = true
+					break
+				}
+			}
+		}
+
+		if matched {
+			matching = append(matching, r)
+		}
+	}
+
+	return matching
+}
+
+func (r *rule) offers(identity *agent.Identity) bool {
+	if r.keys[agent.Fingerprint(identity.KeyBlob)] {
+		return true
+	}
+	for _, pattern := range r.comments {
+		if matched, _ := path.Match(pattern, string(identity.Comment)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HostIdentities) filterIdentities(conn *agent.Connection, rules []*rule, reply agent.AgentMessageReply) agent.AgentMessageReply {
+	identities, err := agent.ParseIdentitiesAnswer(reply.Data)
+	if err != nil {
+		return reply
+	}
+
+	filtered := make([]agent.Identity, 0, len(identities))
+	for i := range identities {
+		for _, r := range rules {
+			if r.offers(&identities[i]) {
+				filtered = append(filtered, identities[i])
+				break
+			}
+		}
+	}
+
+	log.Debugf("%s: offering %d of %d identities to %s", PackageName, len(filtered), len(identities), conn)
+
+	return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(filtered)}
+}
+
+func (h *HostIdentities) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		if len(h.rules) == 0 || len(conn.SessionBinds) == 0 || agent.MessageType(query) != agent.SSH_AGENTC_REQUEST_IDENTITIES {
+			return next(conn, query)
+		}
+
+		// The last session-bind is the host the client is authenticating to
+		hostKey := conn.SessionBinds[len(conn.SessionBinds)-1].HostKey
+		rules := h.matchingRules(hostKey)
+		if len(rules) == 0 {
+			return next(conn, query)
+		}
+
+		return h.filterIdentities(conn, rules, next(conn, query))
+	}
+}
@@ -0,0 +1,182 @@
+package hostIdentities
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	return newSigner(t).PublicKey()
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// newHostCertificate returns a host certificate of a new key signed by ca
+func newHostCertificate(t *testing.T, ca ssh.Signer, principal string) ssh.PublicKey {
+	t.Helper()
+
+	certificate := &ssh.Certificate{
+		Key:             newKey(t),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := certificate.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func writeKnownHosts(t *testing.T, file string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listed returns the comments of the identities listed to a connection bound to hostKeys
+func listed(t *testing.T, h *HostIdentities, hostKeys ...ssh.PublicKey) []string {
+	t.Helper()
+
+	handler := h.Middleware(func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		var identities []agent.Identity
+		for _, comment := range []string{"github", "build", "corp"} {
+			identities = append(identities, agent.Identity{KeyBlob: []byte(comment), Comment: []byte(comment)})
+		}
+		return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(identities)}
+	})
+
+	conn := agent.NewConnection("test", agent.PeerInfo{})
+	for i, hostKey := range hostKeys {
+		conn.SessionBinds = append(conn.SessionBinds, agent.SessionBind{HostKey: hostKey.Marshal(), Forwarding: i < len(hostKeys)-1})
+	}
+
+	identities, err := agent.ParseIdentitiesAnswer(handler(conn, agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES)).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := []string{}
+	for i := range identities {
+		comments = append(comments, string(identities[i].Comment))
+	}
+	return comments
+}
+
+func TestHostIdentities(t *testing.T) {
+	githubKey := newKey(t)
+	buildKey := newKey(t)
+	revokedKey := newKey(t)
+	configuredKey := newKey(t)
+	unknownKey := newKey(t)
+	ca := newSigner(t)
+	otherCa := newSigner(t)
+
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	writeKnownHosts(t, knownHostsFile,
+		"# comment",
+		"github.com,140.82.121.3 "+authorizedKey(githubKey),
+		knownhosts.HashHostname("build.example.com")+" "+authorizedKey(buildKey),
+		"@cert-authority *.corp.example.com "+authorizedKey(ca.PublicKey()),
+		"revoked.example.com "+authorizedKey(revokedKey),
+		"@revoked * "+authorizedKey(revokedKey),
+	)
+
+	h, err := New(&Config{
+		KnownHosts: []string{knownHostsFile},
+		Rules: []RuleConfig{
+			{Hosts: []string{"github.com"}, Comments: []string{"github"}},
+			{Hosts: []string{"build.example.com"}, Comments: []string{"build"}},
+			// Hashed host names only match names without wildcards
+			{Hosts: []string{"build.*"}, Comments: []string{"github"}},
+			{Hosts: []string{"*.corp.example.com"}, Comments: []string{"corp"}},
+			{Hosts: []string{"revoked.example.com"}, Comments: []string{"github"}},
+			{HostKeys: []string{authorizedKey(configuredKey)}, Keys: []string{agent.Fingerprint([]byte("build"))}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := []string{"github", "build", "corp"}
+	tests := []struct {
+		name     string
+		hostKeys []ssh.PublicKey
+		want     []string
+	}{
+		{"host name", []ssh.PublicKey{githubKey}, []string{"github"}},
+		{"hashed host name", []ssh.PublicKey{buildKey}, []string{"build"}},
+		{"cert-authority", []ssh.PublicKey{newHostCertificate(t, ca, "db.corp.example.com")}, []string{"corp"}},
+		{"certificate of another authority", []ssh.PublicKey{newHostCertificate(t, otherCa, "db.corp.example.com")}, all},
+		{"revoked", []ssh.PublicKey{revokedKey}, all},
+		{"host key", []ssh.PublicKey{configuredKey}, []string{"build"}},
+		{"unknown host", []ssh.PublicKey{unknownKey}, all},
+		{"last session-bind wins", []ssh.PublicKey{githubKey, buildKey}, []string{"build"}},
+		{"forwarded to an unknown host", []ssh.PublicKey{githubKey, unknownKey}, all},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := listed(t, h, test.hostKeys...); !slices.Equal(got, test.want) {
+				t.Errorf("listed %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Without session-bind, the host isn't known
+	if got := listed(t, h); !slices.Equal(got, all) {
+		t.Errorf("listed %v without session-bind, want %v", got, all)
+	}
+}
+
+func TestKnownHostsReload(t *testing.T) {
+	hostKey := newKey(t)
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	writeKnownHosts(t, knownHostsFile, "github.com "+authorizedKey(hostKey))
+
+	h, err := New(&Config{
+		KnownHosts: []string{knownHostsFile},
+		Rules:      []RuleConfig{{Hosts: []string{"build.example.com"}, Comments: []string{"build"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(t, h, hostKey); len(got) != 3 {
+		t.Fatalf("listed %v before the host was known", got)
+	}
+
+	writeKnownHosts(t, knownHostsFile, "build.example.com "+authorizedKey(hostKey))
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(knownHostsFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(t, h, hostKey); !slices.Equal(got, []string{"build"}) {
+		t.Errorf("listed %v after known_hosts changed, want [build]", got)
+	}
+}
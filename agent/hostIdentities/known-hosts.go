@@ -0,0 +1,141 @@
+package hostIdentities
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHost is a known_hosts line
+type knownHost struct {
+	// patterns are host names or patterns, or |1|salt|hash hashed host names
+	patterns []string
+	key      []byte
+	isCA     bool
+	revoked  bool
+}
+
+// knownHostsFile is a known_hosts file reloaded when it changes
+type knownHostsFile struct {
+	path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	hosts   []knownHost
+}
+
+func parseKnownHosts(data []byte) ([]knownHost, error) {
+	var hosts []knownHost
+
+	for len(bytes.TrimSpace(data)) > 0 {
+		marker, patterns, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		hosts = append(hosts, knownHost{
+			patterns: patterns,
+			key:      key.Marshal(),
+			isCA:     marker == "cert-authority",
+			revoked:  marker == "revoked",
+		})
+	}
+
+	return hosts, nil
+}
+
+// entries returns the known hosts, reloading the file if it was modified
+func (f *knownHostsFile) entries() ([]knownHost, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.hosts != nil && info.ModTime().Equal(f.modTime) {
+		return f.hosts, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseKnownHosts(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f.hosts = hosts
+	f.modTime = info.ModTime()
+	return hosts, nil
+}
+
+// hostKeyMatches returns true if the known host vouches for the host key, directly or as certificate authority
+func (h *knownHost) hostKeyMatches(hostKey []byte) bool {
+	if !h.isCA {
+		return bytes.Equal(h.key, hostKey)
+	}
+
+	key, err := ssh.ParsePublicKey(hostKey)
+	if err != nil {
+		return false
+	}
+	certificate, ok := key.(*ssh.Certificate)
+	return ok && certificate.CertType == ssh.HostCert && bytes.Equal(certificate.SignatureKey.Marshal(), h.key)
+}
+
+// hostMatches returns true if one of the host patterns of the configuration matches a host name of the known host.
+// Hashed host names only match literal patterns.
+func (h *knownHost) hostMatches(patterns []string) bool {
+	for _, knownPattern := range h.patterns {
+		if strings.HasPrefix(knownPattern, "!") {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if strings.HasPrefix(knownPattern, "|1|") {
+				if hashedHostMatches(knownPattern, pattern) {
+					return true
+				}
+			} else if matched, _ := path.Match(pattern, knownPattern); matched || pattern == knownPattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashedHostMatches checks a |1|salt|hash host name written with HashKnownHosts
+func hashedHostMatches(hashed string, host string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
@@ -0,0 +1,3 @@
+package identityCache
+
+const PackageName = "identity-cache"
@@ -0,0 +1,125 @@
+package identityCache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// Queries changing the identities of the upstream agent, or hiding them when locked
+var invalidatingQueries = map[byte]bool{
+	agent.SSH_AGENTC_ADD_IDENTITY:                  true,
+	agent.SSH_AGENTC_ADD_ID_CONSTRAINED:            true,
+	agent.SSH_AGENTC_REMOVE_IDENTITY:               true,
+	agent.SSH_AGENTC_REMOVE_ALL_IDENTITIES:         true,
+	agent.SSH_AGENTC_ADD_SMARTCARD_KEY:             true,
+	agent.SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED: true,
+	agent.SSH_AGENTC_REMOVE_SMARTCARD_KEY:          true,
+	agent.SSH_AGENTC_LOCK:                          true,
+	agent.SSH_AGENTC_UNLOCK:                        true,
+}
+
+type cachedAnswer struct {
+	data    []byte
+	expires time.Time
+}
+
+// Cache replies to REQUEST_IDENTITIES with the last IDENTITIES_ANSWER of the upstream agent for a TTL
+type Cache struct {
+	ttl      time.Duration
+	upstream func() string
+
+	lock sync.Mutex
+	// answers by upstream agent name
+	answers map[string]cachedAnswer
+	// generation is incremented on each invalidation so answers requested before are not cached
+	generation uint64
+	// listeners always forwarding REQUEST_IDENTITIES
+	bypass map[string]bool
+}
+
+// New creates a cache keeping answers for ttl, upstream returns the name of the current upstream agent
+func New(ttl time.Duration, upstream func() string) *Cache {
+	return &Cache{
+		ttl:      ttl,
+		upstream: upstream,
+		answers:  map[string]cachedAnswer{},
+		bypass:   map[string]bool{},
+	}
+}
+
+// Bypass makes a listener always forward REQUEST_IDENTITIES to the upstream agent
+func (c *Cache) Bypass(listener string) {
+	c.bypass[listener] = true
+}
+
+// Invalidate drops all cached answers
+func (c *Cache) Invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	if len(c.answers) > 0 {
+		log.Debugf("%s: invalidated", PackageName)
+		c.answers = map[string]cachedAnswer{}
+	}
+}
+
+func (c *Cache) lookup(upstream string) ([]byte, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	answer, ok := c.answers[upstream]
+	if !ok || time.Now().After(answer.expires) {
+		return nil, c.generation, false
+	}
+	return answer.data, c.generation, true
+}
+
+func (c *Cache) store(upstream string, generation uint64, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// The identities changed while the upstream agent was answering
+	if generation != c.generation {
+		return
+	}
+
+	c.answers[upstream] = cachedAnswer{
+		data:    append([]byte(nil), data...),
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+func (c *Cache) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		messageType := agent.MessageType(query)
+
+		if invalidatingQueries[messageType] {
+			// Invalidate after the query too, REQUEST_IDENTITIES answered meanwhile may not include the change
+			c.Invalidate()
+			defer c.Invalidate()
+			return next(conn, query)
+		}
+
+		if messageType != agent.SSH_AGENTC_REQUEST_IDENTITIES || c.ttl <= 0 || c.bypass[conn.Listener] {
+			return next(conn, query)
+		}
+
+		upstream := c.upstream()
+		data, generation, ok := c.lookup(upstream)
+		if ok {
+			log.Debugf("%s: answering identities of %s from cache to %s", PackageName, upstream, conn)
+			// Copy as later middlewares may modify the reply
+			return agent.AgentMessageReply{Data: append([]byte(nil), data...)}
+		}
+
+		reply := next(conn, query)
+		if agent.MessageType(reply.Data) == agent.SSH_AGENT_IDENTITIES_ANSWER {
+			c.store(upstream, generation, reply.Data)
+		}
+		return reply
+	}
+}
@@ -0,0 +1,191 @@
+package identityCache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+var listQuery = agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES)
+
+// fakeUpstream answers identities with a comment changing on each query, and success to other queries
+type fakeUpstream struct {
+	lists int
+	// during is called while answering a query, before the reply is returned
+	during func(query []byte)
+}
+
+func (u *fakeUpstream) handle(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+	if u.during != nil {
+		during := u.during
+		u.during = nil
+		during(query)
+	}
+
+	if agent.MessageType(query) != agent.SSH_AGENTC_REQUEST_IDENTITIES {
+		return agent.AGENT_MESSAGE_SUCCESS_REPLY
+	}
+	u.lists++
+	comment := []byte{byte('0' + u.lists)}
+	return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer([]agent.Identity{{KeyBlob: []byte("key"), Comment: comment}})}
+}
+
+func newTestCache(ttl time.Duration) (*Cache, *fakeUpstream, agent.QueryHandler) {
+	upstream := &fakeUpstream{}
+	c := New(ttl, func() string { return "upstream" })
+	return c, upstream, c.Middleware(upstream.handle)
+}
+
+func list(handler agent.QueryHandler, listener string) agent.AgentMessageReply {
+	return handler(agent.NewConnection(listener, agent.PeerInfo{}), listQuery)
+}
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		sleep time.Duration
+		lists int
+	}{
+		{"cached", time.Hour, 0, 1},
+		{"expired", 20 * time.Millisecond, 40 * time.Millisecond, 2},
+		{"disabled", 0, 0, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, upstream, handler := newTestCache(test.ttl)
+
+			first := list(handler, "pipe")
+			time.Sleep(test.sleep)
+			second := list(handler, "pipe")
+
+			if upstream.lists != test.lists {
+				t.Errorf("upstream listed %d times, want %d", upstream.lists, test.lists)
+			}
+			if cached := test.lists == 1; bytes.Equal(first.Data, second.Data) != cached {
+				t.Errorf("second answer %x after %x, cached = %v", second.Data, first.Data, cached)
+			}
+		})
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		messageType  byte
+		invalidating bool
+	}{
+		{"add", agent.SSH_AGENTC_ADD_IDENTITY, true},
+		{"add constrained", agent.SSH_AGENTC_ADD_ID_CONSTRAINED, true},
+		{"remove", agent.SSH_AGENTC_REMOVE_IDENTITY, true},
+		{"remove all", agent.SSH_AGENTC_REMOVE_ALL_IDENTITIES, true},
+		{"add smartcard", agent.SSH_AGENTC_ADD_SMARTCARD_KEY, true},
+		{"remove smartcard", agent.SSH_AGENTC_REMOVE_SMARTCARD_KEY, true},
+		{"lock", agent.SSH_AGENTC_LOCK, true},
+		{"unlock", agent.SSH_AGENTC_UNLOCK, true},
+		{"sign", agent.SSH_AGENTC_SIGN_REQUEST, false},
+		{"extension", agent.SSH_AGENTC_EXTENSION, false},
+	}
+
+	for _, test := range tests {
+		query := agent.NewAgentMessage(test.messageType)
+		wantLists := 1
+		if test.invalidating {
+			wantLists = 2
+		}
+
+		// Answers cached before the query are dropped
+		t.Run(test.name+" before", func(t *testing.T) {
+			_, upstream, handler := newTestCache(time.Hour)
+
+			list(handler, "pipe")
+			handler(agent.NewConnection("pipe", agent.PeerInfo{}), query)
+			list(handler, "pipe")
+
+			if upstream.lists != wantLists {
+				t.Errorf("upstream listed %d times, want %d", upstream.lists, wantLists)
+			}
+		})
+
+		// Answers cached while the upstream agent handles the query may miss the change
+		t.Run(test.name+" during", func(t *testing.T) {
+			_, upstream, handler := newTestCache(time.Hour)
+
+			upstream.during = func([]byte) { list(handler, "wsl") }
+			handler(agent.NewConnection("pipe", agent.PeerInfo{}), query)
+			list(handler, "pipe")
+
+			if upstream.lists != wantLists {
+				t.Errorf("upstream listed %d times, want %d", upstream.lists, wantLists)
+			}
+		})
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	c, upstream, handler := newTestCache(time.Hour)
+
+	// The identities change while the upstream agent answers, its answer may be outdated
+	upstream.during = func([]byte) { c.Invalidate() }
+	list(handler, "pipe")
+	list(handler, "pipe")
+
+	if upstream.lists != 2 {
+		t.Errorf("answer fetched across an invalidation was cached, upstream listed %d times", upstream.lists)
+	}
+}
+
+func TestUpstreamChange(t *testing.T) {
+	upstream := &fakeUpstream{}
+	name := "pageant"
+	c := New(time.Hour, func() string { return name })
+	handler := c.Middleware(upstream.handle)
+
+	list(handler, "pipe")
+	name = "pipe"
+	list(handler, "pipe")
+
+	if upstream.lists != 2 {
+		t.Errorf("answer of another upstream agent used, upstream listed %d times", upstream.lists)
+	}
+}
+
+func TestBypass(t *testing.T) {
+	c, upstream, handler := newTestCache(time.Hour)
+	c.Bypass("direct")
+
+	list(handler, "pipe")
+	list(handler, "direct")
+	list(handler, "direct")
+	list(handler, "pipe")
+
+	if upstream.lists != 3 {
+		t.Errorf("upstream listed %d times, want 3: once for pipe and each time for direct", upstream.lists)
+	}
+}
+
+func TestCopies(t *testing.T) {
+	_, _, handler := newTestCache(time.Hour)
+
+	first := list(handler, "pipe")
+	want := append([]byte(nil), first.Data...)
+
+	// Later middlewares may modify the replies in place
+	for i := range first.Data {
+		first.Data[i] = 0
+	}
+	second := list(handler, "pipe")
+	if !bytes.Equal(second.Data, want) {
+		t.Fatalf("cached answer modified through the first reply: %x, want %x", second.Data, want)
+	}
+
+	for i := range second.Data {
+		second.Data[i] = 0
+	}
+	if third := list(handler, "pipe"); !bytes.Equal(third.Data, want) {
+		t.Errorf("cached answer modified through a cached reply: %x, want %x", third.Data, want)
+	}
+}
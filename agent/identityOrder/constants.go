@@ -0,0 +1,3 @@
+package identityOrder
+
+const PackageName = "identity-order"
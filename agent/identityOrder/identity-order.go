@@ -0,0 +1,146 @@
+package identityOrder
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// Rule matches identities, all non-empty fields must match.
+// Comment and Type are patterns like "*@work" or "ssh-ed25519*".
+type Rule struct {
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment"`
+	Type        string `json:"type"`
+}
+
+func (r *Rule) check() error {
+	if r.Fingerprint == "" && r.Comment == "" && r.Type == "" {
+		return fmt.Errorf("%s: rule without fingerprint, comment or type", PackageName)
+	}
+	for _, pattern := range []string{r.Comment, r.Type} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: bad pattern %s: %w", PackageName, pattern, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(identity *agent.Identity) bool {
+	// A rule on a key matches its certificates too
+	if r.Fingerprint != "" && r.Fingerprint != agent.Fingerprint(identity.KeyBlob) && r.Fingerprint != agent.KeyFingerprint(identity.KeyBlob) {
+		return false
+	}
+	if r.Comment != "" {
+		if matched, _ := path.Match(r.Comment, string(identity.Comment)); !matched {
+			return false
+		}
+	}
+	if r.Type != "" && !matchesType(r.Type, identity.KeyBlob) && !matchesType(r.Type, agent.CertifiedKey(identity.KeyBlob)) {
+		return false
+	}
+	return true
+}
+
+func matchesType(pattern string, keyBlob []byte) bool {
+	keyType, _, err := agent.ReadString(keyBlob)
+	if err != nil {
+		return false
+	}
+	matched, _ := path.Match(pattern, string(keyType))
+	return matched
+}
+
+type listenerOrder struct {
+	rules []Rule
+	// max is the maximum number of identities listed, 0 for no limit
+	max int
+}
+
+// Order reorders and limits the identities listed on some listeners, as OpenSSH tries keys in the listed order
+type Order struct {
+	listeners map[string]*listenerOrder
+}
+
+func New() *Order {
+	return &Order{
+		listeners: map[string]*listenerOrder{},
+	}
+}
+
+// AddListener lists identities matching the first rule first, then the second rule, ... then the others,
+// keeping the upstream order otherwise. Certificates matching a rule are listed before the keys matching it.
+// At most max identities are listed if max is not 0.
+func (o *Order) AddListener(listener string, rules []Rule, max int) error {
+	if len(rules) == 0 && max == 0 {
+		return nil
+	}
+	if max < 0 {
+		return fmt.Errorf("%s: listener %s: negative maximum identity count", PackageName, listener)
+	}
+	for i := range rules {
+		if err := rules[i].check(); err != nil {
+			return fmt.Errorf("listener %s: %w", listener, err)
+		}
+	}
+
+	o.listeners[listener] = &listenerOrder{rules: rules, max: max}
+	return nil
+}
+
+// rank returns the index of the first matching rule, or the rule count if none matches
+func (l *listenerOrder) rank(identity *agent.Identity) int {
+	for i := range l.rules {
+		if l.rules[i].matches(identity) {
+			return i
+		}
+	}
+	return len(l.rules)
+}
+
+func (l *listenerOrder) orderIdentities(conn *agent.Connection, reply agent.AgentMessageReply) agent.AgentMessageReply {
+	identities, err := agent.ParseIdentitiesAnswer(reply.Data)
+	if err != nil {
+		return reply
+	}
+
+	// Certificates go before the plain keys matching the same rule, so they are tried first and kept by max
+	ranks := make([]int, len(identities))
+	for i := range identities {
+		ranks[i] = 2 * l.rank(&identities[i])
+		if ranks[i] < 2*len(l.rules) && agent.CertifiedKey(identities[i].KeyBlob) == nil {
+			ranks[i]++
+		}
+	}
+
+	ordered := make([]agent.Identity, len(identities))
+	indexes := make([]int, len(identities))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool { return ranks[indexes[i]] < ranks[indexes[j]] })
+	for i, index := range indexes {
+		ordered[i] = identities[index]
+	}
+
+	if l.max > 0 && len(ordered) > l.max {
+		log.Debugf("%s: listing %d of %d identities to %s", PackageName, l.max, len(ordered), conn)
+		ordered = ordered[:l.max]
+	}
+
+	return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(ordered)}
+}
+
+func (o *Order) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		order, ok := o.listeners[conn.Listener]
+		if !ok || agent.MessageType(query) != agent.SSH_AGENTC_REQUEST_IDENTITIES {
+			return next(conn, query)
+		}
+
+		return order.orderIdentities(conn, next(conn, query))
+	}
+}
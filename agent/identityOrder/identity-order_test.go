@@ -0,0 +1,154 @@
+package identityOrder
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"slices"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+func newIdentity(t *testing.T, comment string) (agent.Identity, ssh.PublicKey) {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agent.Identity{KeyBlob: key.Marshal(), Comment: []byte(comment)}, key
+}
+
+// newCertificateIdentity returns an identity with a certificate of key
+func newCertificateIdentity(t *testing.T, key ssh.PublicKey, comment string) agent.Identity {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &ssh.Certificate{Key: key, CertType: ssh.UserCert, ValidBefore: ssh.CertTimeInfinity}
+	if err := certificate.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return agent.Identity{KeyBlob: certificate.Marshal(), Comment: []byte(comment)}
+}
+
+// order returns the comments of identities as listed by a listener with rules and max
+func order(t *testing.T, identities []agent.Identity, rules []Rule, max int) []string {
+	t.Helper()
+
+	o := New()
+	if err := o.AddListener("test", rules, max); err != nil {
+		t.Fatal(err)
+	}
+	reply := o.listeners["test"].orderIdentities(agent.NewConnection("test", agent.PeerInfo{}), agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(identities)})
+
+	listed, err := agent.ParseIdentitiesAnswer(reply.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := make([]string, len(listed))
+	for i := range listed {
+		comments[i] = string(listed[i].Comment)
+	}
+	return comments
+}
+
+func TestCertificates(t *testing.T) {
+	other, _ := newIdentity(t, "other")
+	work, workKey := newIdentity(t, "work")
+	workCertificate := newCertificateIdentity(t, workKey, "work-cert")
+	workFingerprint := agent.Fingerprint(workKey.Marshal())
+
+	// Certificates are listed after the keys by the certificates middleware
+	identities := []agent.Identity{other, work, workCertificate}
+
+	tests := []struct {
+		name  string
+		rules []Rule
+		max   int
+		want  []string
+	}{
+		{"fingerprint of the key", []Rule{{Fingerprint: workFingerprint}}, 0, []string{"work-cert", "work", "other"}},
+		{"fingerprint with max", []Rule{{Fingerprint: workFingerprint}}, 1, []string{"work-cert"}},
+		{"fingerprint of the certificate", []Rule{{Fingerprint: agent.Fingerprint(workCertificate.KeyBlob)}}, 0, []string{"work-cert", "other", "work"}},
+		{"type of the key", []Rule{{Type: ssh.KeyAlgoED25519}}, 0, []string{"work-cert", "other", "work"}},
+		{"type of certificates", []Rule{{Type: "*-cert-v01@openssh.com"}}, 0, []string{"work-cert", "other", "work"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := order(t, identities, test.rules, test.max); !slices.Equal(got, test.want) {
+				t.Errorf("listed %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	var identities []agent.Identity
+	var fingerprints []string
+	for _, comment := range []string{"personal", "work-1", "github", "work-2", "old"} {
+		identity, key := newIdentity(t, comment)
+		identities = append(identities, identity)
+		fingerprints = append(fingerprints, agent.Fingerprint(key.Marshal()))
+	}
+
+	tests := []struct {
+		name  string
+		rules []Rule
+		max   int
+		want  []string
+	}{
+		{"max only", nil, 2, []string{"personal", "work-1"}},
+		{"max over the identity count", nil, 10, []string{"personal", "work-1", "github", "work-2", "old"}},
+		{"matches keep the upstream order", []Rule{{Comment: "work-*"}}, 0, []string{"work-1", "work-2", "personal", "github", "old"}},
+		{"rules order", []Rule{{Comment: "old"}, {Comment: "work-*"}}, 0, []string{"old", "work-1", "work-2", "personal", "github"}},
+		{"first matching rule", []Rule{{Comment: "work-2"}, {Comment: "old"}, {Comment: "work-*"}}, 0, []string{"work-2", "old", "work-1", "personal", "github"}},
+		{"fingerprint", []Rule{{Fingerprint: fingerprints[2]}}, 0, []string{"github", "personal", "work-1", "work-2", "old"}},
+		{"all fields must match", []Rule{{Comment: "work-*", Fingerprint: fingerprints[3]}}, 0, []string{"work-2", "personal", "work-1", "github", "old"}},
+		{"type", []Rule{{Type: "ssh-rsa"}, {Type: "ssh-ed25519"}}, 0, []string{"personal", "work-1", "github", "work-2", "old"}},
+		{"truncated after ordering", []Rule{{Comment: "work-*"}, {Comment: "github"}}, 3, []string{"work-1", "work-2", "github"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := order(t, identities, test.rules, test.max); !slices.Equal(got, test.want) {
+				t.Errorf("listed %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddListener(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		max   int
+		valid bool
+	}{
+		{"rules", []Rule{{Comment: "*@work"}}, 0, true},
+		{"max", nil, 1, true},
+		{"negative max", nil, -1, false},
+		{"empty rule", []Rule{{}}, 0, false},
+		{"bad pattern", []Rule{{Type: "["}}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := New().AddListener("test", test.rules, test.max); (err == nil) != test.valid {
+				t.Errorf("AddListener error %v, want valid = %v", err, test.valid)
+			}
+		})
+	}
+}
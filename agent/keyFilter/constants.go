@@ -0,0 +1,3 @@
+package keyFilter
+
+const PackageName = "key-filter"
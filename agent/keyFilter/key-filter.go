@@ -0,0 +1,101 @@
+package keyFilter
+
+import (
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/readOnly"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+type filteredListener struct {
+	// allowed key fingerprints
+	keys           map[string]bool
+	safeExtensions map[string]bool
+}
+
+// Filter restricts the keys visible and usable on some listeners.
+// Filtered listeners can't manage keys either, as this would affect the keys of other listeners.
+type Filter struct {
+	// only filtered listeners are present
+	listeners map[string]*filteredListener
+}
+
+func New() *Filter {
+	return &Filter{
+		listeners: map[string]*filteredListener{},
+	}
+}
+
+// AddListener restricts a listener to the keys with the given SHA256 fingerprints,
+// safeExtensions are the allowed extensions, readOnly.DefaultSafeExtensions if nil
+func (f *Filter) AddListener(listener string, fingerprints []string, safeExtensions []string) {
+	if safeExtensions == nil {
+		safeExtensions = readOnly.DefaultSafeExtensions
+	}
+
+	filtered := &filteredListener{
+		keys:           map[string]bool{},
+		safeExtensions: map[string]bool{},
+	}
+	for _, fingerprint := range fingerprints {
+		filtered.keys[fingerprint] = true
+	}
+	for _, extension := range safeExtensions {
+		filtered.safeExtensions[extension] = true
+	}
+
+	f.listeners[listener] = filtered
+}
+
+func (f *Filter) filterIdentities(allowed map[string]bool, reply agent.AgentMessageReply) agent.AgentMessageReply {
+	identities, err := agent.ParseIdentitiesAnswer(reply.Data)
+	if err != nil {
+		return reply
+	}
+
+	filtered := identities[:0]
+	for _, identity := range identities {
+		if allowed[agent.Fingerprint(identity.KeyBlob)] {
+			filtered = append(filtered, identity)
+		}
+	}
+
+	return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(filtered)}
+}
+
+func (f *Filter) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		filtered, ok := f.listeners[conn.Listener]
+		if !ok {
+			return next(conn, query)
+		}
+
+		switch agent.MessageType(query) {
+		case agent.SSH_AGENTC_REQUEST_IDENTITIES:
+			return f.filterIdentities(filtered.keys, next(conn, query))
+
+		case agent.SSH_AGENTC_SIGN_REQUEST:
+			keyBlob, err := agent.RequestKeyBlob(query)
+			if err != nil || !filtered.keys[agent.Fingerprint(keyBlob)] {
+				log.Infof("%s: refusing %s of a filtered key from %s",
+					PackageName,
+					agent.MessageTypeName(agent.MessageType(query)),
+					conn)
+				return agent.AGENT_MESSAGE_ERROR_REPLY
+			}
+
+		case agent.SSH_AGENTC_EXTENSION:
+			extension, err := agent.ExtensionName(query)
+			if err != nil || !filtered.safeExtensions[extension] {
+				log.Infof("%s: refusing extension %q from %s", PackageName, extension, conn)
+				return agent.AGENT_MESSAGE_ERROR_REPLY
+			}
+
+		default:
+			// Adding, removing keys or locking the agent would change the keys of all listeners
+			log.Infof("%s: refusing %s from %s", PackageName, agent.MessageTypeName(agent.MessageType(query)), conn)
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+
+		return next(conn, query)
+	}
+}
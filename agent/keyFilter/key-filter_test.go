@@ -0,0 +1,106 @@
+package keyFilter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+	"golang.org/x/crypto/ssh"
+	xagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestFilteredListener(t *testing.T) {
+	keyring := agentTest.NewKeyring(t, "allowed")
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(xagent.AddedKey{PrivateKey: otherKey, Comment: "filtered"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, filtered := keys[0], keys[1]
+
+	f := New()
+	f.AddListener("filtered", []string{agent.Fingerprint(allowed.Marshal())}, nil)
+
+	ctx := agent.CreateAgent()
+	ctx.Use(f.Middleware)
+	agentTest.ServeUpstream(&ctx, keyring)
+	t.Cleanup(func() { agentTest.Stop(&ctx) })
+
+	client := agentTest.Client(&ctx, "filtered")
+
+	listed, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Comment != "allowed" {
+		t.Errorf("list = %v, want only the allowed key", listed)
+	}
+	agentTest.CheckSign(t, client)
+	if _, err := client.Sign(filtered, []byte("data")); err == nil {
+		t.Error("sign with a filtered key worked")
+	}
+
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := map[string]func() error{
+		"remove":     func() error { return client.Remove(allowed) },
+		"remove all": client.RemoveAll,
+		"lock":       func() error { return client.Lock([]byte("passphrase")) },
+		"unlock":     func() error { return client.Unlock([]byte("passphrase")) },
+		"add":        func() error { return client.Add(xagent.AddedKey{PrivateKey: newKey}) },
+		"extension": func() error {
+			_, err := client.Extension("other@example.com", nil)
+			return err
+		},
+	}
+	for name, query := range refused {
+		if err := query(); err == nil {
+			t.Errorf("%s worked on a filtered listener", name)
+		}
+	}
+
+	// The upstream agent is unchanged and other listeners see all keys
+	all, err := agentTest.Client(&ctx, "other").List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("upstream has %d keys, want 2", len(all))
+	}
+}
+
+func TestSafeExtensions(t *testing.T) {
+	keyring := agentTest.NewKeyring(t, "allowed")
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := New()
+	f.AddListener("filtered", []string{agent.Fingerprint(keys[0].Marshal())}, []string{"other@example.com"})
+
+	next := func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		return agent.AGENT_MESSAGE_SUCCESS_REPLY
+	}
+	conn := agent.NewConnection("filtered", agent.PeerInfo{})
+	extension := func(name string) []byte {
+		return agent.NewAgentMessage(agent.SSH_AGENTC_EXTENSION, ssh.Marshal(struct{ Name string }{name}))
+	}
+
+	if reply := f.Middleware(next)(conn, extension("other@example.com")); agent.MessageType(reply.Data) != agent.SSH_AGENT_SUCCESS {
+		t.Error("allowlisted extension refused")
+	}
+	if reply := f.Middleware(next)(conn, extension("query")); agent.MessageType(reply.Data) != agent.SSH_AGENT_FAILURE {
+		t.Error("extension out of safe-extensions forwarded")
+	}
+}
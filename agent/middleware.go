@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// QueryHandler processes an agent query received on a connection and returns the reply
+type QueryHandler func(conn *Connection, query []byte) AgentMessageReply
+
+// Middleware wraps a QueryHandler to inspect, answer or modify queries before they reach the upstream agent
+type Middleware func(next QueryHandler) QueryHandler
+
+// Use adds a middleware to the query processing chain.
+// Middlewares added first see queries first, they must all be added before the first query.
+func (a *AgentContext) Use(middleware Middleware) {
+	a.middlewares = append(a.middlewares, middleware)
+}
+
+// Query runs a query through the middlewares and the upstream agent and waits for its reply.
+// Once stopping, queries are refused with a failure reply.
+func (a *AgentContext) Query(conn *Connection, query []byte) AgentMessageReply {
+	return a.QueryContext(context.Background(), conn, query)
+}
+
+// QueryContext is like Query, but stops waiting for the upstream agent and replies a failure when ctx is done
+func (a *AgentContext) QueryContext(ctx context.Context, conn *Connection, query []byte) AgentMessageReply {
+	a.handlerOnce.Do(func() {
+		a.handler = a.forwardQuery
+		for i := len(a.middlewares) - 1; i >= 0; i-- {
+			a.handler = a.middlewares[i](a.handler)
+		}
+	})
+
+	// Register the query while holding the lock so Stop can't start waiting for in-flight queries before
+	a.stopLock.RLock()
+	if a.stopping {
+		a.stopLock.RUnlock()
+		log.Debugf("agentContext: stopping, refusing query from %s", conn)
+		return AGENT_MESSAGE_ERROR_REPLY
+	}
+	a.inFlight.Add(1)
+	a.stopLock.RUnlock()
+	defer a.inFlight.Done()
+
+	// Queries of a connection are sequential, the context of the current one can be kept in the connection
+	conn.queryCtx = ctx
+	defer func() { conn.queryCtx = nil }()
+
+	return a.handler(conn, query)
+}
+
+func (a *AgentContext) forwardQuery(conn *Connection, query []byte) AgentMessageReply {
+	replyChannel := make(chan AgentMessageReply, 1)
+	queryCtx := conn.queryContext()
+
+	// Hold the read lock so QueryChannel can't be closed while sending to it,
+	// upstreamCtx is canceled before closing QueryChannel to unblock the send.
+	// Stop must not wait for this lock, as the upstream agent may not be reading QueryChannel.
+	a.sendLock.RLock()
+	if a.upstreamCtx.Err() != nil {
+		// QueryChannel may be closed, select could choose to send to it
+		a.sendLock.RUnlock()
+		return AGENT_MESSAGE_ERROR_REPLY
+	}
+	select {
+	case a.QueryChannel <- AgentMessageQuery{Data: query, ReplyChannel: replyChannel, Connection: conn}:
+		a.sendLock.RUnlock()
+	case <-a.upstreamCtx.Done():
+		a.sendLock.RUnlock()
+		return AGENT_MESSAGE_ERROR_REPLY
+	case <-queryCtx.Done():
+		a.sendLock.RUnlock()
+		log.Debugf("agentContext: query from %s canceled before reaching the upstream agent: %v", conn, queryCtx.Err())
+		return AGENT_MESSAGE_ERROR_REPLY
+	}
+
+	select {
+	case reply := <-replyChannel:
+		return reply
+	case <-a.upstreamCtx.Done():
+		log.Debugf("agentContext: stopped while waiting for the upstream agent reply to %s", conn)
+		return AGENT_MESSAGE_ERROR_REPLY
+	case <-queryCtx.Done():
+		log.Debugf("agentContext: query from %s canceled while waiting for the upstream agent reply: %v", conn, queryCtx.Err())
+		return AGENT_MESSAGE_ERROR_REPLY
+	}
+}
@@ -0,0 +1,55 @@
+package agent_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+func TestQueryContextCanceled(t *testing.T) {
+	query := agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES)
+
+	tests := []struct {
+		name string
+		// upstream reads the queries of ctx without replying when true
+		received bool
+	}{
+		{"upstream not reading", false},
+		{"upstream not replying", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := agent.CreateAgent()
+			received := make(chan agent.AgentMessageQuery, 1)
+			if test.received {
+				go func() {
+					for message := range ctx.QueryChannel {
+						received <- message
+					}
+				}()
+			}
+			t.Cleanup(func() {
+				ctx.Stop()
+				ctx.Wait()
+			})
+
+			queryCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			reply := ctx.QueryContext(queryCtx, agent.NewConnection("test", agent.PeerInfo{}), query)
+			if agent.MessageType(reply.Data) != agent.SSH_AGENT_FAILURE {
+				t.Errorf("reply = %x, want a failure", reply.Data)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("query canceled after %v", elapsed)
+			}
+			if test.received && len(received) != 1 {
+				t.Error("query not sent to the upstream agent")
+			}
+		})
+	}
+}
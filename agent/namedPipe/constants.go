@@ -1,3 +1,6 @@
 package namedPipe
 
-const PackageName = "named-pipe"
+const (
+	PackageName  = "named-pipe"
+	EndpointName = "pipe"
+)
@@ -11,10 +11,10 @@ import (
 	"github.com/amurzeau/ssh-agent-bridge/log"
 )
 
-func ServePipe(pipePath string, ctx *agent.AgentContext) {
+func ServePipe(pipePath string, ctx *agent.AgentContext) error {
 	if pipePath == "" {
 		log.Errorf("%s: empty pipe path, skipping serving for ssh-agent queries", PackageName)
-		return
+		return nil
 	}
 
 	log.Infof("%s: listening for agent requests on pipe %v\n", PackageName, pipePath)
@@ -29,5 +29,5 @@ func ServePipe(pipePath string, ctx *agent.AgentContext) {
 		log.Debugf("%s: security descriptor: %s", PackageName, pipeConfig.SecurityDescriptor)
 		return winio.ListenPipe(pipePath, &pipeConfig)
 	}
-	common.GenericNetServer(PackageName, listenFunction, ctx)
+	return common.GenericNetServer(PackageName, EndpointName, listenFunction, common.NamedPipePeer, ctx)
 }
@@ -1,3 +1,12 @@
 package pageant
 
-const PackageName = "pageant"
+import "time"
+
+const (
+	PackageName  = "pageant"
+	EndpointName = "pageant"
+
+	// DEFAULT_QUERY_TIMEOUT is the default time the pageant window waits for a reply before replying a failure.
+	// The window can't process other queries meanwhile, so keep it short.
+	DEFAULT_QUERY_TIMEOUT = 10 * time.Second
+)
@@ -1,7 +1,6 @@
 package pageant
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"sync"
@@ -17,13 +16,6 @@ var (
 	ErrPageantNotFound = errors.New("pageant process not found")
 	// ErrSendMessage returns when message to pageant cannt be sent
 	ErrSendMessage = errors.New("error sending message")
-
-	// ErrMessageTooLong returns when message is too long (see MaxMessageLen)
-	ErrMessageTooLong = errors.New("message too long")
-	// ErrInvalidMessageFormat returns when message have invalid fomat
-	ErrInvalidMessageFormat = errors.New("invalid message format")
-	// ErrResponseTooLong returns when response from pageant is too long
-	ErrResponseTooLong = errors.New("response too long")
 )
 
 /////////////////////////
@@ -36,13 +28,8 @@ var (
 // 'msg' is raw agent request with length prefix
 // Response is raw agent response with length prefix
 func query(msg []byte) ([]byte, error) {
-	if len(msg) > agent.MAX_AGENT_MESSAGE_SIZE {
-		return nil, ErrMessageTooLong
-	}
-
-	msgLen := binary.BigEndian.Uint32(msg[:4])
-	if len(msg) != int(msgLen)+4 {
-		return nil, ErrInvalidMessageFormat
+	if err := checkMessage(msg); err != nil {
+		return nil, err
 	}
 
 	lock.Lock()
@@ -70,9 +57,11 @@ func query(msg []byte) ([]byte, error) {
 	}
 	defer syscall.UnmapViewOfFile(ptr)
 
-	mmSlice := (*(*[agent.MAX_AGENT_MESSAGE_SIZE]byte)(unsafe.Pointer(ptr)))[:]
+	mm := sharedMemory(unsafe.Slice((*byte)(unsafe.Pointer(ptr)), agent.MAX_AGENT_MESSAGE_SIZE))
 
-	copy(mmSlice, msg)
+	if err := mm.writeMessage(msg); err != nil {
+		return nil, err
+	}
 
 	mapNameBytesZ := append([]byte(mapName), 0)
 
@@ -88,15 +77,12 @@ func query(msg []byte) ([]byte, error) {
 		return nil, ErrSendMessage
 	}
 
-	respLen := binary.BigEndian.Uint32(mmSlice[:4])
-	if respLen > agent.MAX_AGENT_MESSAGE_SIZE-4 {
+	respData, err := mm.readMessage()
+	if errors.Is(err, ErrMessageTooLong) {
 		return nil, ErrResponseTooLong
 	}
 
-	respData := make([]byte, respLen+4)
-	copy(respData, mmSlice)
-
-	return respData, nil
+	return respData, err
 }
 
 func pageantWindow() uintptr {
@@ -117,6 +103,7 @@ func ClientPageant(ctx *agent.AgentContext) error {
 
 	for message := range ctx.QueryChannel {
 		reply, err := query(message.Data)
+		ctx.UpstreamResult(err)
 		if err != nil {
 			log.Errorf("%s: query error: %v\n", PackageName, err)
 			message.ReplyChannel <- agent.AGENT_MESSAGE_ERROR_REPLY
@@ -0,0 +1,105 @@
+package pageant
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// Platform independent part of the Pageant WM_COPYDATA protocol.
+// The client writes a length prefixed agent query in a shared memory map,
+// sends its name with WM_COPYDATA and the server replaces the query with the reply.
+
+var (
+	// ErrMessageTooLong returns when message is too long (see MaxMessageLen)
+	ErrMessageTooLong = errors.New("message too long")
+	// ErrInvalidMessageFormat returns when message have invalid fomat
+	ErrInvalidMessageFormat = errors.New("invalid message format")
+	// ErrResponseTooLong returns when response from pageant is too long
+	ErrResponseTooLong = errors.New("response too long")
+	// ErrInvalidMapName returns when the map name sent with WM_COPYDATA is not valid
+	ErrInvalidMapName = errors.New("invalid map name")
+)
+
+// Windows limit for object names
+const maxMapNameLength = 260
+
+// sharedMemory is the view of the memory map shared by the Pageant client and server
+type sharedMemory []byte
+
+// parseMapName returns the memory map name sent as a \0 terminated string in WM_COPYDATA data
+func parseMapName(mapNameZ []byte) (string, error) {
+	if len(mapNameZ) < 2 || mapNameZ[len(mapNameZ)-1] != 0 {
+		return "", fmt.Errorf("%w: should end with \\0", ErrInvalidMapName)
+	}
+
+	mapName := mapNameZ[:len(mapNameZ)-1]
+	if len(mapName) > maxMapNameLength {
+		return "", fmt.Errorf("%w: too long (%d bytes)", ErrInvalidMapName, len(mapName))
+	}
+	if bytes.IndexByte(mapName, 0) >= 0 {
+		return "", fmt.Errorf("%w: contains \\0", ErrInvalidMapName)
+	}
+
+	return string(mapName), nil
+}
+
+// checkMessage checks that msg is a single length prefixed agent message
+func checkMessage(msg []byte) error {
+	if len(msg) > agent.MAX_AGENT_MESSAGE_SIZE {
+		return ErrMessageTooLong
+	}
+	if len(msg) < 4 || int(binary.BigEndian.Uint32(msg))+4 != len(msg) {
+		return ErrInvalidMessageFormat
+	}
+	return nil
+}
+
+// readMessage returns a copy of the length prefixed message stored in the shared memory
+func (m sharedMemory) readMessage() ([]byte, error) {
+	if len(m) < 4 {
+		return nil, fmt.Errorf("%w: shared memory too small (%d bytes)", ErrInvalidMessageFormat, len(m))
+	}
+
+	messageSize := uint64(binary.BigEndian.Uint32(m)) + 4
+	if messageSize > agent.MAX_AGENT_MESSAGE_SIZE {
+		return nil, fmt.Errorf("%w: %d > %d", ErrMessageTooLong, messageSize, agent.MAX_AGENT_MESSAGE_SIZE)
+	}
+	if messageSize > uint64(len(m)) {
+		return nil, fmt.Errorf("%w: %d bytes message in %d bytes shared memory", ErrInvalidMessageFormat, messageSize, len(m))
+	}
+
+	msg := make([]byte, messageSize)
+	copy(msg, m)
+
+	return msg, nil
+}
+
+// writeMessage stores a length prefixed message in the shared memory
+func (m sharedMemory) writeMessage(msg []byte) error {
+	if err := checkMessage(msg); err != nil {
+		return err
+	}
+	if len(msg) > len(m) {
+		return fmt.Errorf("%w: %d bytes message in %d bytes shared memory", ErrMessageTooLong, len(msg), len(m))
+	}
+
+	copy(m, msg)
+
+	return nil
+}
+
+// writeReply stores the reply in the shared memory, or a failure reply if it doesn't fit
+func (m sharedMemory) writeReply(reply []byte) error {
+	if err := m.writeMessage(reply); err != nil {
+		if errors.Is(err, ErrMessageTooLong) {
+			m.writeMessage(agent.AGENT_MESSAGE_ERROR_REPLY.Data)
+		}
+		return fmt.Errorf("can't write reply: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package pageant
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// lengthPrefixed returns a message announcing size bytes followed by payload
+func lengthPrefixed(size uint32, payload []byte) []byte {
+	msg := binary.BigEndian.AppendUint32(nil, size)
+	return append(msg, payload...)
+}
+
+func TestReadMessage(t *testing.T) {
+	query := agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES)
+
+	tests := []struct {
+		name   string
+		memory []byte
+		want   []byte
+		err    error
+	}{
+		{"exact", query, query, nil},
+		{"trailing data", append(append([]byte(nil), query...), 1, 2, 3), query, nil},
+		{"empty message", lengthPrefixed(0, nil), lengthPrefixed(0, nil), nil},
+		{"empty memory", nil, nil, ErrInvalidMessageFormat},
+		{"short length", []byte{0, 0, 1}, nil, ErrInvalidMessageFormat},
+		{"short payload", lengthPrefixed(10, []byte{11}), nil, ErrInvalidMessageFormat},
+		{"oversized", lengthPrefixed(agent.MAX_AGENT_MESSAGE_SIZE, make([]byte, agent.MAX_AGENT_MESSAGE_SIZE)), nil, ErrMessageTooLong},
+		{"length overflow", lengthPrefixed(0xffffffff, []byte{11}), nil, ErrMessageTooLong},
+		{"length overflow minus 4", lengthPrefixed(0xfffffffc, []byte{11}), nil, ErrMessageTooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := sharedMemory(test.memory).readMessage()
+			if !errors.Is(err, test.err) {
+				t.Fatalf("readMessage() error = %v, want %v", err, test.err)
+			}
+			if !bytes.Equal(msg, test.want) {
+				t.Errorf("readMessage() = %x, want %x", msg, test.want)
+			}
+		})
+	}
+}
+
+func TestReadMessageCopies(t *testing.T) {
+	memory := sharedMemory(agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES))
+	msg, err := memory.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory[4] = 0
+	if msg[4] != agent.SSH_AGENTC_REQUEST_IDENTITIES {
+		t.Error("readMessage() result changed with the shared memory")
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	reply := agent.NewAgentMessage(agent.SSH_AGENT_SUCCESS)
+
+	tests := []struct {
+		name       string
+		memorySize int
+		msg        []byte
+		err        error
+	}{
+		{"fits", 16, reply, nil},
+		{"exact size", len(reply), reply, nil},
+		{"memory too small", len(reply) - 1, reply, ErrMessageTooLong},
+		{"oversized", agent.MAX_AGENT_MESSAGE_SIZE + 8, lengthPrefixed(agent.MAX_AGENT_MESSAGE_SIZE, make([]byte, agent.MAX_AGENT_MESSAGE_SIZE)), ErrMessageTooLong},
+		{"short", 16, []byte{0, 0}, ErrInvalidMessageFormat},
+		{"length mismatch", 16, lengthPrefixed(3, []byte{1}), ErrInvalidMessageFormat},
+		{"length overflow", 16, lengthPrefixed(0xfffffffc, nil), ErrInvalidMessageFormat},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := make(sharedMemory, test.memorySize)
+			err := memory.writeMessage(test.msg)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("writeMessage() error = %v, want %v", err, test.err)
+			}
+			if err == nil && !bytes.Equal(memory[:len(test.msg)], test.msg) {
+				t.Errorf("shared memory = %x, want %x", memory[:len(test.msg)], test.msg)
+			}
+		})
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	failure := agent.AGENT_MESSAGE_ERROR_REPLY.Data
+	large := agent.NewAgentMessage(agent.SSH_AGENT_IDENTITIES_ANSWER, make([]byte, 100))
+
+	tests := []struct {
+		name       string
+		memorySize int
+		reply      []byte
+		want       []byte
+		err        error
+	}{
+		{"fits", 256, large, large, nil},
+		{"too long for the memory", 64, large, failure, ErrMessageTooLong},
+		{"invalid reply", 64, []byte{0, 0, 0, 9, 1}, make([]byte, 5), ErrInvalidMessageFormat},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := make(sharedMemory, test.memorySize)
+			err := memory.writeReply(test.reply)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("writeReply() error = %v, want %v", err, test.err)
+			}
+			if !bytes.Equal(memory[:len(test.want)], test.want) {
+				t.Errorf("shared memory = %x, want %x", memory[:len(test.want)], test.want)
+			}
+		})
+	}
+}
+
+func TestParseMapName(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapName []byte
+		want    string
+		err     error
+	}{
+		{"valid", []byte("PageantRequest12345678\x00"), "PageantRequest12345678", nil},
+		{"not terminated", []byte("PageantRequest"), "", ErrInvalidMapName},
+		{"empty", []byte{0}, "", ErrInvalidMapName},
+		{"inner nul", []byte("Pageant\x00Request\x00"), "", ErrInvalidMapName},
+		{"too long", append(bytes.Repeat([]byte("a"), maxMapNameLength+1), 0), "", ErrInvalidMapName},
+		{"longest", append(bytes.Repeat([]byte("a"), maxMapNameLength), 0), string(bytes.Repeat([]byte("a"), maxMapNameLength)), nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapName, err := parseMapName(test.mapName)
+			if !errors.Is(err, test.err) || mapName != test.want {
+				t.Errorf("parseMapName() = %q, %v, want %q, %v", mapName, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES))
+	f.Add([]byte{0, 0, 0, 5, 1})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xfc})
+
+	f.Fuzz(func(t *testing.T, memory []byte) {
+		msg, err := sharedMemory(memory).readMessage()
+		if err != nil {
+			return
+		}
+
+		if len(msg) > len(memory) || len(msg) > agent.MAX_AGENT_MESSAGE_SIZE {
+			t.Fatalf("%d bytes message read from %d bytes shared memory", len(msg), len(memory))
+		}
+		if err := checkMessage(msg); err != nil {
+			t.Fatalf("readMessage() returned an invalid message: %v", err)
+		}
+
+		// A message read from the shared memory can be written back
+		if err := make(sharedMemory, len(msg)).writeMessage(msg); err != nil {
+			t.Fatalf("writeMessage() of a read message: %v", err)
+		}
+	})
+}
@@ -1,10 +1,12 @@
 package pageant
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
+	"runtime"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/amurzeau/ssh-agent-bridge/agent"
@@ -17,19 +19,19 @@ var (
 )
 
 type pageantServerContext struct {
-	ctx          *agent.AgentContext
-	ReplyChannel chan agent.AgentMessageReply
+	ctx *agent.AgentContext
+	// queryTimeout is the maximum time the pageant window waits for a reply before replying a failure
+	queryTimeout time.Duration
 }
 
 var globalPageantState pageantServerContext = pageantServerContext{}
 
 func (p *pageantServerContext) processPageantQuery(mapNameZ []byte) error {
-	if len(mapNameZ) < 1 || mapNameZ[len(mapNameZ)-1] != 0 {
-		return fmt.Errorf("%s: bad map name, should end with \\0", PackageName)
+	mapName, err := parseMapName(mapNameZ)
+	if err != nil {
+		return fmt.Errorf("%s: %w", PackageName, err)
 	}
 
-	mapName := (string)(mapNameZ[:len(mapNameZ)-1])
-
 	pMapName, _ := syscall.UTF16PtrFromString(mapName)
 
 	log.Debugf("%s: opening memory map at %s", PackageName, mapName)
@@ -44,9 +46,15 @@ func (p *pageantServerContext) processPageantQuery(mapNameZ []byte) error {
 	}
 	defer syscall.CloseHandle((syscall.Handle)(mmap))
 
+	ptr, err := syscall.MapViewOfFile((syscall.Handle)(mmap), syscall.FILE_MAP_WRITE, 0, 0, 0)
+	if ptr == _NULL {
+		return fmt.Errorf("%s: failed map view of memory (MapViewOfFile): %w", PackageName, err)
+	}
+	defer syscall.UnmapViewOfFile(ptr)
+
 	var memoryBasicInformation _MEMORY_BASIC_INFORMATION
 
-	mbiSize, _, err := winVirtualQuery(mmap,
+	mbiSize, _, err := winVirtualQuery(ptr,
 		(uintptr)(unsafe.Pointer(&memoryBasicInformation)),
 		unsafe.Sizeof(memoryBasicInformation))
 
@@ -56,31 +64,44 @@ func (p *pageantServerContext) processPageantQuery(mapNameZ []byte) error {
 
 	log.Debugf("%s: map size: %d", PackageName, memoryBasicInformation.RegionSize)
 
-	ptr, err := syscall.MapViewOfFile((syscall.Handle)(mmap), syscall.FILE_MAP_WRITE, 0, 0, 0)
-	if ptr == _NULL {
-		return fmt.Errorf("%s: failed map view of memory (MapViewOfFile): %w", PackageName, err)
-	}
-	defer syscall.UnmapViewOfFile(ptr)
+	mm := sharedMemory(unsafe.Slice((*byte)(unsafe.Pointer(ptr)), memoryBasicInformation.RegionSize))
 
-	memoryMapSize := memoryBasicInformation.RegionSize
-	mmSlice := unsafe.Slice((*byte)(unsafe.Pointer(ptr)), memoryMapSize)
+	// The memory map is created by the client, its owner is the client user
+	var peer agent.PeerInfo
+	if owner, err := getObjectOwner(mmap); err == nil {
+		peer.Uid = owner
+	} else {
+		log.Debugf("%s: can't get memory map owner: %v", PackageName, err)
+	}
+	conn := agent.NewConnection(EndpointName, peer)
 
-	agentMessageSize := binary.BigEndian.Uint32(mmSlice[:4])
-	if agentMessageSize > agent.MAX_AGENT_MESSAGE_SIZE-4 {
-		return fmt.Errorf("%s: received agent message too long: %d > %d",
-			PackageName,
-			agentMessageSize,
-			agent.MAX_AGENT_MESSAGE_SIZE-4)
+	query, err := mm.readMessage()
+	if err != nil {
+		return fmt.Errorf("%s: %w", PackageName, err)
 	}
 
-	msg := make([]byte, agentMessageSize+4)
-	copy(msg, mmSlice)
+	// The client waits in SendMessage until the window procedure returns and the message loop is blocked meanwhile,
+	// so don't wait forever for the upstream agent (touch-to-sign tokens, confirmation prompts, ...)
+	queryCtx, cancel := context.WithTimeout(context.Background(), p.queryTimeout)
+	defer cancel()
 
-	p.ctx.QueryChannel <- agent.AgentMessageQuery{Data: msg, ReplyChannel: p.ReplyChannel}
+	replyChannel := make(chan agent.AgentMessageReply, 1)
+	go func() {
+		replyChannel <- p.ctx.QueryContext(queryCtx, conn, query)
+	}()
 
-	agentMessageQuery := <-p.ReplyChannel
+	var reply agent.AgentMessageReply
+	select {
+	case reply = <-replyChannel:
+	case <-queryCtx.Done():
+		// Middlewares waiting for a confirmation don't see the cancellation, don't wait for them either
+		log.Errorf("%s: no reply from upstream agent after %v, replying failure", PackageName, p.queryTimeout)
+		reply = agent.AGENT_MESSAGE_ERROR_REPLY
+	}
 
-	copy(mmSlice, agentMessageQuery.Data)
+	if err := mm.writeReply(reply.Data); err != nil {
+		return fmt.Errorf("%s: %w", PackageName, err)
+	}
 
 	return nil
 }
@@ -104,21 +125,26 @@ func handlerPageantWindowProc(hwnd uintptr, msg uint32, wParam uintptr, lParam u
 	return result
 }
 
-func (p *pageantServerContext) handlerPageantMessages(hInstance uintptr, nameP *uint16, hwndPageant uintptr) {
+func (p *pageantServerContext) handlerPageantMessages(hInstance uintptr, nameP *uint16, hwndPageant uintptr) error {
 	var msg _MSG
 
-	p.ReplyChannel = make(chan agent.AgentMessageReply)
-	defer close(p.ReplyChannel)
-
 	defer winUnregisterClass(uintptr(unsafe.Pointer(nameP)), hInstance)
 	defer winDestroyWindow(hwndPageant)
 
+	doneChannel := make(chan bool)
+	defer close(doneChannel)
+
 	go func() {
-		<-p.ctx.Done()
-		log.Debugf("%s: stopping", PackageName)
-		winPostMessage(hwndPageant, _WM_QUIT, 0, 0)
+		select {
+		case <-p.ctx.ListenerDone(EndpointName):
+			log.Debugf("%s: stopping", PackageName)
+			winPostMessage(hwndPageant, _WM_QUIT, 0, 0)
+		case <-doneChannel:
+		}
 	}()
 
+	p.ctx.ListenerReady(EndpointName)
+
 	for {
 		result, _, err := winGetMessage(uintptr(unsafe.Pointer(&msg)), hwndPageant, 0, 0)
 
@@ -127,8 +153,7 @@ func (p *pageantServerContext) handlerPageantMessages(hInstance uintptr, nameP *
 		if int32(result) == 0 {
 			break
 		} else if int32(result) == -1 {
-			log.Errorf("%s: error while processing pageant messages: %v", PackageName, err)
-			break
+			return fmt.Errorf("%s: error while processing pageant messages: %w", PackageName, err)
 		}
 
 		winTranslateMessage(uintptr(unsafe.Pointer(&msg)))
@@ -136,6 +161,8 @@ func (p *pageantServerContext) handlerPageantMessages(hInstance uintptr, nameP *
 	}
 
 	log.Debugf("%s: stopped", PackageName)
+
+	return nil
 }
 
 func (p *pageantServerContext) createPageantWindow() error {
@@ -189,23 +216,23 @@ func (p *pageantServerContext) createPageantWindow() error {
 	winShowWindow(hwndPageant, _SW_HIDE)
 
 	atom = 0 // disable UnregisterClass in defer
-	p.handlerPageantMessages(hInstance, windowNameUnicode, hwndPageant)
-
-	return nil
+	return p.handlerPageantMessages(hInstance, windowNameUnicode, hwndPageant)
 }
 
-func ServePageant(ctx *agent.AgentContext) {
+// ServePageant answers the queries sent to the Pageant window, replying a failure after queryTimeout
+func ServePageant(queryTimeout time.Duration, ctx *agent.AgentContext) error {
 	if isPageantAvailable() {
-		log.Errorf("%s: error: a pageant is already existing, can't listen for pageant requests", PackageName)
-		return
+		return ErrPageantExists
 	}
 
 	log.Infof("%s: listening for pageant requests\n", PackageName)
 
 	globalPageantState.ctx = ctx
+	globalPageantState.queryTimeout = queryTimeout
 
-	err := globalPageantState.createPageantWindow()
-	if err != nil {
-		log.Debugf("%s: failed to create pageant window: %v", PackageName, err)
-	}
+	// Window messages are received by the thread that created the window
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	return globalPageantState.createPageantWindow()
 }
@@ -10,6 +10,9 @@ const (
 	_WM_QUIT        = 0x0012
 	_WM_COPYDATA    = 74
 
+	_SE_KERNEL_OBJECT           = 6
+	_OWNER_SECURITY_INFORMATION = 1
+
 	_CW_USEDEFAULT = 0x80000000
 	_NULL          = 0
 	_SW_HIDE       = 0
@@ -73,9 +76,32 @@ var (
 	winGetModuleHandle    = winAPI("kernel32.dll", "GetModuleHandleW")
 	winOpenFileMapping    = winAPI("kernel32.dll", "OpenFileMappingW")
 	winVirtualQuery       = winAPI("kernel32.dll", "VirtualQuery")
+	winGetSecurityInfo    = winAPI("advapi32.dll", "GetSecurityInfo")
+	winLocalFree          = winAPI("kernel32.dll", "LocalFree")
 )
 
 func winAPI(dllName, funcName string) func(...uintptr) (uintptr, uintptr, error) {
 	proc := syscall.MustLoadDLL(dllName).MustFindProc(funcName)
 	return func(a ...uintptr) (uintptr, uintptr, error) { return proc.Call(a...) }
 }
+
+// getObjectOwner returns the SID of the owner of a kernel object
+func getObjectOwner(handle uintptr) (string, error) {
+	var owner *syscall.SID
+	var securityDescriptor uintptr
+
+	result, _, _ := winGetSecurityInfo(handle,
+		_SE_KERNEL_OBJECT,
+		_OWNER_SECURITY_INFORMATION,
+		uintptr(unsafe.Pointer(&owner)),
+		0,
+		0,
+		0,
+		uintptr(unsafe.Pointer(&securityDescriptor)))
+	if result != 0 {
+		return "", syscall.Errno(result)
+	}
+	defer winLocalFree(securityDescriptor)
+
+	return owner.String()
+}
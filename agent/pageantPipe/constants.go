@@ -1,3 +1,6 @@
 package pageantPipe
 
-const PackageName = "pageant-pipe"
+const (
+	PackageName  = "pageant-pipe"
+	EndpointName = "pageant-pipe"
+)
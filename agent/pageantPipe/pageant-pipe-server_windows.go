@@ -11,13 +11,12 @@ import (
 	"github.com/amurzeau/ssh-agent-bridge/log"
 )
 
-func ServePageantPipe(ctx *agent.AgentContext) {
+func ServePageantPipe(ctx *agent.AgentContext) error {
 	log.Infof("%s: listening for pageant-pipe requests", PackageName)
 
 	pipePath, err := getPageantPipePath()
 	if err != nil {
-		log.Errorf("%s: failed to get pageant pipe path: %v", PackageName, err)
-		return
+		return fmt.Errorf("%s: failed to get pageant pipe path: %w", PackageName, err)
 	}
 
 	// We must hide the pageant pipe path
@@ -31,5 +30,5 @@ func ServePageantPipe(ctx *agent.AgentContext) {
 		log.Debugf("%s: security descriptor: %s", PackageName, pipeConfig.SecurityDescriptor)
 		return winio.ListenPipe(pipePath, &pipeConfig)
 	}
-	common.GenericNetServer(PackageName, listenFunction, ctx)
+	return common.GenericNetServer(PackageName, EndpointName, listenFunction, common.NamedPipePeer, ctx)
 }
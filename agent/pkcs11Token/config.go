@@ -0,0 +1,92 @@
+package pkcs11Token
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Sources of the token PIN, see NewPinPrompt
+const (
+	PIN_FROM_ASKPASS = "askpass"
+	PIN_FROM_ENV     = "env:"
+	PIN_FROM_FILE    = "file:"
+)
+
+// Config describes the PKCS#11 token used as upstream agent
+type Config struct {
+	// Module is the path of the PKCS#11 library, like /usr/lib/softhsm/libsofthsm2.so or opensc-pkcs11.dll
+	Module string
+	// Token is the label of the token to use, the first token found is used when empty
+	Token string
+	Pin   PinPrompt
+}
+
+// PinPrompt returns the PIN of a token, prompt is a text suitable to show to the user.
+// It is called each time the token needs a login, the PIN is not kept in memory.
+type PinPrompt func(prompt string) (string, error)
+
+var ErrNoAskpass = errors.New("SSH_ASKPASS is not set")
+
+// NewPinPrompt returns a PinPrompt reading the PIN from a source:
+//   - askpass runs the program of SSH_ASKPASS, askpass:PROGRAM runs PROGRAM, with the prompt as argument
+//   - env:NAME reads the environment variable NAME
+//   - file:PATH reads the first line of the file PATH
+func NewPinPrompt(source string) (PinPrompt, error) {
+	switch {
+	case source == PIN_FROM_ASKPASS:
+		return func(prompt string) (string, error) {
+			program := os.Getenv("SSH_ASKPASS")
+			if program == "" {
+				return "", fmt.Errorf("%s: can't ask PIN: %w", PackageName, ErrNoAskpass)
+			}
+			return askpass(program, prompt)
+		}, nil
+
+	case strings.HasPrefix(source, PIN_FROM_ASKPASS+":"):
+		program := strings.TrimPrefix(source, PIN_FROM_ASKPASS+":")
+		return func(prompt string) (string, error) {
+			return askpass(program, prompt)
+		}, nil
+
+	case strings.HasPrefix(source, PIN_FROM_ENV):
+		name := strings.TrimPrefix(source, PIN_FROM_ENV)
+		return func(prompt string) (string, error) {
+			pin, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("%s: environment variable %s is not set", PackageName, name)
+			}
+			return pin, nil
+		}, nil
+
+	case strings.HasPrefix(source, PIN_FROM_FILE):
+		path := strings.TrimPrefix(source, PIN_FROM_FILE)
+		return func(prompt string) (string, error) {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("%s: can't read PIN: %w", PackageName, err)
+			}
+			return firstLine(string(content)), nil
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%s: bad PIN source %s, available: %s, %s:PROGRAM, %sNAME, %sPATH",
+			PackageName, source, PIN_FROM_ASKPASS, PIN_FROM_ASKPASS, PIN_FROM_ENV, PIN_FROM_FILE)
+	}
+}
+
+// askpass runs an ssh-askpass like program which prints the PIN on its standard output
+func askpass(program string, prompt string) (string, error) {
+	output, err := exec.Command(program, prompt).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s failed: %w", PackageName, program, err)
+	}
+	return firstLine(string(output)), nil
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return strings.TrimSuffix(line, "\r")
+}
@@ -0,0 +1,6 @@
+package pkcs11Token
+
+const (
+	PackageName  = "pkcs11"
+	EndpointName = "pkcs11"
+)
@@ -0,0 +1,147 @@
+package pkcs11Token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+// Flags of SSH_AGENTC_SIGN_REQUEST selecting the RSA signature hash
+const (
+	SSH_AGENT_RSA_SHA2_256 = 2
+	SSH_AGENT_RSA_SHA2_512 = 4
+)
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+// DER DigestInfo prefixes of PKCS#1 v1.5 signatures, the token signs the prefixed hash with CKM_RSA_PKCS
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var namedCurves = []struct {
+	oid   asn1.ObjectIdentifier
+	curve elliptic.Curve
+	hash  crypto.Hash
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}, elliptic.P256(), crypto.SHA256},
+	{asn1.ObjectIdentifier{1, 3, 132, 0, 34}, elliptic.P384(), crypto.SHA384},
+	{asn1.ObjectIdentifier{1, 3, 132, 0, 35}, elliptic.P521(), crypto.SHA512},
+}
+
+func rsaPublicKey(modulus []byte, exponent []byte) (ssh.PublicKey, error) {
+	e := new(big.Int).SetBytes(exponent)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("%s: bad RSA public exponent", PackageName)
+	}
+
+	return ssh.NewPublicKey(&rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(e.Int64())})
+}
+
+// ecPoint decodes CKA_EC_POINT, a DER OCTET STRING, though some modules return the raw point
+func ecPoint(point []byte) []byte {
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		return raw
+	}
+	return point
+}
+
+func ecdsaPublicKey(params []byte, point []byte) (ssh.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("%s: bad EC parameters: %w", PackageName, err)
+	}
+
+	for _, namedCurve := range namedCurves {
+		if !namedCurve.oid.Equal(oid) {
+			continue
+		}
+
+		x, y := elliptic.Unmarshal(namedCurve.curve, ecPoint(point))
+		if x == nil {
+			return nil, fmt.Errorf("%s: bad EC point", PackageName)
+		}
+		return ssh.NewPublicKey(&ecdsa.PublicKey{Curve: namedCurve.curve, X: x, Y: y})
+	}
+
+	return nil, fmt.Errorf("%s: curve %s: %w", PackageName, oid, ErrUnsupportedKey)
+}
+
+func ed25519PublicKey(point []byte) (ssh.PublicKey, error) {
+	point = ecPoint(point)
+	if len(point) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: bad Ed25519 point", PackageName)
+	}
+
+	return ssh.NewPublicKey(ed25519.PublicKey(point))
+}
+
+// rsaSignatureHash returns the hash and signature format requested by the flags of a sign request
+func rsaSignatureHash(flags uint32) (crypto.Hash, string) {
+	switch {
+	case flags&SSH_AGENT_RSA_SHA2_512 != 0:
+		return crypto.SHA512, ssh.KeyAlgoRSASHA512
+	case flags&SSH_AGENT_RSA_SHA2_256 != 0:
+		return crypto.SHA256, ssh.KeyAlgoRSASHA256
+	default:
+		return crypto.SHA1, ssh.KeyAlgoRSA
+	}
+}
+
+// rsaSignatureInput returns the data signed by CKM_RSA_PKCS
+func rsaSignatureInput(hash crypto.Hash, data []byte) []byte {
+	hasher := hash.New()
+	hasher.Write(data)
+	return append(append([]byte(nil), digestInfoPrefixes[hash]...), hasher.Sum(nil)...)
+}
+
+// ecdsaSignatureHash returns the hash used by SSH for a curve
+func ecdsaSignatureHash(publicKey ssh.PublicKey) (crypto.Hash, error) {
+	cryptoPublicKey, ok := publicKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0, ErrUnsupportedKey
+	}
+	ecdsaKey, ok := cryptoPublicKey.CryptoPublicKey().(*ecdsa.PublicKey)
+	if !ok {
+		return 0, ErrUnsupportedKey
+	}
+
+	for _, namedCurve := range namedCurves {
+		if namedCurve.curve == ecdsaKey.Curve {
+			return namedCurve.hash, nil
+		}
+	}
+	return 0, ErrUnsupportedKey
+}
+
+// ecdsaSignatureBlob converts the r || s signature of CKM_ECDSA to the SSH encoding
+func ecdsaSignatureBlob(signature []byte) ([]byte, error) {
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, fmt.Errorf("%s: bad ECDSA signature length %d", PackageName, len(signature))
+	}
+
+	half := len(signature) / 2
+	return ssh.Marshal(struct {
+		R *big.Int
+		S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	}), nil
+}
+
+func newSignResponse(signature *ssh.Signature) []byte {
+	return agent.NewAgentMessage(agent.SSH_AGENT_SIGN_RESPONSE, agent.MarshalString(ssh.Marshal(signature)))
+}
@@ -0,0 +1,46 @@
+//go:build cgo
+
+package pkcs11Token
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// ClientPkcs11 answers agent queries with the keys of a PKCS#11 token instead of forwarding them
+func ClientPkcs11(config *Config, ctx *agent.AgentContext) error {
+	if config.Module == "" {
+		return fmt.Errorf("%s: no module, use --pkcs11-module", PackageName)
+	}
+
+	log.Infof("%s: using keys of module %s", PackageName, config.Module)
+
+	t, err := openToken(config)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	for message := range ctx.QueryChannel {
+		reply, err := t.handle(message.Data)
+		if err != nil {
+			log.Errorf("%s: %s failed: %v", PackageName, agent.MessageTypeName(agent.MessageType(message.Data)), err)
+		}
+
+		// A missing token makes the upstream agent unreachable, other errors are failures of a single query
+		if errors.Is(err, ErrTokenNotFound) || isSessionLost(err) {
+			ctx.UpstreamResult(err)
+		} else {
+			ctx.UpstreamResult(nil)
+		}
+
+		message.ReplyChannel <- reply
+	}
+
+	log.Debugf("%s: stopped", PackageName)
+
+	return nil
+}
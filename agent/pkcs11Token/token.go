@@ -0,0 +1,562 @@
+//go:build cgo
+
+package pkcs11Token
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+// PKCS#11 3.0 values, missing from the headers of the pkcs11 package
+const (
+	CKK_EC_EDWARDS = 0x40
+	CKM_EDDSA      = 0x1057
+)
+
+var ErrTokenNotFound = errors.New("token not found")
+var ErrKeyNotFound = errors.New("key not on token")
+var ErrPinRejected = errors.New("PIN already rejected by the token")
+
+// tokenKey is a key pair of the token, identified by its CKA_ID
+type tokenKey struct {
+	id        []byte
+	label     string
+	keyType   uint
+	publicKey ssh.PublicKey
+	blob      []byte
+}
+
+type token struct {
+	config *Config
+	module *pkcs11.Ctx
+
+	// Session state, reset when the token is removed
+	opened        bool
+	loggedIn      bool
+	session       pkcs11.SessionHandle
+	label         string
+	protectedPath bool
+	pinLocked     bool
+
+	// Keyed hash of the last PIN rejected by the token, it is not sent again to not lock the token
+	pinKey      []byte
+	rejectedPin []byte
+
+	keys []*tokenKey
+}
+
+func openToken(config *Config) (*token, error) {
+	module := pkcs11.New(config.Module)
+	if module == nil {
+		return nil, fmt.Errorf("%s: can't load module %s", PackageName, config.Module)
+	}
+
+	if err := module.Initialize(); err != nil {
+		module.Destroy()
+		return nil, fmt.Errorf("%s: can't initialize module %s: %w", PackageName, config.Module, err)
+	}
+
+	pinKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(pinKey); err != nil {
+		module.Finalize()
+		module.Destroy()
+		return nil, fmt.Errorf("%s: %w", PackageName, err)
+	}
+
+	return &token{config: config, module: module, pinKey: pinKey}, nil
+}
+
+func (t *token) close() {
+	t.closeSession()
+	t.module.Finalize()
+	t.module.Destroy()
+}
+
+// findSlot returns the slot holding the configured token, slot ids can change when the token is inserted again
+func (t *token) findSlot() (uint, pkcs11.TokenInfo, error) {
+	slots, err := t.module.GetSlotList(true)
+	if err != nil {
+		return 0, pkcs11.TokenInfo{}, fmt.Errorf("%s: can't list slots: %w", PackageName, err)
+	}
+
+	for _, slot := range slots {
+		info, err := t.module.GetTokenInfo(slot)
+		if err != nil {
+			log.Debugf("%s: slot %d: %v", PackageName, slot, err)
+			continue
+		}
+		if t.config.Token == "" || info.Label == t.config.Token {
+			return slot, info, nil
+		}
+	}
+
+	if t.config.Token != "" {
+		return 0, pkcs11.TokenInfo{}, fmt.Errorf("%s: %s: %w", PackageName, t.config.Token, ErrTokenNotFound)
+	}
+	return 0, pkcs11.TokenInfo{}, fmt.Errorf("%s: %w", PackageName, ErrTokenNotFound)
+}
+
+func (t *token) openSession() error {
+	if t.opened {
+		return nil
+	}
+
+	slot, info, err := t.findSlot()
+	if err != nil {
+		return err
+	}
+
+	session, err := t.module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("%s: can't open session on token %s: %w", PackageName, info.Label, err)
+	}
+
+	log.Debugf("%s: opened session on token %s in slot %d", PackageName, info.Label, slot)
+
+	t.opened = true
+	t.loggedIn = false
+	t.session = session
+	t.label = info.Label
+	t.protectedPath = info.Flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH != 0
+	t.pinLocked = info.Flags&(pkcs11.CKF_USER_PIN_LOCKED|pkcs11.CKF_USER_PIN_TO_BE_CHANGED) != 0
+	if t.pinLocked {
+		log.Errorf("%s: PIN of token %s is locked or expired, unlock or change it with the tools of the token", PackageName, t.label)
+	}
+
+	return nil
+}
+
+func (t *token) closeSession() {
+	if !t.opened {
+		return
+	}
+
+	if t.loggedIn {
+		t.module.Logout(t.session)
+	}
+	t.module.CloseSession(t.session)
+	t.opened = false
+	t.loggedIn = false
+}
+
+// pin returns the PIN to login, empty when the token has its own PIN pad
+func (t *token) pin() (string, error) {
+	if t.protectedPath {
+		log.Infof("%s: enter the PIN of token %s on its PIN pad", PackageName, t.label)
+		return "", nil
+	}
+	if t.config.Pin == nil {
+		return "", fmt.Errorf("%s: no PIN source for token %s", PackageName, t.label)
+	}
+	return t.config.Pin(fmt.Sprintf("Enter PIN for token %s: ", t.label))
+}
+
+func (t *token) login() error {
+	if t.loggedIn {
+		return nil
+	}
+
+	if err := t.loginAs(pkcs11.CKU_USER); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return fmt.Errorf("%s: can't login to token %s: %w", PackageName, t.label, err)
+	}
+
+	t.loggedIn = true
+	return nil
+}
+
+// loginAs asks the PIN and logs in, without retrying a PIN already rejected as each failure brings the token closer to being locked
+func (t *token) loginAs(userType uint) error {
+	if t.pinLocked {
+		return fmt.Errorf("PIN locked or expired: %w", ErrPinRejected)
+	}
+
+	pin, err := t.pin()
+	if err != nil {
+		return err
+	}
+
+	// The PIN pad asks a new PIN each time
+	var hash []byte
+	if !t.protectedPath {
+		mac := hmac.New(sha256.New, t.pinKey)
+		mac.Write([]byte(pin))
+		hash = mac.Sum(nil)
+		if t.rejectedPin != nil && hmac.Equal(hash, t.rejectedPin) {
+			return fmt.Errorf("change the PIN source to try again: %w", ErrPinRejected)
+		}
+	}
+
+	err = t.module.Login(t.session, userType, pin)
+	var pkcs11Error pkcs11.Error
+	if errors.As(err, &pkcs11Error) {
+		switch pkcs11Error {
+		case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_INVALID, pkcs11.CKR_PIN_LEN_RANGE:
+			log.Errorf("%s: PIN rejected by token %s, it won't be sent again", PackageName, t.label)
+			t.rejectedPin = hash
+		case pkcs11.CKR_PIN_LOCKED, pkcs11.CKR_PIN_EXPIRED:
+			log.Errorf("%s: PIN of token %s is locked or expired, unlock or change it with the tools of the token", PackageName, t.label)
+			t.pinLocked = true
+		}
+	} else if err == nil {
+		t.rejectedPin = nil
+	}
+	return err
+}
+
+// isSessionLost returns true for errors fixed by opening a new session, mostly after the token was removed
+func isSessionLost(err error) bool {
+	var pkcs11Error pkcs11.Error
+	if !errors.As(err, &pkcs11Error) {
+		return false
+	}
+
+	switch pkcs11Error {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_TOKEN_NOT_RECOGNIZED,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_USER_NOT_LOGGED_IN:
+		return true
+	default:
+		return false
+	}
+}
+
+// do runs an operation in a session, it is run again in a new session if the previous one was lost
+func (t *token) do(operation func() error) error {
+	if err := t.openSession(); err != nil {
+		return err
+	}
+
+	err := operation()
+	if !isSessionLost(err) {
+		return err
+	}
+
+	log.Infof("%s: session on token %s lost, opening a new one: %v", PackageName, t.label, err)
+	t.closeSession()
+
+	if err := t.openSession(); err != nil {
+		return err
+	}
+	return operation()
+}
+
+func (t *token) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := t.module.FindObjectsInit(t.session, template); err != nil {
+		return nil, err
+	}
+	defer t.module.FindObjectsFinal(t.session)
+
+	var objects []pkcs11.ObjectHandle
+	for {
+		found, _, err := t.module.FindObjects(t.session, 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return objects, nil
+		}
+		objects = append(objects, found...)
+	}
+}
+
+func (t *token) attributes(object pkcs11.ObjectHandle, types ...uint) ([][]byte, error) {
+	template := make([]*pkcs11.Attribute, len(types))
+	for i, attributeType := range types {
+		template[i] = pkcs11.NewAttribute(attributeType, nil)
+	}
+
+	attributes, err := t.module.GetAttributeValue(t.session, object, template)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(types))
+	for i, attribute := range attributes {
+		values[i] = attribute.Value
+	}
+	return values, nil
+}
+
+func attributeUint(value []byte) uint {
+	var result uint
+	// Attributes are native endian CK_ULONG
+	for i := len(value) - 1; i >= 0; i-- {
+		result = result<<8 | uint(value[i])
+	}
+	return result
+}
+
+func (t *token) publicKey(object pkcs11.ObjectHandle) (*tokenKey, error) {
+	values, err := t.attributes(object, pkcs11.CKA_ID, pkcs11.CKA_LABEL, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	key := &tokenKey{id: values[0], label: string(values[1]), keyType: attributeUint(values[2])}
+
+	switch key.keyType {
+	case pkcs11.CKK_RSA:
+		values, err = t.attributes(object, pkcs11.CKA_MODULUS, pkcs11.CKA_PUBLIC_EXPONENT)
+		if err == nil {
+			key.publicKey, err = rsaPublicKey(values[0], values[1])
+		}
+	case pkcs11.CKK_EC:
+		values, err = t.attributes(object, pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT)
+		if err == nil {
+			key.publicKey, err = ecdsaPublicKey(values[0], values[1])
+		}
+	case CKK_EC_EDWARDS:
+		values, err = t.attributes(object, pkcs11.CKA_EC_POINT)
+		if err == nil {
+			key.publicKey, err = ed25519PublicKey(values[0])
+		}
+	default:
+		err = fmt.Errorf("%s: key type 0x%x: %w", PackageName, key.keyType, ErrUnsupportedKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key.blob = key.publicKey.Marshal()
+	return key, nil
+}
+
+// certificateKey returns the key of a X.509 certificate, used by tokens without public key objects like PIV cards
+func (t *token) certificateKey(object pkcs11.ObjectHandle) (*tokenKey, error) {
+	values, err := t.attributes(object, pkcs11.CKA_ID, pkcs11.CKA_LABEL, pkcs11.CKA_VALUE)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(values[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad certificate: %w", PackageName, err)
+	}
+
+	publicKey, err := ssh.NewPublicKey(certificate.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: certificate %s: %w", PackageName, certificate.Subject, err)
+	}
+
+	key := &tokenKey{id: values[0], label: string(values[1]), publicKey: publicKey, blob: publicKey.Marshal()}
+	switch publicKey.Type() {
+	case ssh.KeyAlgoRSA:
+		key.keyType = pkcs11.CKK_RSA
+	case ssh.KeyAlgoED25519:
+		key.keyType = CKK_EC_EDWARDS
+	default:
+		key.keyType = pkcs11.CKK_EC
+	}
+	return key, nil
+}
+
+func (t *token) listKeysInSession() ([]*tokenKey, error) {
+	var keys []*tokenKey
+	ids := map[string]bool{}
+
+	publicKeys, err := t.findObjects([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY)})
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range publicKeys {
+		key, err := t.publicKey(object)
+		if err != nil {
+			log.Debugf("%s: skipping public key object: %v", PackageName, err)
+			continue
+		}
+		keys = append(keys, key)
+		ids[string(key.id)] = true
+	}
+
+	certificates, err := t.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range certificates {
+		key, err := t.certificateKey(object)
+		if err != nil {
+			log.Debugf("%s: skipping certificate object: %v", PackageName, err)
+			continue
+		}
+		if ids[string(key.id)] {
+			continue
+		}
+		keys = append(keys, key)
+		ids[string(key.id)] = true
+	}
+
+	return keys, nil
+}
+
+// listKeys returns the keys of the token, a login is not needed for public objects
+func (t *token) listKeys() ([]*tokenKey, error) {
+	err := t.do(func() error {
+		keys, err := t.listKeysInSession()
+		if err == nil {
+			t.keys = keys
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't list keys: %w", PackageName, err)
+	}
+	return t.keys, nil
+}
+
+func (t *token) findKey(blob []byte) (*tokenKey, error) {
+	for _, key := range t.keys {
+		if bytes.Equal(key.blob, blob) {
+			return key, nil
+		}
+	}
+
+	// The client may sign without listing the keys first
+	keys, err := t.listKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if bytes.Equal(key.blob, blob) {
+			return key, nil
+		}
+	}
+
+	return nil, ErrKeyNotFound
+}
+
+// signInSession signs with the private key having the same CKA_ID as key
+func (t *token) signInSession(key *tokenKey, mechanism uint, input []byte) ([]byte, error) {
+	if err := t.login(); err != nil {
+		return nil, err
+	}
+
+	privateKeys, err := t.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, key.id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(privateKeys) == 0 {
+		return nil, fmt.Errorf("%s: no private key for %s: %w", PackageName, key.label, ErrKeyNotFound)
+	}
+
+	err = t.module.SignInit(t.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, privateKeys[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys like the PIV signature key need the PIN again for each signature
+	values, err := t.attributes(privateKeys[0], pkcs11.CKA_ALWAYS_AUTHENTICATE)
+	if err == nil && len(values[0]) > 0 && values[0][0] != 0 {
+		if err := t.loginAs(pkcs11.CKU_CONTEXT_SPECIFIC); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.module.Sign(t.session, input)
+}
+
+// sign returns the SSH signature of data
+func (t *token) sign(key *tokenKey, data []byte, flags uint32) (*ssh.Signature, error) {
+	var mechanism uint
+	var input []byte
+	format := key.publicKey.Type()
+
+	switch key.keyType {
+	case pkcs11.CKK_RSA:
+		hash, rsaFormat := rsaSignatureHash(flags)
+		mechanism = pkcs11.CKM_RSA_PKCS
+		input = rsaSignatureInput(hash, data)
+		format = rsaFormat
+	case pkcs11.CKK_EC:
+		hash, err := ecdsaSignatureHash(key.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		hasher := hash.New()
+		hasher.Write(data)
+		mechanism = pkcs11.CKM_ECDSA
+		input = hasher.Sum(nil)
+	case CKK_EC_EDWARDS:
+		mechanism = CKM_EDDSA
+		input = data
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	var blob []byte
+	err := t.do(func() error {
+		var err error
+		blob, err = t.signInSession(key, mechanism, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't sign with %s: %w", PackageName, key.label, err)
+	}
+
+	if key.keyType == pkcs11.CKK_EC {
+		blob, err = ecdsaSignatureBlob(blob)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ssh.Signature{Format: format, Blob: blob}, nil
+}
+
+// handle answers an agent query with the keys of the token
+func (t *token) handle(query []byte) (agent.AgentMessageReply, error) {
+	switch agent.MessageType(query) {
+	case agent.SSH_AGENTC_REQUEST_IDENTITIES:
+		keys, err := t.listKeys()
+		if err != nil {
+			return agent.AGENT_MESSAGE_ERROR_REPLY, err
+		}
+
+		identities := make([]agent.Identity, len(keys))
+		for i, key := range keys {
+			identities[i] = agent.Identity{KeyBlob: key.blob, Comment: []byte(key.label)}
+		}
+		return agent.AgentMessageReply{Data: agent.NewIdentitiesAnswer(identities)}, nil
+
+	case agent.SSH_AGENTC_SIGN_REQUEST:
+		blob, data, flags, err := agent.ParseSignRequest(query)
+		if err != nil {
+			return agent.AGENT_MESSAGE_ERROR_REPLY, err
+		}
+
+		key, err := t.findKey(blob)
+		if err != nil {
+			return agent.AGENT_MESSAGE_ERROR_REPLY, err
+		}
+
+		signature, err := t.sign(key, data, flags)
+		if err != nil {
+			return agent.AGENT_MESSAGE_ERROR_REPLY, err
+		}
+		return agent.AgentMessageReply{Data: newSignResponse(signature)}, nil
+
+	case agent.SSH_AGENTC_EXTENSION:
+		return agent.AGENT_MESSAGE_EXTENSION_FAILURE_REPLY, nil
+
+	default:
+		// Keys can't be added to or removed from the token through the agent protocol
+		return agent.AGENT_MESSAGE_ERROR_REPLY, nil
+	}
+}
@@ -0,0 +1,211 @@
+//go:build cgo
+
+package pkcs11Token
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	testTokenLabel = "ssh-agent-bridge"
+	testSoPin      = "87654321"
+	testUserPin    = "1234"
+)
+
+// Usual locations of SoftHSM, SOFTHSM2_MODULE overrides them
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+func findSoftHSM(t *testing.T) string {
+	t.Helper()
+
+	if module := os.Getenv("SOFTHSM2_MODULE"); module != "" {
+		return module
+	}
+	for _, module := range softHSMModules {
+		if _, err := os.Stat(module); err == nil {
+			return module
+		}
+	}
+	t.Skip("SoftHSM not found, set SOFTHSM2_MODULE to the path of libsofthsm2")
+	return ""
+}
+
+// newSoftHSMToken creates a SoftHSM token holding an ECDSA key in a temporary directory and returns its module
+func newSoftHSMToken(t *testing.T) string {
+	t.Helper()
+
+	module := findSoftHSM(t)
+
+	directory := t.TempDir()
+	tokens := filepath.Join(directory, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(directory, "softhsm2.conf")
+	if err := os.WriteFile(configFile, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", configFile)
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("can't load %s", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no slot: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], testSoPin, testTokenLabel); err != nil {
+		t.Fatal(err)
+	}
+
+	// SoftHSM moves the initialized token to a new slot
+	token := &token{config: &Config{Token: testTokenLabel}, module: ctx}
+	slot, _, err := token.findSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+
+	if err := ctx.Login(session, pkcs11.CKU_SO, testSoPin); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(session, testUserPin); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Logout(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, testUserPin); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(session)
+
+	// DER of the OID of P-256
+	p256 := []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	_, _, err = ctx.GenerateKeyPair(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, p256),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{1}),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "test key"),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{1}),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "test key"),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return module
+}
+
+// pinSource returns a PinPrompt giving *pin and counting its calls
+func pinSource(pin *string, calls *int) PinPrompt {
+	return func(prompt string) (string, error) {
+		*calls++
+		return *pin, nil
+	}
+}
+
+func TestSoftHSMSign(t *testing.T) {
+	module := newSoftHSMToken(t)
+
+	pin, calls := testUserPin, 0
+	token, err := openToken(&Config{Module: module, Token: testTokenLabel, Pin: pinSource(&pin, &calls)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.close()
+
+	keys, err := token.listKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].label != "test key" {
+		t.Fatalf("got keys %v, want the test key", keys)
+	}
+
+	data := []byte("data to sign")
+	for i := 0; i < 2; i++ {
+		signature, err := token.sign(keys[0], data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keys[0].publicKey.Verify(data, signature); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("PIN asked %d times, want once", calls)
+	}
+}
+
+func TestSoftHSMWrongPin(t *testing.T) {
+	module := newSoftHSMToken(t)
+
+	pin, calls := "0000", 0
+	token, err := openToken(&Config{Module: module, Token: testTokenLabel, Pin: pinSource(&pin, &calls)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.close()
+
+	keys, err := token.listKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("data to sign")
+
+	_, err = token.sign(keys[0], data, 0)
+	if !errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)) {
+		t.Fatalf("got %v, want CKR_PIN_INCORRECT", err)
+	}
+
+	// The same PIN must not reach the token again
+	for i := 0; i < 3; i++ {
+		_, err = token.sign(keys[0], data, 0)
+		if !errors.Is(err, ErrPinRejected) {
+			t.Fatalf("got %v, want %v", err, ErrPinRejected)
+		}
+	}
+
+	// A new PIN from the source is tried
+	pin = testUserPin
+	signature, err := token.sign(keys[0], data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys[0].publicKey.Verify(data, signature); err != nil {
+		t.Fatal(err)
+	}
+}
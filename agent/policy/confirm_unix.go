@@ -0,0 +1,10 @@
+//go:build !windows
+
+package policy
+
+import "github.com/amurzeau/ssh-agent-bridge/log"
+
+func confirm(prompt string) bool {
+	log.Errorf("%s: no confirmation prompt available, denying: %s", PackageName, prompt)
+	return false
+}
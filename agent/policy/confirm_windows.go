@@ -0,0 +1,28 @@
+package policy
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_MB_YESNO         = 0x04
+	_MB_ICONQUESTION  = 0x20
+	_MB_SYSTEMMODAL   = 0x1000
+	_MB_SETFOREGROUND = 0x10000
+	_IDYES            = 6
+)
+
+var messageBoxW = syscall.NewLazyDLL("user32.dll").NewProc("MessageBoxW")
+
+func confirm(prompt string) bool {
+	titleUnicode, _ := syscall.UTF16PtrFromString("ssh-agent-bridge")
+	promptUnicode, _ := syscall.UTF16PtrFromString(prompt)
+
+	result, _, _ := messageBoxW.Call(0,
+		uintptr(unsafe.Pointer(promptUnicode)),
+		uintptr(unsafe.Pointer(titleUnicode)),
+		_MB_YESNO|_MB_ICONQUESTION|_MB_SYSTEMMODAL|_MB_SETFOREGROUND)
+
+	return result == _IDYES
+}
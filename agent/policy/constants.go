@@ -0,0 +1,3 @@
+package policy
+
+const PackageName = "policy"
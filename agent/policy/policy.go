@@ -0,0 +1,204 @@
+package policy
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+type Action string
+
+const (
+	Allow   Action = "allow"
+	Deny    Action = "deny"
+	Confirm Action = "confirm"
+)
+
+// Config is the policy section of the configuration file
+type Config struct {
+	Default Action `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule matches a query when all of its non-empty fields match.
+// Each field matches if any of its values matches.
+type Rule struct {
+	Listeners   []string `json:"listeners"`
+	Uids        []string `json:"uids"`
+	Executables []string `json:"executables"`
+	Parents     []string `json:"parents"`
+	Messages    []string `json:"messages"`
+	Keys        []string `json:"keys"`
+	Action      Action   `json:"action"`
+}
+
+type Policy struct {
+	defaultAction Action
+	rules         []Rule
+	messageTypes  []map[byte]bool
+}
+
+// ConfirmFunction asks the user whether a query should be allowed
+var ConfirmFunction func(prompt string) bool = confirm
+
+func checkAction(action Action) error {
+	switch action {
+	case Allow, Deny, Confirm:
+		return nil
+	default:
+		return fmt.Errorf("%s: invalid action %q, must be one of allow, deny, confirm", PackageName, action)
+	}
+}
+
+func New(config Config) (*Policy, error) {
+	p := &Policy{
+		defaultAction: config.Default,
+		rules:         config.Rules,
+	}
+
+	if p.defaultAction == "" {
+		p.defaultAction = Allow
+	}
+	if err := checkAction(p.defaultAction); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range p.rules {
+		if err := checkAction(rule.Action); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", PackageName, i, err)
+		}
+
+		messageTypes := map[byte]bool{}
+		for _, name := range rule.Messages {
+			messageType, ok := agent.ParseMessageTypeName(name)
+			if !ok {
+				return nil, fmt.Errorf("%s: rule %d: unknown message type %q", PackageName, i, name)
+			}
+			messageTypes[messageType] = true
+		}
+		p.messageTypes = append(p.messageTypes, messageTypes)
+	}
+
+	return p, nil
+}
+
+func matchString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern string, name string) bool {
+	if runtime.GOOS == "windows" {
+		pattern = strings.ToLower(pattern)
+		name = strings.ToLower(name)
+	}
+
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// matchExecutable matches full paths if the pattern contains a path separator, else only the executable name
+func matchExecutable(patterns []string, executable string) bool {
+	if executable == "" {
+		return false
+	}
+
+	name := filepath.Base(executable)
+
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, `/\`) {
+			if matchPattern(pattern, executable) {
+				return true
+			}
+		} else if matchPattern(pattern, name) || matchPattern(pattern, strings.TrimSuffix(name, ".exe")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) match(index int, conn *agent.Connection, messageType byte, fingerprint string) bool {
+	rule := &p.rules[index]
+
+	if len(rule.Listeners) > 0 && !matchString(rule.Listeners, conn.Listener) {
+		return false
+	}
+	if len(rule.Uids) > 0 && !matchString(rule.Uids, conn.Peer.Uid) {
+		return false
+	}
+	if len(rule.Executables) > 0 && !matchExecutable(rule.Executables, conn.Peer.Executable) {
+		return false
+	}
+	if len(rule.Parents) > 0 && !matchExecutable(rule.Parents, conn.Peer.ParentExecutable) {
+		return false
+	}
+	if len(rule.Messages) > 0 && !p.messageTypes[index][messageType] {
+		return false
+	}
+	if len(rule.Keys) > 0 && (fingerprint == "" || !matchString(rule.Keys, fingerprint)) {
+		return false
+	}
+
+	return true
+}
+
+// Evaluate returns the action of the first rule matching the query, or the default action
+func (p *Policy) Evaluate(conn *agent.Connection, query []byte) (Action, error) {
+	messageType := agent.MessageType(query)
+
+	var fingerprint string
+	keyBlob, err := agent.RequestKeyBlob(query)
+	if err != nil {
+		return Deny, err
+	} else if keyBlob != nil {
+		fingerprint = agent.KeyFingerprint(keyBlob)
+	}
+
+	for i := range p.rules {
+		if p.match(i, conn, messageType, fingerprint) {
+			return p.rules[i].Action, nil
+		}
+	}
+
+	return p.defaultAction, nil
+}
+
+func (p *Policy) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		messageName := agent.MessageTypeName(agent.MessageType(query))
+
+		action, err := p.Evaluate(conn, query)
+		if err != nil {
+			log.Errorf("%s: denied %s from %s: %v", PackageName, messageName, conn, err)
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+
+		if action == Confirm {
+			prompt := fmt.Sprintf("Allow %s from %s ?", messageName, conn)
+			if keyBlob, _ := agent.RequestKeyBlob(query); keyBlob != nil {
+				prompt += fmt.Sprintf("\nKey: %s", agent.KeyFingerprint(keyBlob))
+			}
+
+			if ConfirmFunction(prompt) {
+				action = Allow
+			} else {
+				action = Deny
+			}
+		}
+
+		if action != Allow {
+			log.Infof("%s: denied %s from %s", PackageName, messageName, conn)
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+
+		return next(conn, query)
+	}
+}
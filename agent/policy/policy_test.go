@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func signRequest(keyBlob []byte) []byte {
+	return agent.NewAgentMessage(agent.SSH_AGENTC_SIGN_REQUEST, agent.MarshalString(keyBlob), agent.MarshalString([]byte("data")), []byte{0, 0, 0, 0})
+}
+
+func TestEvaluateCertificate(t *testing.T) {
+	key := newTestSigner(t)
+	other := newTestSigner(t)
+	ca := newTestSigner(t)
+
+	certificate := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"me"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := certificate.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(Config{
+		Default: Allow,
+		Rules: []Rule{
+			{Keys: []string{agent.Fingerprint(key.PublicKey().Marshal())}, Listeners: []string{"pipe"}, Action: Allow},
+			{Keys: []string{agent.Fingerprint(key.PublicKey().Marshal())}, Action: Deny},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		listener string
+		keyBlob  []byte
+		want     Action
+	}{
+		{"key", "wsl", key.PublicKey().Marshal(), Deny},
+		{"certificate", "wsl", certificate.Marshal(), Deny},
+		{"certificate on an allowed listener", "pipe", certificate.Marshal(), Allow},
+		{"other key", "wsl", other.PublicKey().Marshal(), Allow},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action, err := p.Evaluate(agent.NewConnection(test.listener, agent.PeerInfo{}), signRequest(test.keyBlob))
+			if err != nil || action != test.want {
+				t.Errorf("Evaluate() = %v, %v, want %v", action, err, test.want)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := New(Config{
+		Default: Deny,
+		Rules: []Rule{
+			{Executables: []string{"ssh"}, Messages: []string{"sign-request"}, Action: Confirm},
+			{Messages: []string{"request-identities"}, Action: Allow},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssh := agent.NewConnection("pipe", agent.PeerInfo{Executable: "/usr/bin/ssh"})
+	git := agent.NewConnection("pipe", agent.PeerInfo{Executable: "/usr/bin/git"})
+	key := newTestSigner(t).PublicKey().Marshal()
+
+	tests := []struct {
+		name  string
+		conn  *agent.Connection
+		query []byte
+		want  Action
+	}{
+		{"ssh signature", ssh, signRequest(key), Confirm},
+		{"other executable signature", git, signRequest(key), Deny},
+		{"identities", git, agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES), Allow},
+		{"default", ssh, agent.NewAgentMessage(agent.SSH_AGENTC_REMOVE_ALL_IDENTITIES), Deny},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action, err := p.Evaluate(test.conn, test.query)
+			if err != nil || action != test.want {
+				t.Errorf("Evaluate() = %v, %v, want %v", action, err, test.want)
+			}
+		})
+	}
+}
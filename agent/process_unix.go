@@ -0,0 +1,45 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+func lookupProcess(peer *PeerInfo) {
+	procPath := fmt.Sprintf("/proc/%d", peer.Pid)
+
+	executable, err := os.Readlink(procPath + "/exe")
+	if err != nil {
+		log.Debugf("agent: can't get executable of process %d: %v", peer.Pid, err)
+	} else {
+		peer.Executable = executable
+	}
+
+	status, err := os.ReadFile(procPath + "/status")
+	if err != nil {
+		log.Debugf("agent: can't get status of process %d: %v", peer.Pid, err)
+		return
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "PPid:":
+			peer.ParentPid, _ = strconv.Atoi(fields[1])
+		case "Uid:":
+			if peer.Uid == "" {
+				peer.Uid = fields[1]
+			}
+		}
+	}
+}
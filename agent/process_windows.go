@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+const _PROCESS_QUERY_LIMITED_INFORMATION = 0x1000
+
+var winQueryFullProcessImageName = syscall.NewLazyDLL("kernel32.dll").NewProc("QueryFullProcessImageNameW")
+
+func lookupProcess(peer *PeerInfo) {
+	process, err := syscall.OpenProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(peer.Pid))
+	if err != nil {
+		log.Debugf("agent: can't open process %d: %v", peer.Pid, err)
+	} else {
+		defer syscall.CloseHandle(process)
+
+		name := make([]uint16, syscall.MAX_LONG_PATH)
+		nameSize := uint32(len(name))
+		result, _, err := winQueryFullProcessImageName.Call(
+			uintptr(process),
+			0,
+			uintptr(unsafe.Pointer(&name[0])),
+			uintptr(unsafe.Pointer(&nameSize)))
+		if result != 0 {
+			peer.Executable = syscall.UTF16ToString(name[:nameSize])
+		} else {
+			log.Debugf("agent: can't get executable of process %d: %v", peer.Pid, err)
+		}
+
+		var token syscall.Token
+		if peer.Uid == "" && syscall.OpenProcessToken(process, syscall.TOKEN_QUERY, &token) == nil {
+			if tokenUser, err := token.GetTokenUser(); err == nil {
+				peer.Uid, _ = tokenUser.User.Sid.String()
+			}
+			token.Close()
+		}
+	}
+
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		log.Debugf("agent: can't list processes: %v", err)
+		return
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	var entry syscall.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	for err = syscall.Process32First(snapshot, &entry); err == nil; err = syscall.Process32Next(snapshot, &entry) {
+		if int(entry.ProcessID) == peer.Pid {
+			peer.ParentPid = int(entry.ParentProcessID)
+			break
+		}
+	}
+}
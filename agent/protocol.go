@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Message numbers from draft-miller-ssh-agent
+const (
+	SSH_AGENT_FAILURE                        = 5
+	SSH_AGENT_SUCCESS                        = 6
+	SSH_AGENTC_REQUEST_IDENTITIES            = 11
+	SSH_AGENT_IDENTITIES_ANSWER              = 12
+	SSH_AGENTC_SIGN_REQUEST                  = 13
+	SSH_AGENT_SIGN_RESPONSE                  = 14
+	SSH_AGENTC_ADD_IDENTITY                  = 17
+	SSH_AGENTC_REMOVE_IDENTITY               = 18
+	SSH_AGENTC_REMOVE_ALL_IDENTITIES         = 19
+	SSH_AGENTC_ADD_SMARTCARD_KEY             = 20
+	SSH_AGENTC_REMOVE_SMARTCARD_KEY          = 21
+	SSH_AGENTC_LOCK                          = 22
+	SSH_AGENTC_UNLOCK                        = 23
+	SSH_AGENTC_ADD_ID_CONSTRAINED            = 25
+	SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED = 26
+	SSH_AGENTC_EXTENSION                     = 27
+	SSH_AGENT_EXTENSION_FAILURE              = 28
+)
+
+// Key constraints of SSH_AGENTC_ADD_ID_CONSTRAINED
+const (
+	SSH_AGENT_CONSTRAIN_LIFETIME  = 1
+	SSH_AGENT_CONSTRAIN_CONFIRM   = 2
+	SSH_AGENT_CONSTRAIN_MAXSIGN   = 3
+	SSH_AGENT_CONSTRAIN_EXTENSION = 255
+)
+
+var ErrMalformedMessage = errors.New("malformed agent message")
+
+var messageTypeNames = map[byte]string{
+	SSH_AGENTC_REQUEST_IDENTITIES:            "request-identities",
+	SSH_AGENTC_SIGN_REQUEST:                  "sign-request",
+	SSH_AGENTC_ADD_IDENTITY:                  "add-identity",
+	SSH_AGENTC_REMOVE_IDENTITY:               "remove-identity",
+	SSH_AGENTC_REMOVE_ALL_IDENTITIES:         "remove-all-identities",
+	SSH_AGENTC_ADD_SMARTCARD_KEY:             "add-smartcard-key",
+	SSH_AGENTC_REMOVE_SMARTCARD_KEY:          "remove-smartcard-key",
+	SSH_AGENTC_LOCK:                          "lock",
+	SSH_AGENTC_UNLOCK:                        "unlock",
+	SSH_AGENTC_ADD_ID_CONSTRAINED:            "add-id-constrained",
+	SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED: "add-smartcard-key-constrained",
+	SSH_AGENTC_EXTENSION:                     "extension",
+}
+
+// MessageTypeName returns the name used in configuration files for a request message type
+func MessageTypeName(messageType byte) string {
+	if name, ok := messageTypeNames[messageType]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseMessageTypeName is the inverse of MessageTypeName
+func ParseMessageTypeName(name string) (byte, bool) {
+	for messageType, typeName := range messageTypeNames {
+		if typeName == name {
+			return messageType, true
+		}
+	}
+	return 0, false
+}
+
+// MessageType returns the type of a length prefixed agent message, or 0 if the message is empty
+func MessageType(message []byte) byte {
+	if len(message) < 5 {
+		return 0
+	}
+	return message[4]
+}
+
+// MessagePayload returns the content of a length prefixed agent message after the type byte
+func MessagePayload(message []byte) []byte {
+	if len(message) < 5 {
+		return nil
+	}
+	return message[5:]
+}
+
+// NewAgentMessage builds a length prefixed agent message from its type and payload parts
+func NewAgentMessage(messageType byte, payload ...[]byte) []byte {
+	size := 1
+	for _, part := range payload {
+		size += len(part)
+	}
+
+	message := make([]byte, 4, size+4)
+	binary.BigEndian.PutUint32(message, uint32(size))
+	message = append(message, messageType)
+	for _, part := range payload {
+		message = append(message, part...)
+	}
+
+	return message
+}
+
+// ReadString parses a SSH string (uint32 length followed by data)
+func ReadString(buf []byte) (value []byte, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, ErrMalformedMessage
+	}
+
+	length := binary.BigEndian.Uint32(buf)
+	if uint64(length) > uint64(len(buf)-4) {
+		return nil, nil, ErrMalformedMessage
+	}
+
+	return buf[4 : 4+length], buf[4+length:], nil
+}
+
+// MarshalString encodes a SSH string
+func MarshalString(value []byte) []byte {
+	buf := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// RequestKeyBlob returns the public key blob targeted by a SIGN_REQUEST or REMOVE_IDENTITY message
+func RequestKeyBlob(message []byte) ([]byte, error) {
+	switch MessageType(message) {
+	case SSH_AGENTC_SIGN_REQUEST, SSH_AGENTC_REMOVE_IDENTITY:
+		keyBlob, _, err := ReadString(MessagePayload(message))
+		return keyBlob, err
+	default:
+		return nil, nil
+	}
+}
+
+// ParseSignRequest returns the key blob, data to sign and flags of a SSH_AGENTC_SIGN_REQUEST message
+func ParseSignRequest(message []byte) (keyBlob []byte, data []byte, flags uint32, err error) {
+	if MessageType(message) != SSH_AGENTC_SIGN_REQUEST {
+		return nil, nil, 0, ErrMalformedMessage
+	}
+
+	keyBlob, rest, err := ReadString(MessagePayload(message))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	data, rest, err = ReadString(rest)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if len(rest) < 4 {
+		return nil, nil, 0, ErrMalformedMessage
+	}
+
+	return keyBlob, data, binary.BigEndian.Uint32(rest), nil
+}
+
+// ExtensionName returns the extension type of a SSH_AGENTC_EXTENSION message
+func ExtensionName(message []byte) (string, error) {
+	name, _, err := ParseExtension(message)
+	return name, err
+}
+
+// ParseExtension returns the extension type and contents of a SSH_AGENTC_EXTENSION message
+func ParseExtension(message []byte) (name string, contents []byte, err error) {
+	if MessageType(message) != SSH_AGENTC_EXTENSION {
+		return "", nil, ErrMalformedMessage
+	}
+
+	nameBytes, contents, err := ReadString(MessagePayload(message))
+	return string(nameBytes), contents, err
+}
+
+// Identity is a key listed in a SSH_AGENT_IDENTITIES_ANSWER message
+type Identity struct {
+	KeyBlob []byte
+	Comment []byte
+}
+
+// ParseIdentitiesAnswer returns the identities listed in a SSH_AGENT_IDENTITIES_ANSWER message
+func ParseIdentitiesAnswer(message []byte) ([]Identity, error) {
+	payload := MessagePayload(message)
+	if MessageType(message) != SSH_AGENT_IDENTITIES_ANSWER || len(payload) < 4 {
+		return nil, ErrMalformedMessage
+	}
+
+	count := binary.BigEndian.Uint32(payload)
+	rest := payload[4:]
+
+	// Each identity takes at least 8 bytes, don't trust count for the allocation
+	if uint64(count) > uint64(len(rest)/8) {
+		return nil, ErrMalformedMessage
+	}
+
+	identities := make([]Identity, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var identity Identity
+		var err error
+
+		if identity.KeyBlob, rest, err = ReadString(rest); err != nil {
+			return nil, err
+		}
+		if identity.Comment, rest, err = ReadString(rest); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// NewIdentitiesAnswer builds a SSH_AGENT_IDENTITIES_ANSWER message
+func NewIdentitiesAnswer(identities []Identity) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(len(identities)))
+
+	for _, identity := range identities {
+		payload = append(payload, MarshalString(identity.KeyBlob)...)
+		payload = append(payload, MarshalString(identity.Comment)...)
+	}
+
+	return NewAgentMessage(SSH_AGENT_IDENTITIES_ANSWER, payload)
+}
+
+// Fingerprint returns the OpenSSH SHA256 fingerprint of a public key blob
+func Fingerprint(keyBlob []byte) string {
+	hash := sha256.Sum256(keyBlob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// CertifiedKey returns the blob of the key certified by a certificate, or nil if keyBlob is not a certificate
+func CertifiedKey(keyBlob []byte) []byte {
+	if key, err := ssh.ParsePublicKey(keyBlob); err == nil {
+		if certificate, ok := key.(*ssh.Certificate); ok {
+			return certificate.Key.Marshal()
+		}
+	}
+	return nil
+}
+
+// KeyFingerprint returns the fingerprint of the key certified by a certificate, or of the key itself,
+// so that rules on a key apply to its certificates too
+func KeyFingerprint(keyBlob []byte) string {
+	if certifiedKey := CertifiedKey(keyBlob); certifiedKey != nil {
+		return Fingerprint(certifiedKey)
+	}
+	return Fingerprint(keyBlob)
+}
@@ -0,0 +1,3 @@
+package readOnly
+
+const PackageName = "read-only"
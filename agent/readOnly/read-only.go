@@ -0,0 +1,62 @@
+package readOnly
+
+import (
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// DefaultSafeExtensions are the extensions allowed on read-only listeners when none are configured
+var DefaultSafeExtensions = []string{
+	"query",
+	"session-bind@openssh.com",
+}
+
+// Filter rejects key management queries on read-only listeners without forwarding them upstream
+type Filter struct {
+	// safe extensions by listener name, only read-only listeners are present
+	listeners map[string]map[string]bool
+}
+
+func New() *Filter {
+	return &Filter{
+		listeners: map[string]map[string]bool{},
+	}
+}
+
+// AddListener makes a listener read-only, safeExtensions defaults to DefaultSafeExtensions if nil
+func (f *Filter) AddListener(listener string, safeExtensions []string) {
+	if safeExtensions == nil {
+		safeExtensions = DefaultSafeExtensions
+	}
+
+	extensions := map[string]bool{}
+	for _, extension := range safeExtensions {
+		extensions[extension] = true
+	}
+
+	f.listeners[listener] = extensions
+}
+
+func (f *Filter) isAllowed(safeExtensions map[string]bool, query []byte) bool {
+	switch agent.MessageType(query) {
+	case agent.SSH_AGENTC_REQUEST_IDENTITIES, agent.SSH_AGENTC_SIGN_REQUEST:
+		return true
+	case agent.SSH_AGENTC_EXTENSION:
+		extension, err := agent.ExtensionName(query)
+		return err == nil && safeExtensions[extension]
+	default:
+		return false
+	}
+}
+
+func (f *Filter) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		safeExtensions, readOnly := f.listeners[conn.Listener]
+		if readOnly && !f.isAllowed(safeExtensions, query) {
+			log.Infof("%s: rejected %s from %s", PackageName, agent.MessageTypeName(agent.MessageType(query)), conn)
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+
+		return next(conn, query)
+	}
+}
@@ -0,0 +1,64 @@
+package readOnly
+
+import (
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+func extensionQuery(name string) []byte {
+	return agent.NewAgentMessage(agent.SSH_AGENTC_EXTENSION, agent.MarshalString([]byte(name)))
+}
+
+func TestFilter(t *testing.T) {
+	f := New()
+	f.AddListener("read-only", nil)
+	f.AddListener("custom", []string{"custom@example.com"})
+
+	var forwarded bool
+	handler := f.Middleware(func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		forwarded = true
+		return agent.AGENT_MESSAGE_SUCCESS_REPLY
+	})
+
+	tests := []struct {
+		name     string
+		listener string
+		query    []byte
+		allowed  bool
+	}{
+		{"list", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES), true},
+		{"sign", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_SIGN_REQUEST), true},
+		{"query extension", "read-only", extensionQuery("query"), true},
+		{"session-bind extension", "read-only", extensionQuery("session-bind@openssh.com"), true},
+		{"add", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_ADD_IDENTITY), false},
+		{"add constrained", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_ADD_ID_CONSTRAINED), false},
+		{"add smartcard", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_ADD_SMARTCARD_KEY), false},
+		{"remove", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_REMOVE_IDENTITY), false},
+		{"remove all", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_REMOVE_ALL_IDENTITIES), false},
+		{"remove smartcard", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_REMOVE_SMARTCARD_KEY), false},
+		{"lock", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_LOCK), false},
+		{"unlock", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_UNLOCK), false},
+		{"unlisted extension", "read-only", extensionQuery("other@example.com"), false},
+		{"malformed extension", "read-only", agent.NewAgentMessage(agent.SSH_AGENTC_EXTENSION), false},
+		{"unknown message", "read-only", agent.NewAgentMessage(200), false},
+		{"configured extension", "custom", extensionQuery("custom@example.com"), true},
+		{"default extension not configured", "custom", extensionQuery("query"), false},
+		{"add on a writable listener", "pipe", agent.NewAgentMessage(agent.SSH_AGENTC_ADD_IDENTITY), true},
+		{"lock on a writable listener", "pipe", agent.NewAgentMessage(agent.SSH_AGENTC_LOCK), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwarded = false
+			reply := handler(agent.NewConnection(test.listener, agent.PeerInfo{}), test.query)
+
+			if forwarded != test.allowed {
+				t.Errorf("forwarded = %v, want %v", forwarded, test.allowed)
+			}
+			if !test.allowed && agent.MessageType(reply.Data) != agent.SSH_AGENT_FAILURE {
+				t.Errorf("refused with %x, want a failure", reply.Data)
+			}
+		})
+	}
+}
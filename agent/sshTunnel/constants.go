@@ -0,0 +1,6 @@
+package sshTunnel
+
+const (
+	PackageName  = "ssh-tunnel"
+	EndpointName = "ssh"
+)
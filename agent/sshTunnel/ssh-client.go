@@ -0,0 +1,238 @@
+package sshTunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const connectTimeout = 10 * time.Second
+
+// REMOTE_AUTH_SOCK_COMMAND prints SSH_AUTH_SOCK as set by the profile of the remote user
+const REMOTE_AUTH_SOCK_COMMAND = `exec "${SHELL:-/bin/sh}" -l -c 'printenv SSH_AUTH_SOCK'`
+
+// Config describes the remote host running the upstream agent
+type Config struct {
+	// Destination is [user@]host[:port]
+	Destination    string
+	IdentityFiles  []string
+	KnownHostsFile string
+	// RemoteSocket is the path of the agent socket on the remote host, reached with a stream-local forward.
+	// When empty, SSH_AUTH_SOCK of a remote login shell is used.
+	RemoteSocket string
+}
+
+type tunnel struct {
+	config       *Config
+	address      string
+	clientConfig *ssh.ClientConfig
+
+	lock         sync.Mutex
+	client       *ssh.Client
+	remoteSocket string
+}
+
+func parseDestination(destination string) (user string, address string) {
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		user = destination[:i]
+		destination = destination[i+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(destination); err != nil {
+		destination = net.JoinHostPort(destination, "22")
+	}
+
+	return user, destination
+}
+
+func loadSigners(identityFiles []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+
+	for _, identityFile := range identityFiles {
+		keyData, err := os.ReadFile(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't read identity %s: %w", PackageName, identityFile, err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(keyData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't parse identity %s: %w", PackageName, identityFile, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+func newTunnel(config *Config) (*tunnel, error) {
+	user, address := parseDestination(config.Destination)
+	if user == "" {
+		if currentUser := os.Getenv("USER"); currentUser != "" {
+			user = currentUser
+		} else {
+			user = os.Getenv("USERNAME")
+		}
+	}
+
+	signers, err := loadSigners(config.IdentityFiles)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("%s: no identity file given to authenticate to %s", PackageName, config.Destination)
+	}
+
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't find known_hosts: %w", PackageName, err)
+		}
+		knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't load known hosts %s: %w", PackageName, knownHostsFile, err)
+	}
+
+	return &tunnel{
+		config:  config,
+		address: address,
+		clientConfig: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         connectTimeout,
+		},
+	}, nil
+}
+
+// getRemoteAuthSock reads SSH_AUTH_SOCK in the environment of the remote user.
+// Commands run by sshd don't read the shell profile where agents are usually started, so a login shell is used.
+// Agent forwarding is not requested, SSH_AUTH_SOCK would be the forwarded agent instead of the remote one.
+func getRemoteAuthSock(client *ssh.Client) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	output, err := session.Output(REMOTE_AUTH_SOCK_COMMAND)
+	if err != nil {
+		return "", fmt.Errorf("can't get remote SSH_AUTH_SOCK: %w", err)
+	}
+
+	socketPath := strings.TrimSpace(string(output))
+	if socketPath == "" {
+		return "", errors.New("SSH_AUTH_SOCK is not set on the remote host, use --ssh-agent-socket")
+	}
+
+	return socketPath, nil
+}
+
+// connect returns the SSH connection, creating it if needed
+func (t *tunnel) connect() (*ssh.Client, string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.client != nil {
+		return t.client, t.remoteSocket, nil
+	}
+
+	log.Debugf("%s: connecting to %s", PackageName, t.address)
+	client, err := ssh.Dial("tcp", t.address, t.clientConfig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	remoteSocket := t.config.RemoteSocket
+	if remoteSocket == "" {
+		remoteSocket, err = getRemoteAuthSock(client)
+		if err != nil {
+			client.Close()
+			return nil, "", err
+		}
+		log.Debugf("%s: using remote agent at %s", PackageName, remoteSocket)
+	}
+
+	t.client = client
+	t.remoteSocket = remoteSocket
+
+	return client, remoteSocket, nil
+}
+
+// reset closes a broken SSH connection so the next dial reconnects
+func (t *tunnel) reset(client *ssh.Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.client == client {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+func (t *tunnel) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+// dial opens a stream to the remote agent, reconnecting once if the SSH connection is broken
+func (t *tunnel) dial() (net.Conn, error) {
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var client *ssh.Client
+		var remoteSocket string
+
+		client, remoteSocket, err = t.connect()
+		if err != nil {
+			continue
+		}
+
+		var conn net.Conn
+		// direct-streamlocal@openssh.com forward to the remote socket
+		conn, err = client.Dial("unix", remoteSocket)
+		if err == nil {
+			return conn, nil
+		}
+
+		log.Debugf("%s: can't open agent stream, reconnecting: %v", PackageName, err)
+		t.reset(client)
+	}
+
+	return nil, fmt.Errorf("%s: can't connect to agent on %s: %w", PackageName, t.config.Destination, err)
+}
+
+func ClientSshTunnel(config *Config, ctx *agent.AgentContext) error {
+	if config.Destination == "" {
+		return fmt.Errorf("%s: empty destination, use --ssh-destination", PackageName)
+	}
+
+	log.Infof("%s: forwarding to agent on %s", PackageName, config.Destination)
+
+	t, err := newTunnel(config)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	return common.GenericNetClient(PackageName, t.dial, ctx)
+}
@@ -0,0 +1,299 @@
+package sshTunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+	"golang.org/x/crypto/ssh"
+	xagent "golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testSocket = "/tmp/ssh-test/agent.sock"
+
+// testServer is an in-process sshd serving an agent on testSocket with direct-streamlocal@openssh.com
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+	keyring  xagent.Agent
+	// authSock is printed by the exec request reading SSH_AUTH_SOCK
+	authSock string
+
+	lock     sync.Mutex
+	conns    []*ssh.ServerConn
+	commands []string
+}
+
+func newSigner(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func newTestServer(t *testing.T, clientKey ssh.PublicKey) *testServer {
+	t.Helper()
+
+	hostKey, _ := newSigner(t)
+	s := &testServer{
+		t:        t,
+		hostKey:  hostKey,
+		keyring:  agentTest.NewKeyring(t, "remote-key"),
+		authSock: testSocket,
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "me" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	s.config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = listener
+	t.Cleanup(s.close)
+
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testServer) handleConn(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.lock.Unlock()
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			go s.handleSession(newChannel)
+		case "direct-streamlocal@openssh.com":
+			go s.handleStreamLocal(newChannel)
+		default:
+			// Like sshd, auth-agent@openssh.com is only opened by the server
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func (s *testServer) handleSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(request.Payload, &exec); err != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		s.lock.Lock()
+		s.commands = append(s.commands, exec.Command)
+		s.lock.Unlock()
+
+		request.Reply(true, nil)
+		if exec.Command == REMOTE_AUTH_SOCK_COMMAND && s.authSock != "" {
+			channel.Write([]byte(s.authSock + "\n"))
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+func (s *testServer) handleStreamLocal(newChannel ssh.NewChannel) {
+	var payload struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil || payload.SocketPath != testSocket {
+		newChannel.Reject(ssh.ConnectionFailed, "no such socket")
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+
+	xagent.ServeAgent(s.keyring, channel)
+}
+
+// dropConnections closes the SSH connections like a network failure would
+func (s *testServer) dropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) execCommands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+func (s *testServer) close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+// newTestConfig returns a configuration to connect to a new test server as user me
+func newTestConfig(t *testing.T) (*Config, *testServer) {
+	t.Helper()
+
+	clientKey, clientKeyPem := newSigner(t)
+	server := newTestServer(t, clientKey.PublicKey())
+	address := server.listener.Addr().String()
+
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "id_ecdsa")
+	if err := os.WriteFile(identityFile, clientKeyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	knownHosts := knownhosts.Line([]string{knownhosts.Normalize(address)}, server.hostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHostsFile, []byte(knownHosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Config{
+		Destination:    "me@" + address,
+		IdentityFiles:  []string{identityFile},
+		KnownHostsFile: knownHostsFile,
+	}, server
+}
+
+// forward returns a context forwarding queries with ClientSshTunnel
+func forward(t *testing.T, config *Config) *agent.AgentContext {
+	t.Helper()
+
+	ctx := agent.CreateAgent()
+	ctx.Go(func() {
+		if err := ClientSshTunnel(config, &ctx); err != nil {
+			t.Errorf("client: %v", err)
+		}
+	})
+	t.Cleanup(func() { agentTest.Stop(&ctx) })
+
+	return &ctx
+}
+
+func TestRemoteAuthSock(t *testing.T) {
+	config, server := newTestConfig(t)
+	agentTest.CheckSign(t, agentTest.Client(forward(t, config), "test"))
+
+	commands := server.execCommands()
+	if len(commands) != 1 || commands[0] != REMOTE_AUTH_SOCK_COMMAND {
+		t.Errorf("remote commands = %q, want the login shell reading SSH_AUTH_SOCK", commands)
+	}
+}
+
+func TestExplicitSocket(t *testing.T) {
+	config, server := newTestConfig(t)
+	config.RemoteSocket = testSocket
+	server.authSock = ""
+
+	agentTest.CheckSign(t, agentTest.Client(forward(t, config), "test"))
+
+	if commands := server.execCommands(); len(commands) != 0 {
+		t.Errorf("remote commands = %q, want none with an explicit socket", commands)
+	}
+}
+
+func TestNoRemoteAuthSock(t *testing.T) {
+	config, server := newTestConfig(t)
+	server.authSock = ""
+
+	if _, err := agentTest.Client(forward(t, config), "test").List(); err == nil {
+		t.Error("list worked without remote agent socket")
+	}
+}
+
+func TestWrongSocket(t *testing.T) {
+	config, _ := newTestConfig(t)
+	config.RemoteSocket = "/tmp/other.sock"
+
+	if _, err := agentTest.Client(forward(t, config), "test").List(); err == nil {
+		t.Error("list worked with a wrong remote socket")
+	}
+}
+
+func TestUnknownHostKey(t *testing.T) {
+	config, _ := newTestConfig(t)
+	other, _ := newSigner(t)
+	address := config.Destination[len("me@"):]
+	knownHosts := knownhosts.Line([]string{knownhosts.Normalize(address)}, other.PublicKey()) + "\n"
+	if err := os.WriteFile(config.KnownHostsFile, []byte(knownHosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := agentTest.Client(forward(t, config), "test").List(); err == nil {
+		t.Error("list worked with an unknown host key")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	config, server := newTestConfig(t)
+	client := agentTest.Client(forward(t, config), "test")
+
+	agentTest.CheckSign(t, client)
+	server.dropConnections()
+	agentTest.CheckSign(t, client)
+}
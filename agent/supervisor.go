@@ -0,0 +1,338 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// Default delays between restarts of a failed listener, doubled after each failure
+const (
+	LISTENER_RESTART_MIN_DELAY = 1 * time.Second
+	LISTENER_RESTART_MAX_DELAY = 60 * time.Second
+)
+
+type ListenerState int
+
+const (
+	ListenerStarting ListenerState = iota
+	ListenerRunning
+	ListenerFailed
+	ListenerStopped
+)
+
+func (s ListenerState) String() string {
+	switch s {
+	case ListenerStarting:
+		return "starting"
+	case ListenerRunning:
+		return "running"
+	case ListenerFailed:
+		return "failed"
+	case ListenerStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(s))
+	}
+}
+
+// ListenerStatus is the state of a supervised listener
+type ListenerStatus struct {
+	Name  string
+	State ListenerState
+	// Err is the error of the last failure
+	Err error
+	// Restarts counts restarts after failures
+	Restarts int
+	// GaveUp is true when the listener failed ListenerRestartMaxAttempts times in a row and isn't restarted anymore
+	GaveUp bool
+	// Disabled is true when the listener was stopped with DisableListener
+	Disabled bool
+}
+
+func (s ListenerStatus) String() string {
+	if s.State == ListenerFailed && s.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", s.Name, s.State, s.Err)
+	}
+	return fmt.Sprintf("%s: %s", s.Name, s.State)
+}
+
+// ServeFunction listens for agent queries until ListenerDone is closed.
+// It calls ListenerReady once listening and returns an error if it can't listen anymore.
+type ServeFunction func(ctx *AgentContext) error
+
+type supervisedListener struct {
+	status ListenerStatus
+	serve  ServeFunction
+	// ctx is canceled when the listener is disabled or when stopping
+	ctx            context.Context
+	cancelFunction context.CancelFunc
+	running        bool
+	// restart is set when the listener is served again while its disabled run is still stopping
+	restart bool
+}
+
+// Serve runs a listener and restarts it with backoff when it fails, until it is disabled or stopping.
+// Serving an already running listener does nothing, a disabled listener still stopping is restarted once stopped.
+func (a *AgentContext) Serve(name string, serve ServeFunction) {
+	a.listenersLock.Lock()
+	if a.listeners == nil {
+		a.listeners = map[string]*supervisedListener{}
+	}
+	listener, ok := a.listeners[name]
+	if !ok {
+		listener = &supervisedListener{status: ListenerStatus{Name: name}}
+		a.listeners[name] = listener
+	}
+	listener.serve = serve
+	listener.status.Disabled = false
+	listener.status.GaveUp = false
+	if listener.running {
+		if listener.ctx.Err() != nil {
+			listener.restart = true
+		}
+		a.listenersLock.Unlock()
+		return
+	}
+	a.runListener(name, listener)
+	a.listenersLock.Unlock()
+
+	a.notifyListener(name)
+}
+
+// runListener starts supervising a listener, listenersLock must be held.
+// The listener is starting until it calls ListenerReady, the caller notifies observers once listenersLock is released.
+func (a *AgentContext) runListener(name string, listener *supervisedListener) {
+	listener.status.State = ListenerStarting
+	listener.status.Err = nil
+	listener.running = true
+	listener.restart = false
+	listener.ctx, listener.cancelFunction = context.WithCancel(a.ctx)
+	listenerCtx, cancelFunction := listener.ctx, listener.cancelFunction
+	serve := listener.serve
+
+	a.Go(func() {
+		gaveUp := a.superviseListener(name, serve, listenerCtx)
+		cancelFunction()
+		if !gaveUp {
+			a.setListenerState(name, ListenerStopped, nil)
+		}
+
+		a.listenersLock.Lock()
+		restart := listener.restart && a.ctx.Err() == nil
+		if restart {
+			a.runListener(name, listener)
+		} else {
+			listener.running = false
+			listener.restart = false
+		}
+		a.listenersLock.Unlock()
+
+		if restart {
+			log.Infof("agentContext: restarting listener %s", name)
+			a.notifyListener(name)
+		}
+	})
+}
+
+// superviseListener runs serve until listenerCtx is canceled, restarting it with backoff when it fails.
+// It returns true when it gave up restarting the listener.
+func (a *AgentContext) superviseListener(name string, serve ServeFunction, listenerCtx context.Context) bool {
+	delay := a.ListenerRestartMinDelay
+	failures := 0
+
+	for {
+		err := serve(a)
+
+		if listenerCtx.Err() != nil {
+			return false
+		}
+
+		if err == nil {
+			// The listener has nothing to serve, don't restart it
+			log.Infof("agentContext: listener %s stopped", name)
+			return false
+		}
+
+		// A listener that managed to run is restarted quickly again
+		if a.listenerStatus(name).State == ListenerRunning {
+			delay = a.ListenerRestartMinDelay
+			failures = 0
+		}
+
+		failures++
+		if a.ListenerRestartMaxAttempts > 0 && failures > a.ListenerRestartMaxAttempts {
+			log.Errorf("agentContext: listener %s failed %d times in a row, giving up: %v", name, failures, err)
+			a.listenersLock.Lock()
+			if listener, ok := a.listeners[name]; ok {
+				listener.status.GaveUp = true
+			}
+			a.listenersLock.Unlock()
+			a.setListenerState(name, ListenerFailed, err)
+			return true
+		}
+
+		log.Errorf("agentContext: listener %s failed, restarting in %v: %v", name, delay, err)
+		a.setListenerState(name, ListenerFailed, err)
+
+		select {
+		case <-listenerCtx.Done():
+			return false
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > a.ListenerRestartMaxDelay {
+			delay = a.ListenerRestartMaxDelay
+		}
+
+		a.listenersLock.Lock()
+		if listener, ok := a.listeners[name]; ok {
+			listener.status.Restarts++
+		}
+		a.listenersLock.Unlock()
+		a.setListenerState(name, ListenerStarting, err)
+	}
+}
+
+// ListenerDone is closed when a listener must stop accepting connections,
+// because it was disabled or because the agent is stopping
+func (a *AgentContext) ListenerDone(name string) <-chan struct{} {
+	a.listenersLock.Lock()
+	defer a.listenersLock.Unlock()
+
+	if listener, ok := a.listeners[name]; ok && listener.ctx != nil {
+		return listener.ctx.Done()
+	}
+	return a.Done()
+}
+
+// ListenerReady is called by listeners once they accept connections
+func (a *AgentContext) ListenerReady(name string) {
+	a.setListenerState(name, ListenerRunning, nil)
+}
+
+// DisableListener stops a listener until EnableListener is called
+func (a *AgentContext) DisableListener(name string) error {
+	a.listenersLock.Lock()
+	listener, ok := a.listeners[name]
+	if !ok {
+		a.listenersLock.Unlock()
+		return fmt.Errorf("agentContext: unknown listener %s", name)
+	}
+	listener.status.Disabled = true
+	listener.restart = false
+	cancelFunction := listener.cancelFunction
+	a.listenersLock.Unlock()
+
+	log.Infof("agentContext: disabling listener %s", name)
+	if cancelFunction != nil {
+		cancelFunction()
+	}
+
+	return nil
+}
+
+// EnableListener restarts a listener stopped with DisableListener
+func (a *AgentContext) EnableListener(name string) error {
+	a.listenersLock.Lock()
+	listener, ok := a.listeners[name]
+	if !ok || listener.serve == nil {
+		a.listenersLock.Unlock()
+		return fmt.Errorf("agentContext: unknown listener %s", name)
+	}
+	serve := listener.serve
+	a.listenersLock.Unlock()
+
+	select {
+	case <-a.Done():
+		return fmt.Errorf("agentContext: stopping, can't enable listener %s", name)
+	default:
+	}
+
+	log.Infof("agentContext: enabling listener %s", name)
+	a.Serve(name, serve)
+
+	return nil
+}
+
+// Listeners returns the status of all supervised listeners sorted by name
+func (a *AgentContext) Listeners() []ListenerStatus {
+	a.listenersLock.Lock()
+	defer a.listenersLock.Unlock()
+
+	statuses := make([]ListenerStatus, 0, len(a.listeners))
+	for _, listener := range a.listeners {
+		statuses = append(statuses, listener.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// OnListenerChange registers a function called each time a listener changes state
+func (a *AgentContext) OnListenerChange(observer func(status ListenerStatus)) {
+	a.listenersLock.Lock()
+	defer a.listenersLock.Unlock()
+
+	a.listenerObservers = append(a.listenerObservers, observer)
+}
+
+func (a *AgentContext) listenerStatus(name string) ListenerStatus {
+	a.listenersLock.Lock()
+	defer a.listenersLock.Unlock()
+
+	if listener, ok := a.listeners[name]; ok {
+		return listener.status
+	}
+	return ListenerStatus{Name: name}
+}
+
+func (a *AgentContext) setListenerState(name string, state ListenerState, err error) {
+	a.listenersLock.Lock()
+
+	if a.listeners == nil {
+		a.listeners = map[string]*supervisedListener{}
+	}
+
+	listener, ok := a.listeners[name]
+	if !ok {
+		listener = &supervisedListener{status: ListenerStatus{Name: name}}
+		a.listeners[name] = listener
+	} else if listener.status.State == state && err == nil {
+		a.listenersLock.Unlock()
+		return
+	}
+
+	listener.status.State = state
+	listener.status.Err = err
+
+	a.listenersLock.Unlock()
+
+	a.notifyListener(name)
+}
+
+// notifyListener calls the observers with the current status of a listener.
+// Notifications racing with a state change can't overwrite it with a stale status as they are serialized.
+func (a *AgentContext) notifyListener(name string) {
+	a.listenerNotifyLock.Lock()
+	defer a.listenerNotifyLock.Unlock()
+
+	a.listenersLock.Lock()
+	listener, ok := a.listeners[name]
+	if !ok {
+		a.listenersLock.Unlock()
+		return
+	}
+	status := listener.status
+	observers := a.listenerObservers
+	a.listenersLock.Unlock()
+
+	log.Debugf("agentContext: listener %s", status)
+	for _, observer := range observers {
+		observer(status)
+	}
+}
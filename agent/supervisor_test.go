@@ -0,0 +1,276 @@
+package agent_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+const fakeListener = "fake"
+
+var errFakeListener = errors.New("fake listener failure")
+
+// fakeServe returns a ServeFunction sending the time of each start to starts.
+// It fails with errFakeListener, after calling ListenerReady when ready is true,
+// or listens until ListenerDone and takes stopDelay to stop when fail is false.
+func fakeServe(starts chan time.Time, fail bool, ready bool, stopDelay time.Duration) agent.ServeFunction {
+	return func(ctx *agent.AgentContext) error {
+		starts <- time.Now()
+		if ready || !fail {
+			ctx.ListenerReady(fakeListener)
+		}
+		if fail {
+			return errFakeListener
+		}
+
+		<-ctx.ListenerDone(fakeListener)
+		time.Sleep(stopDelay)
+		return nil
+	}
+}
+
+func newSupervisor(t *testing.T) *agent.AgentContext {
+	t.Helper()
+
+	ctx := agent.CreateAgent()
+	ctx.ListenerRestartMinDelay = 10 * time.Millisecond
+	ctx.ListenerRestartMaxDelay = 40 * time.Millisecond
+	t.Cleanup(func() {
+		ctx.Stop()
+		ctx.Wait()
+	})
+	return &ctx
+}
+
+func waitStart(t *testing.T, starts chan time.Time) time.Time {
+	t.Helper()
+
+	select {
+	case start := <-starts:
+		return start
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener not started")
+		return time.Time{}
+	}
+}
+
+func waitState(t *testing.T, ctx *agent.AgentContext, state agent.ListenerState) agent.ListenerStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, status := range ctx.Listeners() {
+			if status.Name == fakeListener && status.State == state {
+				return status
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("listener not %s: %v", state, ctx.Listeners())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQuickDisableEnable(t *testing.T) {
+	ctx := newSupervisor(t)
+	starts := make(chan time.Time, 10)
+
+	ctx.Serve(fakeListener, fakeServe(starts, false, false, 100*time.Millisecond))
+	waitStart(t, starts)
+	waitState(t, ctx, agent.ListenerRunning)
+
+	// Enable while the disabled listener is still stopping
+	if err := ctx.DisableListener(fakeListener); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.EnableListener(fakeListener); err != nil {
+		t.Fatal(err)
+	}
+
+	waitStart(t, starts)
+	status := waitState(t, ctx, agent.ListenerRunning)
+	if status.Disabled {
+		t.Error("restarted listener is disabled")
+	}
+}
+
+func TestQuickDisableEnableDisable(t *testing.T) {
+	ctx := newSupervisor(t)
+	starts := make(chan time.Time, 10)
+
+	ctx.Serve(fakeListener, fakeServe(starts, false, false, 100*time.Millisecond))
+	waitStart(t, starts)
+	waitState(t, ctx, agent.ListenerRunning)
+
+	ctx.DisableListener(fakeListener)
+	ctx.EnableListener(fakeListener)
+	ctx.DisableListener(fakeListener)
+
+	status := waitState(t, ctx, agent.ListenerStopped)
+	if !status.Disabled {
+		t.Error("listener not disabled")
+	}
+	select {
+	case <-starts:
+		t.Error("disabled listener restarted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	ctx := newSupervisor(t)
+	starts := make(chan time.Time, 10)
+
+	ctx.Serve(fakeListener, fakeServe(starts, true, false, 0))
+
+	previous := waitStart(t, starts)
+	for _, delay := range []time.Duration{10, 20, 40, 40} {
+		delay *= time.Millisecond
+		start := waitStart(t, starts)
+		if elapsed := start.Sub(previous); elapsed < delay {
+			t.Errorf("restarted after %v, want at least %v", elapsed, delay)
+		}
+		previous = start
+	}
+
+	status := waitState(t, ctx, agent.ListenerFailed)
+	if status.Restarts < 4 || !errors.Is(status.Err, errFakeListener) {
+		t.Errorf("status = %+v, want at least 4 restarts after errFakeListener", status)
+	}
+}
+
+func TestRestartDelayResetAfterRunning(t *testing.T) {
+	ctx := newSupervisor(t)
+	ctx.ListenerRestartMinDelay = 50 * time.Millisecond
+	ctx.ListenerRestartMaxDelay = 10 * time.Second
+	starts := make(chan time.Time, 10)
+
+	// Without reset, the 4 restarts would take 50+100+200+400ms
+	ctx.Serve(fakeListener, fakeServe(starts, true, true, 0))
+	first := waitStart(t, starts)
+	var last time.Time
+	for i := 0; i < 4; i++ {
+		last = waitStart(t, starts)
+	}
+
+	if elapsed := last.Sub(first); elapsed >= 750*time.Millisecond {
+		t.Errorf("4 restarts of a listener which managed to run took %v, want the minimum delay each time", elapsed)
+	}
+}
+
+func TestServeWithoutError(t *testing.T) {
+	ctx := newSupervisor(t)
+	starts := make(chan time.Time, 10)
+
+	ctx.Serve(fakeListener, func(ctx *agent.AgentContext) error {
+		starts <- time.Now()
+		return nil
+	})
+	waitStart(t, starts)
+	waitState(t, ctx, agent.ListenerStopped)
+
+	select {
+	case <-starts:
+		t.Error("listener with nothing to serve restarted")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStopListeners(t *testing.T) {
+	ctx := agent.CreateAgent()
+	starts := make(chan time.Time, 10)
+
+	ctx.Serve(fakeListener, fakeServe(starts, false, false, 0))
+	waitStart(t, starts)
+	waitState(t, &ctx, agent.ListenerRunning)
+
+	ctx.Stop()
+	ctx.Wait()
+
+	waitState(t, &ctx, agent.ListenerStopped)
+	if err := ctx.EnableListener(fakeListener); err == nil {
+		t.Error("listener enabled after Stop")
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	ctx := newSupervisor(t)
+	ctx.ListenerRestartMaxAttempts = 2
+	starts := make(chan time.Time, 10)
+
+	ctx.Serve(fakeListener, fakeServe(starts, true, false, 0))
+	for i := 0; i < 3; i++ {
+		waitStart(t, starts)
+	}
+
+	status := waitState(t, ctx, agent.ListenerFailed)
+	for !status.GaveUp {
+		time.Sleep(time.Millisecond)
+		status = waitState(t, ctx, agent.ListenerFailed)
+	}
+	if status.Restarts != 2 || !errors.Is(status.Err, errFakeListener) {
+		t.Errorf("status = %+v, want 2 restarts after errFakeListener", status)
+	}
+	select {
+	case <-starts:
+		t.Error("listener restarted after giving up")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Enabling the listener again restarts it
+	if err := ctx.EnableListener(fakeListener); err != nil {
+		t.Fatal(err)
+	}
+	waitStart(t, starts)
+}
+
+func TestNoGiveUpAfterRunning(t *testing.T) {
+	ctx := newSupervisor(t)
+	ctx.ListenerRestartMaxAttempts = 2
+	starts := make(chan time.Time, 10)
+
+	// Failures of a listener which managed to run aren't in a row
+	ctx.Serve(fakeListener, fakeServe(starts, true, true, 0))
+	for i := 0; i < 5; i++ {
+		waitStart(t, starts)
+	}
+	for _, status := range ctx.Listeners() {
+		if status.GaveUp {
+			t.Errorf("gave up restarting a listener which managed to run: %+v", status)
+		}
+	}
+}
+
+// A listener ready before Serve returns must stay running, in the status and for the observers
+func TestReadyNotOverwrittenByStarting(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ctx := newSupervisor(t)
+		starts := make(chan time.Time, 1)
+
+		var lock sync.Mutex
+		var notified agent.ListenerState
+		ctx.OnListenerChange(func(status agent.ListenerStatus) {
+			lock.Lock()
+			notified = status.State
+			lock.Unlock()
+		})
+
+		ctx.Serve(fakeListener, fakeServe(starts, false, false, 0))
+		waitStart(t, starts)
+		waitState(t, ctx, agent.ListenerRunning)
+		time.Sleep(time.Millisecond)
+
+		if status := ctx.Listeners()[0]; status.State != agent.ListenerRunning {
+			t.Fatalf("listener %v after being ready", status)
+		}
+		lock.Lock()
+		state := notified
+		lock.Unlock()
+		if state != agent.ListenerRunning {
+			t.Fatalf("last notified state %s, want running", state)
+		}
+	}
+}
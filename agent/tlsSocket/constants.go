@@ -0,0 +1,6 @@
+package tlsSocket
+
+const (
+	PackageName  = "tls-socket"
+	EndpointName = "tls"
+)
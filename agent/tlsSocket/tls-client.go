@@ -0,0 +1,37 @@
+package tlsSocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+func ClientTls(address string, config *Config, ctx *agent.AgentContext) error {
+	log.Infof("%s: forwarding to %s", PackageName, address)
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%s: bad address %s: %w", PackageName, address, err)
+	}
+
+	tlsConfig, err := config.clientConfig(host)
+	if err != nil {
+		return err
+	}
+
+	dialFunction := func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: handshakeTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+		if err != nil {
+			err = fmt.Errorf("%s: can't connect to %s: %w", PackageName, address, err)
+		}
+
+		return conn, err
+	}
+
+	return common.GenericNetClient(PackageName, dialFunction, ctx)
+}
@@ -0,0 +1,114 @@
+package tlsSocket
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config holds the certificates used for mutual TLS authentication.
+// The peer certificate must be signed by CAFile or match one of Pins, at least one of them is required.
+type Config struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// Pins are SHA256 fingerprints of accepted peer certificates, as shown by openssl x509 -fingerprint -sha256
+	Pins []string
+}
+
+var ErrNoPeerAuthentication = errors.New("no CA or certificate pin configured to authenticate the peer")
+
+func normalizePin(pin string) string {
+	return strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+}
+
+// verifyPins checks that the peer certificate is one of the pinned ones, if any
+func (c *Config) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(c.Pins) == 0 {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%s: no peer certificate", PackageName)
+	}
+
+	hash := sha256.Sum256(rawCerts[0])
+	fingerprint := hex.EncodeToString(hash[:])
+	for _, pin := range c.Pins {
+		if normalizePin(pin) == fingerprint {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: peer certificate %s is not pinned", PackageName, fingerprint)
+}
+
+func (c *Config) baseConfig() (*tls.Config, *x509.CertPool, error) {
+	if c.CAFile == "" && len(c.Pins) == 0 {
+		return nil, nil, fmt.Errorf("%s: %w", PackageName, ErrNoPeerAuthentication)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: can't load certificate %s: %w", PackageName, c.CertFile, err)
+	}
+
+	var caPool *x509.CertPool
+	if c.CAFile != "" {
+		caData, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: can't read CA file: %w", PackageName, err)
+		}
+
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caData) {
+			return nil, nil, fmt.Errorf("%s: no certificate found in CA file %s", PackageName, c.CAFile)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:          []tls.Certificate{certificate},
+		MinVersion:            tls.VersionTLS12,
+		VerifyPeerCertificate: c.verifyPins,
+	}
+
+	return tlsConfig, caPool, nil
+}
+
+func (c *Config) serverConfig() (*tls.Config, error) {
+	tlsConfig, caPool, err := c.baseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if caPool != nil {
+		tlsConfig.ClientCAs = caPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		// Only pinned certificates are accepted, checked by verifyPins
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *Config) clientConfig(serverName string) (*tls.Config, error) {
+	tlsConfig, caPool, err := c.baseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if caPool != nil {
+		tlsConfig.RootCAs = caPool
+		tlsConfig.ServerName = serverName
+	} else {
+		// Only pinned certificates are accepted, checked by verifyPins
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,71 @@
+package tlsSocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// tlsPeer does the TLS handshake and identifies the client by its certificate common name
+func tlsPeer(conn net.Conn) agent.PeerInfo {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return agent.PeerInfo{}
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		// The connection is unusable, following reads will fail and close it
+		log.Errorf("%s: handshake with %s failed: %v", PackageName, conn.RemoteAddr(), err)
+		return agent.PeerInfo{}
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return agent.PeerInfo{}
+	}
+
+	return agent.PeerInfo{Uid: state.PeerCertificates[0].Subject.CommonName}
+}
+
+func ServeTls(address string, config *Config, ctx *agent.AgentContext) error {
+	activatedFile, activated := common.ActivatedFile(EndpointName)
+
+	if address == "" && !activated {
+		log.Errorf("%s: empty listen address, skipping serving for ssh-agent queries", PackageName)
+		return nil
+	}
+
+	tlsConfig, err := config.serverConfig()
+	if err != nil {
+		return fmt.Errorf("%s: %w", PackageName, err)
+	}
+
+	listenFunction := func() (net.Listener, error) {
+		return tls.Listen("tcp", address, tlsConfig)
+	}
+
+	if activated {
+		log.Infof("%s: listening for agent requests on socket passed by systemd", PackageName)
+		listenFunction = func() (net.Listener, error) {
+			listener, err := net.FileListener(activatedFile)
+			if err != nil {
+				return nil, err
+			}
+			return tls.NewListener(listener, tlsConfig), nil
+		}
+	} else {
+		log.Infof("%s: listening for agent requests on %s", PackageName, address)
+	}
+
+	return common.GenericNetServer(PackageName, EndpointName, listenFunction, tlsPeer, ctx)
+}
@@ -0,0 +1,236 @@
+package tlsSocket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certFile    string
+	keyFile     string
+}
+
+func (c *testCertificate) pin() string {
+	hash := sha256.Sum256(c.certificate.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// newCertificate writes a certificate for name signed by parent, or a self-signed CA when parent is nil
+func newCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signerCertificate, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signerCertificate, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCertificate, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	result := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certFile:    filepath.Join(dir, name+".pem"),
+		keyFile:     filepath.Join(dir, name+".key"),
+	}
+	writePem(t, result.certFile, "CERTIFICATE", der)
+	writePem(t, result.keyFile, "EC PRIVATE KEY", keyDer)
+	return result
+}
+
+func writePem(t *testing.T, path string, blockType string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forward serves an upstream keyring with ServeTls and returns a context forwarding to it with ClientTls
+func forward(t *testing.T, serverConfig *Config, clientConfig *Config) *agent.AgentContext {
+	t.Helper()
+	return forwardAddress(t, agentTest.FreeAddress(t), serverConfig, clientConfig)
+}
+
+func forwardAddress(t *testing.T, address string, serverConfig *Config, clientConfig *Config) *agent.AgentContext {
+	t.Helper()
+
+	serverCtx := agent.CreateAgent()
+	agentTest.ServeUpstream(&serverCtx, agentTest.NewKeyring(t, "tls-key"))
+	serverCtx.Serve(EndpointName, func(ctx *agent.AgentContext) error {
+		return ServeTls(address, serverConfig, ctx)
+	})
+	t.Cleanup(func() { agentTest.Stop(&serverCtx) })
+	agentTest.WaitListener(t, &serverCtx, EndpointName)
+
+	clientCtx := agent.CreateAgent()
+	clientCtx.Go(func() {
+		if err := ClientTls(address, clientConfig, &clientCtx); err != nil {
+			t.Errorf("client: %v", err)
+		}
+	})
+	t.Cleanup(func() { agentTest.Stop(&clientCtx) })
+
+	return &clientCtx
+}
+
+func TestForward(t *testing.T) {
+	ca := newCertificate(t, "ca", nil)
+	otherCa := newCertificate(t, "other-ca", nil)
+	server := newCertificate(t, "127.0.0.1", ca)
+	client := newCertificate(t, "client", ca)
+	untrustedClient := newCertificate(t, "client", otherCa)
+
+	tests := []struct {
+		name   string
+		server Config
+		client Config
+		works  bool
+	}{
+		{
+			name:   "ca",
+			server: Config{CertFile: server.certFile, KeyFile: server.keyFile, CAFile: ca.certFile},
+			client: Config{CertFile: client.certFile, KeyFile: client.keyFile, CAFile: ca.certFile},
+			works:  true,
+		},
+		{
+			name:   "pins",
+			server: Config{CertFile: server.certFile, KeyFile: server.keyFile, Pins: []string{client.pin()}},
+			client: Config{CertFile: client.certFile, KeyFile: client.keyFile, Pins: []string{server.pin()}},
+			works:  true,
+		},
+		{
+			name:   "client from another ca",
+			server: Config{CertFile: server.certFile, KeyFile: server.keyFile, CAFile: ca.certFile},
+			client: Config{CertFile: untrustedClient.certFile, KeyFile: untrustedClient.keyFile, CAFile: ca.certFile},
+		},
+		{
+			name:   "client not pinned",
+			server: Config{CertFile: server.certFile, KeyFile: server.keyFile, Pins: []string{client.pin()}},
+			client: Config{CertFile: untrustedClient.certFile, KeyFile: untrustedClient.keyFile, Pins: []string{server.pin()}},
+		},
+		{
+			name:   "server not pinned",
+			server: Config{CertFile: server.certFile, KeyFile: server.keyFile, Pins: []string{client.pin()}},
+			client: Config{CertFile: client.certFile, KeyFile: client.keyFile, Pins: []string{client.pin()}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := forward(t, &test.server, &test.client)
+			client := agentTest.Client(ctx, "test")
+
+			if test.works {
+				agentTest.CheckSign(t, client)
+			} else if keys, err := client.List(); err == nil {
+				t.Fatalf("list worked with %d keys, want an error", len(keys))
+			}
+		})
+	}
+}
+
+func TestSilentClient(t *testing.T) {
+	ca := newCertificate(t, "ca", nil)
+	server := newCertificate(t, "127.0.0.1", ca)
+	client := newCertificate(t, "client", ca)
+
+	address := agentTest.FreeAddress(t)
+	ctx := forwardAddress(t, address,
+		&Config{CertFile: server.certFile, KeyFile: server.keyFile, CAFile: ca.certFile},
+		&Config{CertFile: client.certFile, KeyFile: client.keyFile, CAFile: ca.certFile})
+
+	// Connections which never start the handshake must not block the others
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	start := time.Now()
+	agentTest.CheckSign(t, agentTest.Client(ctx, "test"))
+	if elapsed := time.Since(start); elapsed > handshakeTimeout/2 {
+		t.Errorf("query took %v with silent clients connected", elapsed)
+	}
+}
+
+func TestNoPeerAuthentication(t *testing.T) {
+	server := newCertificate(t, "server", nil)
+	config := Config{CertFile: server.certFile, KeyFile: server.keyFile}
+
+	if _, err := config.serverConfig(); !errors.Is(err, ErrNoPeerAuthentication) {
+		t.Errorf("serverConfig() = %v, want ErrNoPeerAuthentication", err)
+	}
+	if _, err := config.clientConfig("server"); !errors.Is(err, ErrNoPeerAuthentication) {
+		t.Errorf("clientConfig() = %v, want ErrNoPeerAuthentication", err)
+	}
+}
+
+func TestNormalizePin(t *testing.T) {
+	ca := newCertificate(t, "ca", nil)
+	config := Config{Pins: []string{"AB:CD", formatOpenssl(ca.pin())}}
+
+	if err := config.verifyPins([][]byte{ca.certificate.Raw}, nil); err != nil {
+		t.Errorf("openssl formatted pin not accepted: %v", err)
+	}
+}
+
+// formatOpenssl formats a fingerprint like openssl x509 -fingerprint
+func formatOpenssl(fingerprint string) string {
+	var pairs []string
+	for i := 0; i+1 < len(fingerprint); i += 2 {
+		pairs = append(pairs, fingerprint[i:i+2])
+	}
+	return strings.ToUpper(strings.Join(pairs, ":"))
+}
@@ -0,0 +1,3 @@
+package trace
+
+const PackageName = "trace"
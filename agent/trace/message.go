@@ -0,0 +1,140 @@
+package trace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// Reply message types not used elsewhere in the bridge
+const (
+	SSH_AGENT_EXTENSION_RESPONSE = 29
+)
+
+var replyTypeNames = map[byte]string{
+	agent.SSH_AGENT_FAILURE:           "failure",
+	agent.SSH_AGENT_SUCCESS:           "success",
+	agent.SSH_AGENT_IDENTITIES_ANSWER: "identities-answer",
+	agent.SSH_AGENT_SIGN_RESPONSE:     "sign-response",
+	agent.SSH_AGENT_EXTENSION_FAILURE: "extension-failure",
+	SSH_AGENT_EXTENSION_RESPONSE:      "extension-response",
+}
+
+// Message is a request or a reply as written in a trace file
+type Message struct {
+	Type string `json:"type"`
+	// Summary describes the decoded content, like key fingerprints
+	Summary string `json:"summary,omitempty"`
+	// Data is the complete message, omitted when Redacted
+	Data     []byte `json:"data,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// TypeName returns the name of a request or reply message type
+func TypeName(message []byte, request bool) string {
+	messageType := agent.MessageType(message)
+	if len(message) < 5 {
+		return "empty"
+	}
+
+	if request {
+		if name := agent.MessageTypeName(messageType); name != "unknown" {
+			return name
+		}
+	} else if name, ok := replyTypeNames[messageType]; ok {
+		return name
+	}
+	return fmt.Sprintf("type-%d", messageType)
+}
+
+// DecodeRequest returns the trace representation of a request, secrets are redacted
+func DecodeRequest(message []byte) Message {
+	decoded := Message{
+		Type: TypeName(message, true),
+		Data: message,
+	}
+	payload := agent.MessagePayload(message)
+
+	switch agent.MessageType(message) {
+	case agent.SSH_AGENTC_SIGN_REQUEST:
+		if keyBlob, data, flags, err := agent.ParseSignRequest(message); err == nil {
+			decoded.Summary = fmt.Sprintf("key %s, %d bytes to sign, flags 0x%x", agent.Fingerprint(keyBlob), len(data), flags)
+		}
+	case agent.SSH_AGENTC_REMOVE_IDENTITY:
+		if keyBlob, err := agent.RequestKeyBlob(message); err == nil {
+			decoded.Summary = "key " + agent.Fingerprint(keyBlob)
+		}
+	case agent.SSH_AGENTC_ADD_IDENTITY, agent.SSH_AGENTC_ADD_ID_CONSTRAINED:
+		// Private key material, only keep the key type
+		decoded.Data, decoded.Redacted = nil, true
+		if keyType, _, err := agent.ReadString(payload); err == nil {
+			decoded.Summary = "key type " + string(keyType)
+		}
+	case agent.SSH_AGENTC_ADD_SMARTCARD_KEY, agent.SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED, agent.SSH_AGENTC_REMOVE_SMARTCARD_KEY:
+		// The reader id is followed by the PIN
+		decoded.Data, decoded.Redacted = nil, true
+		if readerID, _, err := agent.ReadString(payload); err == nil {
+			decoded.Summary = "reader " + string(readerID)
+		}
+	case agent.SSH_AGENTC_LOCK, agent.SSH_AGENTC_UNLOCK:
+		// Passphrase
+		decoded.Data, decoded.Redacted = nil, true
+	case agent.SSH_AGENTC_EXTENSION:
+		if name, contents, err := agent.ParseExtension(message); err == nil {
+			decoded.Summary = name
+			if name == "session-bind@openssh.com" {
+				if hostKey, _, err := agent.ReadString(contents); err == nil {
+					decoded.Summary += ", host key " + agent.Fingerprint(hostKey)
+				}
+			}
+		}
+	}
+
+	return decoded
+}
+
+// DecodeReply returns the trace representation of a reply
+func DecodeReply(message []byte) Message {
+	decoded := Message{
+		Type: TypeName(message, false),
+		Data: message,
+	}
+
+	switch agent.MessageType(message) {
+	case agent.SSH_AGENT_IDENTITIES_ANSWER:
+		identities, err := agent.ParseIdentitiesAnswer(message)
+		if err != nil {
+			decoded.Summary = "malformed"
+			break
+		}
+
+		keys := make([]string, 0, len(identities))
+		for _, identity := range identities {
+			keys = append(keys, fmt.Sprintf("%s %s", agent.Fingerprint(identity.KeyBlob), identity.Comment))
+		}
+		decoded.Summary = fmt.Sprintf("%d keys: %s", len(identities), strings.Join(keys, ", "))
+	case agent.SSH_AGENT_SIGN_RESPONSE:
+		signature, _, err := agent.ReadString(agent.MessagePayload(message))
+		if err != nil {
+			decoded.Summary = "malformed"
+			break
+		}
+		format, rest, err := agent.ReadString(signature)
+		if err != nil {
+			decoded.Summary = "malformed"
+			break
+		}
+		if blob, _, err := agent.ReadString(rest); err == nil {
+			decoded.Summary = fmt.Sprintf("signature %s, %d bytes", format, len(blob))
+		}
+	case agent.SSH_AGENT_FAILURE, agent.SSH_AGENT_SUCCESS, agent.SSH_AGENT_EXTENSION_FAILURE:
+	default:
+		if len(message) >= 4 {
+			decoded.Summary = fmt.Sprintf("%d bytes", binary.BigEndian.Uint32(message))
+		}
+	}
+
+	return decoded
+}
@@ -0,0 +1,147 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/agentTest"
+	xagent "golang.org/x/crypto/ssh/agent"
+)
+
+// recordedEntries reads the entries of a trace file and the file content
+func recordedEntries(t *testing.T, path string) ([]Entry, []byte) {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, content
+}
+
+func TestRedactedSecrets(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "trace.json")
+	recorder, err := NewRecorder(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := agent.CreateAgent()
+	ctx.Use(recorder.Middleware)
+	agentTest.ServeUpstream(&ctx, agentTest.NewKeyring(t, "existing"))
+	t.Cleanup(func() { agentTest.Stop(&ctx) })
+	client := agentTest.Client(&ctx, "test")
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("lock-passphrase-secret")
+	pin := []byte("smartcard-pin-secret")
+	secrets := map[string][]byte{
+		"private key": privateKey.Seed(),
+		"passphrase":  passphrase,
+		"PIN":         pin,
+	}
+
+	if err := client.Add(xagent.AddedKey{PrivateKey: privateKey, Comment: "added"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Add(xagent.AddedKey{PrivateKey: privateKey, Comment: "constrained", LifetimeSecs: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Lock(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Unlock(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	conn := agent.NewConnection("test", agent.PeerInfo{})
+	for _, messageType := range []byte{agent.SSH_AGENTC_ADD_SMARTCARD_KEY, agent.SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED, agent.SSH_AGENTC_REMOVE_SMARTCARD_KEY} {
+		ctx.Query(conn, agent.NewAgentMessage(messageType, agent.MarshalString([]byte("/usr/lib/opensc-pkcs11.so")), agent.MarshalString(pin)))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, content := recordedEntries(t, traceFile)
+	wantTypes := []string{
+		agent.MessageTypeName(agent.SSH_AGENTC_ADD_IDENTITY),
+		agent.MessageTypeName(agent.SSH_AGENTC_ADD_ID_CONSTRAINED),
+		agent.MessageTypeName(agent.SSH_AGENTC_LOCK),
+		agent.MessageTypeName(agent.SSH_AGENTC_UNLOCK),
+		agent.MessageTypeName(agent.SSH_AGENTC_ADD_SMARTCARD_KEY),
+		agent.MessageTypeName(agent.SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED),
+		agent.MessageTypeName(agent.SSH_AGENTC_REMOVE_SMARTCARD_KEY),
+	}
+	if len(entries) != len(wantTypes) {
+		t.Fatalf("%d entries recorded, want %d", len(entries), len(wantTypes))
+	}
+	for i, entry := range entries {
+		if entry.Request.Type != wantTypes[i] {
+			t.Errorf("entry %d is %s, want %s", i, entry.Request.Type, wantTypes[i])
+		}
+		if !entry.Request.Redacted || entry.Request.Data != nil {
+			t.Errorf("%s request recorded with its data", entry.Request.Type)
+		}
+	}
+
+	// Data fields are base64 encoded in the JSON
+	for name, secret := range secrets {
+		for _, encoded := range [][]byte{secret, []byte(base64.StdEncoding.EncodeToString(secret))} {
+			if bytes.Contains(content, encoded) {
+				t.Errorf("%s found in the trace file", name)
+			}
+		}
+	}
+}
+
+func TestDecodeRequestSummary(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addIdentity := agent.NewAgentMessage(agent.SSH_AGENTC_ADD_IDENTITY,
+		agent.MarshalString([]byte("ssh-ed25519")),
+		agent.MarshalString(privateKey.Public().(ed25519.PublicKey)),
+		agent.MarshalString(privateKey),
+		agent.MarshalString([]byte("comment")))
+
+	tests := []struct {
+		name    string
+		message []byte
+		summary string
+	}{
+		{"add identity", addIdentity, "key type ssh-ed25519"},
+		{"smartcard", agent.NewAgentMessage(agent.SSH_AGENTC_ADD_SMARTCARD_KEY, agent.MarshalString([]byte("reader")), agent.MarshalString([]byte("1234"))), "reader reader"},
+		{"lock", agent.NewAgentMessage(agent.SSH_AGENTC_LOCK, agent.MarshalString([]byte("passphrase"))), ""},
+		{"malformed add identity", agent.NewAgentMessage(agent.SSH_AGENTC_ADD_IDENTITY, []byte{0, 0}), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded := DecodeRequest(test.message)
+			if !decoded.Redacted || decoded.Data != nil || decoded.Summary != test.summary {
+				t.Errorf("decoded %+v, want redacted with summary %q", decoded, test.summary)
+			}
+		})
+	}
+}
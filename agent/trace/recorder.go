@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// Entry is a request/reply pair of a client connection, trace files have one JSON entry per line
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Connection uint64    `json:"connection"`
+	Listener   string    `json:"listener"`
+	Peer       string    `json:"peer"`
+	// DurationMs is the time taken by the upstream agent to reply, in milliseconds
+	DurationMs int64   `json:"duration_ms"`
+	Request    Message `json:"request"`
+	Reply      Message `json:"reply"`
+}
+
+// Recorder writes each request forwarded to the upstream agent and its reply to a trace file
+type Recorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewRecorder appends the trace to the file at path
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't open trace file: %w", PackageName, err)
+	}
+
+	return &Recorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (r *Recorder) record(entry *Entry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if err := r.encoder.Encode(entry); err != nil {
+		log.Errorf("%s: can't write trace: %v", PackageName, err)
+	}
+}
+
+// Middleware records queries as they are sent upstream, it should be the last middleware
+func (r *Recorder) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		start := time.Now()
+		reply := next(conn, query)
+
+		r.record(&Entry{
+			Time:       start,
+			Connection: conn.ID,
+			Listener:   conn.Listener,
+			Peer:       conn.String(),
+			DurationMs: time.Since(start).Milliseconds(),
+			Request:    DecodeRequest(query),
+			Reply:      DecodeReply(reply.Data),
+		})
+
+		return reply
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
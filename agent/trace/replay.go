@@ -0,0 +1,98 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+// Result of the replay of an entry
+type ReplayStatus int
+
+const (
+	ReplaySame ReplayStatus = iota
+	// ReplaySameSummary is a reply with the same decoded content but different bytes, like non-deterministic signatures
+	ReplaySameSummary
+	ReplayDifferent
+	// ReplaySkipped is a redacted request that can't be replayed
+	ReplaySkipped
+)
+
+func (s ReplayStatus) String() string {
+	switch s {
+	case ReplaySame:
+		return "same"
+	case ReplaySameSummary:
+		return "same summary"
+	case ReplayDifferent:
+		return "DIFFERENT"
+	case ReplaySkipped:
+		return "skipped"
+	default:
+		return "unknown"
+	}
+}
+
+// ReplayResult compares the recorded reply of an entry to the reply of the replay
+type ReplayResult struct {
+	Entry  *Entry
+	Reply  Message
+	Status ReplayStatus
+}
+
+// ReadEntries reads a trace file written by Recorder
+func ReadEntries(r io.Reader) ([]*Entry, error) {
+	var entries []*Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*agent.MAX_AGENT_MESSAGE_SIZE)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", PackageName, line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", PackageName, err)
+	}
+
+	return entries, nil
+}
+
+// Replay sends the recorded requests in order with query and compares the replies
+func Replay(entries []*Entry, query func(request []byte) []byte) []ReplayResult {
+	results := make([]ReplayResult, 0, len(entries))
+
+	for _, entry := range entries {
+		result := ReplayResult{Entry: entry}
+
+		if entry.Request.Redacted || len(entry.Request.Data) == 0 {
+			result.Status = ReplaySkipped
+			results = append(results, result)
+			continue
+		}
+
+		result.Reply = DecodeReply(query(entry.Request.Data))
+		switch {
+		case bytes.Equal(result.Reply.Data, entry.Reply.Data):
+			result.Status = ReplaySame
+		case result.Reply.Type == entry.Reply.Type && result.Reply.Summary == entry.Reply.Summary:
+			result.Status = ReplaySameSummary
+		default:
+			result.Status = ReplayDifferent
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
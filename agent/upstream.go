@@ -0,0 +1,55 @@
+package agent
+
+// UpstreamStatus is the health of the upstream agent as seen by the last query
+type UpstreamStatus struct {
+	Name string
+	// Err is the error of the last query, nil if the upstream agent replied
+	Err error
+}
+
+// SetUpstream sets the name of the upstream agent reported in UpstreamStatus
+func (a *AgentContext) SetUpstream(name string) {
+	a.upstreamLock.Lock()
+	defer a.upstreamLock.Unlock()
+
+	a.upstream.Name = name
+}
+
+// UpstreamResult is called by upstream agent clients after each query, err is nil when the upstream agent replied
+func (a *AgentContext) UpstreamResult(err error) {
+	a.upstreamLock.Lock()
+
+	// Only notify the first result and state changes, not each query
+	if a.upstreamReported && (a.upstream.Err == nil) == (err == nil) &&
+		(err == nil || err.Error() == a.upstream.Err.Error()) {
+		a.upstreamLock.Unlock()
+		return
+	}
+
+	a.upstreamReported = true
+	a.upstream.Err = err
+	status := a.upstream
+	observers := a.upstreamObservers
+
+	a.upstreamLock.Unlock()
+
+	for _, observer := range observers {
+		observer(status)
+	}
+}
+
+// Upstream returns the health of the upstream agent
+func (a *AgentContext) Upstream() UpstreamStatus {
+	a.upstreamLock.Lock()
+	defer a.upstreamLock.Unlock()
+
+	return a.upstream
+}
+
+// OnUpstreamChange registers a function called when the upstream agent becomes reachable or unreachable
+func (a *AgentContext) OnUpstreamChange(observer func(status UpstreamStatus)) {
+	a.upstreamLock.Lock()
+	defer a.upstreamLock.Unlock()
+
+	a.upstreamObservers = append(a.upstreamObservers, observer)
+}
@@ -0,0 +1,49 @@
+package agent
+
+const _SSH_MSG_USERAUTH_REQUEST = 50
+
+// UserauthRequest is the content of a publickey user authentication signed by the agent
+type UserauthRequest struct {
+	SessionID []byte
+	User      string
+	// HostKey is only set for publickey-hostbound-v00@openssh.com
+	HostKey []byte
+}
+
+// ParseUserauthRequest parses the data of a sign request as a SSH publickey user authentication request.
+// It returns false if the data to sign is something else.
+func ParseUserauthRequest(data []byte) (*UserauthRequest, bool) {
+	sessionID, rest, err := ReadString(data)
+	if err != nil || len(rest) < 1 || rest[0] != _SSH_MSG_USERAUTH_REQUEST {
+		return nil, false
+	}
+
+	// user, service, method
+	fields, rest, err := readStrings(rest[1:], 3)
+	if err != nil {
+		return nil, false
+	}
+
+	// has signature flag, algorithm, public key
+	if len(rest) < 1 || rest[0] == 0 {
+		return nil, false
+	}
+	if _, rest, err = readStrings(rest[1:], 2); err != nil {
+		return nil, false
+	}
+
+	request := &UserauthRequest{
+		SessionID: sessionID,
+		User:      string(fields[0]),
+	}
+
+	switch string(fields[2]) {
+	case "publickey":
+		return request, len(rest) == 0
+	case "publickey-hostbound-v00@openssh.com":
+		request.HostKey, rest, err = ReadString(rest)
+		return request, err == nil && len(rest) == 0
+	default:
+		return nil, false
+	}
+}
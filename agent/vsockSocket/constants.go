@@ -0,0 +1,6 @@
+package vsockSocket
+
+const (
+	PackageName  = "vsock-socket"
+	EndpointName = "vsock"
+)
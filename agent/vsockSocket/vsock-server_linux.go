@@ -0,0 +1,34 @@
+package vsockSocket
+
+import (
+	"net"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/mdlayher/vsock"
+)
+
+// ServeVsock listens on an AF_VSOCK port, reachable by virtual machines using the host CID (2)
+func ServeVsock(port uint32, ctx *agent.AgentContext) error {
+	if activatedFile, ok := common.ActivatedFile(EndpointName); ok {
+		log.Infof("%s: listening for agent requests on socket passed by systemd", PackageName)
+
+		listenFunction := func() (net.Listener, error) {
+			return vsock.FileListener(activatedFile)
+		}
+		return common.GenericNetServer(PackageName, EndpointName, listenFunction, nil, ctx)
+	}
+
+	if port == 0 {
+		log.Errorf("%s: no vsock port, skipping serving for ssh-agent queries", PackageName)
+		return nil
+	}
+
+	log.Infof("%s: listening for agent requests on vsock port %d", PackageName, port)
+
+	listenFunction := func() (net.Listener, error) {
+		return vsock.Listen(port, nil)
+	}
+	return common.GenericNetServer(PackageName, EndpointName, listenFunction, nil, ctx)
+}
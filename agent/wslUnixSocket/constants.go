@@ -1,3 +1,6 @@
 package wslUnixSocket
 
-const PackageName = "wsl-unix-socket"
+const (
+	PackageName  = "wsl-unix-socket"
+	EndpointName = "wsl"
+)
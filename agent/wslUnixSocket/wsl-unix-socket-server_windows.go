@@ -5,6 +5,7 @@ package wslUnixSocket
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
 
@@ -13,19 +14,17 @@ import (
 	"github.com/amurzeau/ssh-agent-bridge/log"
 )
 
-func ServeWslUnixSocket(socketPath string, ctx *agent.AgentContext) {
+func ServeWslUnixSocket(socketPath string, ctx *agent.AgentContext) error {
 	if socketPath == "" {
 		log.Errorf("%s: empty socket path, skipping serving for WSL ssh-agent queries", PackageName)
-		return
+		return nil
 	}
 
 	result, err := os.Stat(socketPath)
 	if result != nil {
-		log.Errorf("%s: wsl socket path already exists: %s", PackageName, socketPath)
-		return
+		return fmt.Errorf("%s: wsl socket path already exists: %s", PackageName, socketPath)
 	} else if !errors.Is(err, os.ErrNotExist) {
-		log.Errorf("%s: error while checking socket path %s: %v", PackageName, socketPath, err)
-		return
+		return fmt.Errorf("%s: error while checking socket path %s: %w", PackageName, socketPath, err)
 	}
 
 	log.Infof("%s: listening for agent requests on WSL unix socket %v\n", PackageName, socketPath)
@@ -36,5 +35,5 @@ func ServeWslUnixSocket(socketPath string, ctx *agent.AgentContext) {
 	listenFunction := func() (net.Listener, error) {
 		return net.Listen("unix", socketPath)
 	}
-	common.GenericNetServer(PackageName, listenFunction, ctx)
+	return common.GenericNetServer(PackageName, EndpointName, listenFunction, nil, ctx)
 }
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent/certificates"
+	"github.com/amurzeau/ssh-agent-bridge/agent/destinationConstraints"
+	"github.com/amurzeau/ssh-agent-bridge/agent/hostIdentities"
+	"github.com/amurzeau/ssh-agent-bridge/agent/identityOrder"
+	"github.com/amurzeau/ssh-agent-bridge/agent/policy"
+)
+
+// ListenerConfig holds the settings specific to one --from endpoint
+type ListenerConfig struct {
+	// ReadOnly defaults to false for listeners and to true for containers, see IsReadOnly
+	ReadOnly       *bool    `json:"read-only"`
+	SafeExtensions []string `json:"safe-extensions"`
+	// Keys restricts the listener to these key fingerprints
+	Keys []string `json:"keys"`
+	// NoIdentityCache forwards all REQUEST_IDENTITIES of the listener to the upstream agent, see --identity-cache-ttl
+	NoIdentityCache bool `json:"no-identity-cache"`
+	// IdentityOrder lists the matching identities first, in the order of the rules
+	IdentityOrder []identityOrder.Rule `json:"identity-order"`
+	// MaxIdentities limits the number of listed identities, 0 for no limit
+	MaxIdentities int `json:"max-identities"`
+}
+
+// IsReadOnly returns the read-only setting, or defaultValue when it is not set
+func (l *ListenerConfig) IsReadOnly(defaultValue bool) bool {
+	if l.ReadOnly == nil {
+		return defaultValue
+	}
+	return *l.ReadOnly
+}
+
+// Config is the content of the JSON configuration file given with --config
+type Config struct {
+	Listeners              map[string]ListenerConfig          `json:"listeners"`
+	Containers             map[string]ListenerConfig          `json:"containers"`
+	Policy                 *policy.Config                     `json:"policy"`
+	DestinationConstraints []destinationConstraints.KeyConfig `json:"destination-constraints"`
+	HostIdentities         *hostIdentities.Config             `json:"host-identities"`
+	// Certificates are OpenSSH certificate files or patterns like ~/.ssh/*-cert.pub
+	Certificates []string `json:"certificates"`
+	// CertificateAuthority issues short-lived certificates for the upstream keys
+	CertificateAuthority *certificates.AuthorityConfig `json:"certificate-authority"`
+}
+
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: can't open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var config Config
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("config: can't parse %s: %w", path, err)
+	}
+
+	return &config, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/daemon"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+// IDLE_CHECK_PERIOD is the period of connected clients checks for --idle-timeout
+const IDLE_CHECK_PERIOD = 1 * time.Second
+
+// DAEMON_LISTENER_RESTART_ATTEMPTS is the number of restarts of a failing listener before giving up in headless mode,
+// about 3 minutes with the default backoff, then the service manager can restart the bridge
+const DAEMON_LISTENER_RESTART_ATTEMPTS = 8
+
+// runDaemon runs the listeners and the upstream agent without tray icon until stopped by a signal or a failure
+func runDaemon() {
+	watcher := &listenersWatcher{}
+	agentContext.OnListenerChange(func(agent.ListenerStatus) {
+		watcher.check()
+	})
+
+	go handleSignals()
+
+	agentContext.ListenerRestartMaxAttempts = DAEMON_LISTENER_RESTART_ATTEMPTS
+	startAgent()
+	watcher.start()
+
+	if *argIdleTimeout > 0 {
+		go watchIdle(*argIdleTimeout)
+	}
+
+	<-agentContext.Done()
+	if err := daemon.Notify("STOPPING=1"); err != nil {
+		log.Errorf("%v", err)
+	}
+
+	agentContext.Wait()
+}
+
+// watchIdle stops when no client is connected during timeout, systemd starts the bridge again on the next connection
+func watchIdle(timeout time.Duration) {
+	ticker := time.NewTicker(IDLE_CHECK_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-agentContext.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if since, idle := agentContext.IdleSince(); idle && time.Since(since) >= timeout {
+			log.Infof("no client connected since %v, exiting", timeout)
+			agentContext.Stop()
+			return
+		}
+	}
+}
+
+// listenersWatcher notifies readiness once all listeners started,
+// and stops when none is working anymore and the supervisor gave up restarting the failed ones
+type listenersWatcher struct {
+	mutex   sync.Mutex
+	started bool
+	ready   bool
+}
+
+func (w *listenersWatcher) start() {
+	w.mutex.Lock()
+	w.started = true
+	w.mutex.Unlock()
+
+	w.check()
+}
+
+func (w *listenersWatcher) check() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Wait for all listeners to be registered, and ignore listeners stopping at exit
+	if !w.started {
+		return
+	}
+	select {
+	case <-agentContext.Done():
+		return
+	default:
+	}
+
+	starting := false
+	working := false
+	for _, listener := range agentContext.Listeners() {
+		switch listener.State {
+		case agent.ListenerStarting:
+			starting = true
+			working = true
+		case agent.ListenerRunning:
+			working = true
+		case agent.ListenerFailed:
+			// The supervisor restarts failed listeners with backoff until it gives up
+			if !listener.GaveUp {
+				working = true
+			}
+		}
+	}
+
+	if !working {
+		log.Alertf("no listener is working, exiting")
+		stopWithExitCode(EXIT_LISTENERS_FAILED)
+		return
+	}
+
+	if !starting && !w.ready {
+		w.ready = true
+		log.Infof("all listeners started")
+		if err := daemon.Notify("READY=1"); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd, see sd_listen_fds(3)
+const SD_LISTEN_FDS_START = 3
+
+// ActivationFiles returns the sockets passed by systemd socket activation indexed by their FileDescriptorName.
+// It returns nil when not socket activated.
+func ActivationFiles() (map[string]*os.File, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	if len(names) != count {
+		return nil, fmt.Errorf("daemon: %d sockets passed by systemd but %d names in LISTEN_FDNAMES, set FileDescriptorName= in the socket unit", count, len(names))
+	}
+
+	// Don't pass the sockets to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	files := map[string]*os.File{}
+	for i, name := range names {
+		fd := SD_LISTEN_FDS_START + i
+		syscall.CloseOnExec(fd)
+
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("daemon: socket name %s passed twice by systemd", name)
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package daemon
+
+import "os"
+
+// ActivationFiles returns nil, systemd socket activation is only available on Linux
+func ActivationFiles() (map[string]*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,29 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Notify sends a state like READY=1 to the service manager, see sd_notify(3).
+// It does nothing when not started by systemd.
+func Notify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// A leading @ is an abstract socket, handled by net
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("daemon: can't connect to NOTIFY_SOCKET %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("daemon: can't notify %s: %w", state, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package daemon
+
+// Notify does nothing, systemd is only available on Linux
+func Notify(state string) error {
+	return nil
+}
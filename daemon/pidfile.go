@@ -0,0 +1,29 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WritePidFile writes the current process id to path
+func WritePidFile(path string) error {
+	err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("daemon: can't write pid file %s: %w", path, err)
+	}
+	return nil
+}
+
+// RemovePidFile removes the pid file if it still contains the current process id
+func RemovePidFile(path string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
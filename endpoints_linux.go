@@ -0,0 +1,18 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/vsockSocket"
+)
+
+var argVsockPort *uint
+
+func init() {
+	argVsockPort = flag.Uint("vsock-port", 0, "AF_VSOCK port to listen on for vsock mode")
+
+	sshAgentFromMap[vsockSocket.EndpointName] = func(ctx *agent.AgentContext) error {
+		return vsockSocket.ServeVsock(uint32(*argVsockPort), ctx)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build cgo
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/pkcs11Token"
+)
+
+var argPkcs11Config pkcs11Token.Config
+var argPkcs11Pin *string
+
+func init() {
+	flag.StringVar(&argPkcs11Config.Module, "pkcs11-module", "", "PKCS#11 library of the token for pkcs11 mode, for example /usr/lib/softhsm/libsofthsm2.so")
+	flag.StringVar(&argPkcs11Config.Token, "pkcs11-token", "", "label of the token for pkcs11 mode (default to the first token found)")
+	argPkcs11Pin = flag.String("pkcs11-pin", pkcs11Token.PIN_FROM_ASKPASS,
+		fmt.Sprintf("source of the token PIN for pkcs11 mode: %s (SSH_ASKPASS program), %s:PROGRAM, %sNAME or %sPATH",
+			pkcs11Token.PIN_FROM_ASKPASS, pkcs11Token.PIN_FROM_ASKPASS, pkcs11Token.PIN_FROM_ENV, pkcs11Token.PIN_FROM_FILE))
+
+	sshAgentToMap[pkcs11Token.EndpointName] = func(ctx *agent.AgentContext) error {
+		pin, err := pkcs11Token.NewPinPrompt(*argPkcs11Pin)
+		if err != nil {
+			return err
+		}
+		argPkcs11Config.Pin = pin
+
+		return pkcs11Token.ClientPkcs11(&argPkcs11Config, ctx)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/cygwinUnixSocket"
+	"github.com/amurzeau/ssh-agent-bridge/agent/namedPipe"
+	"github.com/amurzeau/ssh-agent-bridge/agent/pageant"
+	"github.com/amurzeau/ssh-agent-bridge/agent/pageantPipe"
+	"github.com/amurzeau/ssh-agent-bridge/agent/wslUnixSocket"
+)
+
+var argPageantTimeout *time.Duration
+
+func init() {
+	argPageantTimeout = flag.Duration("pageant-timeout", pageant.DEFAULT_QUERY_TIMEOUT, "time a pageant query waits for the upstream agent before failing, pageant clients are blocked meanwhile")
+
+	sshAgentFromMap[namedPipe.EndpointName] = func(ctx *agent.AgentContext) error {
+		return namedPipe.ServePipe(*argPipePath, ctx)
+	}
+	sshAgentFromMap[cygwinUnixSocket.EndpointName] = func(ctx *agent.AgentContext) error {
+		return cygwinUnixSocket.ServeUnixSocket(*argCygwinUnixSocketPath, ctx)
+	}
+	sshAgentFromMap[wslUnixSocket.EndpointName] = func(ctx *agent.AgentContext) error {
+		return wslUnixSocket.ServeWslUnixSocket(*argWslUnixSocketPath, ctx)
+	}
+	sshAgentFromMap[pageant.EndpointName] = func(ctx *agent.AgentContext) error {
+		return pageant.ServePageant(*argPageantTimeout, ctx)
+	}
+	sshAgentFromMap[pageantPipe.EndpointName] = func(ctx *agent.AgentContext) error {
+		return pageantPipe.ServePageantPipe(ctx)
+	}
+
+	listenerAuthSocks[namedPipe.EndpointName] = listenerAuthSock{
+		path:    func() string { return *argPipePath },
+		targets: []string{ENV_FOR_WINDOWS},
+	}
+	listenerAuthSocks[cygwinUnixSocket.EndpointName] = listenerAuthSock{
+		path:    func() string { return *argCygwinUnixSocketPath },
+		targets: []string{ENV_FOR_CYGWIN, ENV_FOR_MSYS},
+	}
+	listenerAuthSocks[wslUnixSocket.EndpointName] = listenerAuthSock{
+		path:    func() string { return *argWslUnixSocketPath },
+		targets: []string{ENV_FOR_WSL},
+	}
+
+	sshAgentToMap[namedPipe.EndpointName] = func(ctx *agent.AgentContext) error {
+		return namedPipe.ClientPipe(*argPipePath, ctx)
+	}
+	sshAgentToMap[cygwinUnixSocket.EndpointName] = func(ctx *agent.AgentContext) error {
+		return cygwinUnixSocket.ClientUnixSocket(*argCygwinUnixSocketPath, ctx)
+	}
+	sshAgentToMap[wslUnixSocket.EndpointName] = func(ctx *agent.AgentContext) error {
+		return wslUnixSocket.ClientWslUnixSocket(*argWslUnixSocketPath, ctx)
+	}
+	sshAgentToMap[pageant.EndpointName] = func(ctx *agent.AgentContext) error {
+		return pageant.ClientPageant(ctx)
+	}
+	sshAgentToMap[pageantPipe.EndpointName] = func(ctx *agent.AgentContext) error {
+		return pageantPipe.ClientPageantPipe(ctx)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent/containerSocket"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/amurzeau/ssh-agent-bridge/paths"
+)
+
+// Client environments of the env command
+const (
+	ENV_FOR_WINDOWS = "windows"
+	ENV_FOR_CYGWIN  = "cygwin"
+	ENV_FOR_MSYS    = "msys"
+	ENV_FOR_WSL     = "wsl"
+	ENV_FOR_UNIX    = "unix"
+)
+
+var envTargets = []string{ENV_FOR_WINDOWS, ENV_FOR_CYGWIN, ENV_FOR_MSYS, ENV_FOR_WSL, ENV_FOR_UNIX}
+
+// envPathConversions converts a listener native path to the path seen by clients
+var envPathConversions = map[string]func(path string) (string, error){
+	ENV_FOR_WINDOWS: func(path string) (string, error) {
+		return path, nil
+	},
+	ENV_FOR_CYGWIN: func(path string) (string, error) {
+		return cygwinMountTable(ENV_FOR_CYGWIN).FromWindows(path)
+	},
+	ENV_FOR_MSYS: func(path string) (string, error) {
+		return cygwinMountTable(ENV_FOR_MSYS).FromWindows(path)
+	},
+	ENV_FOR_WSL: func(path string) (string, error) {
+		return paths.DefaultWsl(*argWslDistro).FromWindows(path)
+	},
+	ENV_FOR_UNIX: func(path string) (string, error) {
+		return path, nil
+	},
+}
+
+// envShell prints shell commands
+type envShell struct {
+	comment func(text string) string
+	setenv  func(name string, value string) string
+	// target is the default client environment of the shell
+	target string
+}
+
+var envShells = map[string]envShell{
+	"bash": {
+		comment: func(text string) string { return "# " + text },
+		setenv: func(name string, value string) string {
+			return fmt.Sprintf("%s='%s'; export %s;", name, strings.ReplaceAll(value, "'", `'\''`), name)
+		},
+	},
+	"fish": {
+		comment: func(text string) string { return "# " + text },
+		setenv: func(name string, value string) string {
+			value = strings.ReplaceAll(value, `\`, `\\`)
+			return fmt.Sprintf("set -gx %s '%s';", name, strings.ReplaceAll(value, "'", `\'`))
+		},
+	},
+	"powershell": {
+		comment: func(text string) string { return "# " + text },
+		setenv: func(name string, value string) string {
+			return fmt.Sprintf("$env:%s = '%s'", name, strings.ReplaceAll(value, "'", "''"))
+		},
+		target: ENV_FOR_WINDOWS,
+	},
+	"cmd": {
+		comment: func(text string) string { return "REM " + text },
+		setenv: func(name string, value string) string {
+			return fmt.Sprintf(`set "%s=%s"`, name, value)
+		},
+		target: ENV_FOR_WINDOWS,
+	},
+}
+
+type envArguments struct {
+	shell  string
+	target string
+}
+
+// envArgs is set when running the env command
+var envArgs *envArguments
+
+func defaultEnvShell() string {
+	if strings.HasSuffix(os.Getenv("SHELL"), "fish") {
+		return "fish"
+	}
+	if runtime.GOOS == "windows" && os.Getenv("SHELL") == "" {
+		return "powershell"
+	}
+	return "bash"
+}
+
+func defaultEnvTarget(shell envShell) string {
+	if shell.target != "" {
+		return shell.target
+	}
+	if runtime.GOOS == "windows" {
+		// bash or fish on Windows, most likely Git Bash
+		return ENV_FOR_MSYS
+	}
+	return ENV_FOR_UNIX
+}
+
+// envListener is a listener usable by the clients of the env command
+type envListener struct {
+	name string
+	path string
+}
+
+// envListeners returns the listeners of --from usable from target with their native path
+func envListeners(target string) []envListener {
+	var listeners []envListener
+
+	for _, from := range fromEndpoints() {
+		if from == containerSocket.EndpointName {
+			if target == ENV_FOR_UNIX && *argContainerDir != "" {
+				sortedContainers := append([]string(nil), containers...)
+				sort.Strings(sortedContainers)
+				for _, container := range sortedContainers {
+					listeners = append(listeners, envListener{
+						name: containerSocket.ListenerName(container),
+						path: containerSocket.SocketPath(*argContainerDir, container),
+					})
+				}
+			}
+			continue
+		}
+
+		authSock, ok := listenerAuthSocks[from]
+		if !ok || !contains(authSock.targets, target) || authSock.path() == "" {
+			continue
+		}
+		listeners = append(listeners, envListener{name: from, path: authSock.path()})
+	}
+
+	return listeners
+}
+
+// runEnv prints shell commands setting SSH_AUTH_SOCK to a listener usable by clients, like ssh-agent -s
+func runEnv(args *envArguments) int {
+	shell, ok := envShells[args.shell]
+	if !ok {
+		log.Errorf("Bad --shell value %s, available: %s", args.shell, strings.Join(keys(envShells), ", "))
+		return EXIT_USAGE
+	}
+
+	target := args.target
+	if target == "" {
+		target = defaultEnvTarget(shell)
+	}
+	convert, ok := envPathConversions[target]
+	if !ok {
+		log.Errorf("Bad --for value %s, available: %s", target, strings.Join(envTargets, ", "))
+		return EXIT_USAGE
+	}
+
+	listeners := envListeners(target)
+	if len(listeners) == 0 {
+		log.Errorf("no listener in --from %s is usable from %s", *argFrom, target)
+		return EXIT_ERROR
+	}
+
+	// SSH_AUTH_SOCK can only hold one listener, show the others as comments
+	printed := 0
+	for _, listener := range listeners {
+		path, err := convert(listener.path)
+		if err != nil {
+			log.Errorf("listener %s: %v", listener.name, err)
+			continue
+		}
+
+		command := shell.setenv("SSH_AUTH_SOCK", path)
+		if printed > 0 {
+			command = shell.comment(command)
+		}
+		printed++
+		fmt.Println(shell.comment("listener " + listener.name))
+		fmt.Println(command)
+	}
+
+	return EXIT_OK
+}
@@ -1,10 +1,17 @@
 module github.com/amurzeau/ssh-agent-bridge
 
-go 1.18
+go 1.21
 
 require github.com/Microsoft/go-winio v0.5.2
 
-require github.com/getlantern/systray v1.2.1
+require (
+	github.com/atotto/clipboard v0.1.4
+	github.com/getlantern/systray v1.2.1
+	github.com/mdlayher/vsock v1.1.1
+	github.com/miekg/pkcs11 v1.1.2
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
+)
 
 require (
 	github.com/getlantern/context v0.0.0-20190109183933-c447772a6520 // indirect
@@ -14,6 +21,8 @@ require (
 	github.com/getlantern/hidden v0.0.0-20190325191715-f02dbb02be55 // indirect
 	github.com/getlantern/ops v0.0.0-20190325191751-d70cb0d6f85f // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/mdlayher/socket v0.2.0 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 )
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// filterLevels holds the default level and the per-subsystem levels, shared by all derived handlers
+type filterLevels struct {
+	lock       sync.RWMutex
+	level      slog.Level
+	subsystems map[string]slog.Level
+	sinks      []Sink
+}
+
+// filterHandler drops records below the level of their subsystem and writes others to every sink
+type filterHandler struct {
+	levels *filterLevels
+	// subsystem is the KEY_PACKAGE value given to With, if any
+	subsystem string
+	// derive applies WithAttrs and WithGroup calls, in order, to the sinks
+	derive []func(slog.Handler) slog.Handler
+	// grouped is set once WithGroup was called, attributes are then not top-level anymore
+	grouped bool
+}
+
+func newFilterHandler() *filterHandler {
+	return &filterHandler{
+		levels: &filterLevels{
+			level:      Info,
+			subsystems: map[string]slog.Level{},
+		},
+	}
+}
+
+func (h *filterHandler) setLevel(subsystem string, level slog.Level) {
+	h.levels.lock.Lock()
+	defer h.levels.lock.Unlock()
+
+	if subsystem == "" {
+		h.levels.level = level
+	} else {
+		h.levels.subsystems[subsystem] = level
+	}
+}
+
+// levelOf returns the level of subsystem, or the lowest of all levels if the subsystem is still unknown
+func (h *filterHandler) levelOf(subsystem string, known bool) slog.Level {
+	h.levels.lock.RLock()
+	defer h.levels.lock.RUnlock()
+
+	if level, ok := h.levels.subsystems[subsystem]; ok && subsystem != "" {
+		return level
+	}
+	if known {
+		return h.levels.level
+	}
+
+	lowest := h.levels.level
+	for _, level := range h.levels.subsystems {
+		if level < lowest {
+			lowest = level
+		}
+	}
+	return lowest
+}
+
+func (h *filterHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.levelOf(h.subsystem, h.subsystem != "")
+}
+
+func (h *filterHandler) Handle(ctx context.Context, record slog.Record) error {
+	subsystem := h.subsystem
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == KEY_PACKAGE {
+			subsystem = attr.Value.String()
+			return false
+		}
+		return true
+	})
+
+	if record.Level < h.levelOf(subsystem, true) {
+		return nil
+	}
+
+	h.levels.lock.RLock()
+	sinks := h.levels.sinks
+	h.levels.lock.RUnlock()
+
+	var errs []error
+	for _, sink := range sinks {
+		handler := sink.Handler
+		for _, derive := range h.derive {
+			handler = derive(handler)
+		}
+		if err := handler.Handle(ctx, record.Clone()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *filterHandler) with(derive func(slog.Handler) slog.Handler) *filterHandler {
+	clone := *h
+	clone.derive = append(append([]func(slog.Handler) slog.Handler(nil), h.derive...), derive)
+	return &clone
+}
+
+func (h *filterHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+	for _, attr := range attrs {
+		if attr.Key == KEY_PACKAGE && !h.grouped {
+			clone.subsystem = attr.Value.String()
+		}
+	}
+	return clone
+}
+
+func (h *filterHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+	clone.grouped = true
+	return clone
+}
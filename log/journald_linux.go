@@ -0,0 +1,79 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+// NewJournaldSink writes to the systemd journal with the native protocol, fields are kept as journal fields
+func NewJournaldSink() (Sink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JOURNALD_SOCKET, Net: "unixgram"})
+	if err != nil {
+		return Sink{}, err
+	}
+
+	handler := &recordHandler{
+		emit: func(level slog.Level, msg string, fields []slog.Attr) error {
+			var datagram bytes.Buffer
+			writeJournaldField(&datagram, "MESSAGE", msg)
+			writeJournaldField(&datagram, "PRIORITY", journaldPriority(level))
+			writeJournaldField(&datagram, "SYSLOG_IDENTIFIER", "ssh-agent-bridge")
+			for _, field := range fields {
+				writeJournaldField(&datagram, journaldFieldName(field.Key), field.Value.String())
+			}
+
+			_, err := conn.Write(datagram.Bytes())
+			return err
+		},
+	}
+
+	return Sink{Handler: handler, Closer: conn}, nil
+}
+
+// journaldPriority returns the syslog priority of a level
+func journaldPriority(level slog.Level) string {
+	switch {
+	case level >= Error:
+		return "3"
+	case level >= Warn:
+		return "4"
+	case level >= Info:
+		return "6"
+	default:
+		return "7"
+	}
+}
+
+// journaldFieldName converts a key to a journal field name, upper case letters, digits and underscores
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+
+	// Fields starting with _ are trusted fields set by journald
+	return "BRIDGE_" + strings.TrimLeft(name, "_")
+}
+
+func writeJournaldField(datagram *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		datagram.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	// Values with newlines are written with their length as little endian 64 bits integer
+	datagram.WriteString(name + "\n")
+	binary.Write(datagram, binary.LittleEndian, uint64(len(value)))
+	datagram.WriteString(value + "\n")
+}
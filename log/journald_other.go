@@ -0,0 +1,9 @@
+//go:build !linux
+
+package log
+
+import "errors"
+
+func NewJournaldSink() (Sink, error) {
+	return Sink{}, errors.New("journald is only available on Linux")
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// SetLevel sets the level of subsystems without a specific level
+func SetLevel(level slog.Level) {
+	root.setLevel("", level)
+}
+
+// SetSubsystemLevel sets the level of messages from a package, as in "pageant: ..." messages
+func SetSubsystemLevel(subsystem string, level slog.Level) {
+	root.setLevel(subsystem, level)
+}
+
+// ParseLevels parses a comma-separated list of levels like "info,pageant=debug,agentContext=error"
+// and applies them. A level without subsystem is the default level.
+func ParseLevels(spec string) error {
+	levels := map[string]slog.Level{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		subsystem, name, found := strings.Cut(item, "=")
+		if !found {
+			subsystem, name = "", item
+		}
+
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("log: bad level %s, available: debug, info, warn, error", name)
+		}
+		levels[subsystem] = level
+	}
+
+	for subsystem, level := range levels {
+		root.setLevel(subsystem, level)
+	}
+
+	return nil
+}
@@ -1,49 +1,125 @@
 package log
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
 )
 
-type LogLevel int64
+const (
+	Debug = slog.LevelDebug
+	Info  = slog.LevelInfo
+	Warn  = slog.LevelWarn
+	Error = slog.LevelError
+)
 
+// Attribute keys added to log records
 const (
-	Debug LogLevel = iota
-	Info
-	Error
+	KEY_PACKAGE    = "package"
+	KEY_LISTENER   = "listener"
+	KEY_CONNECTION = "connection"
 )
 
 var (
-	Level                 LogLevel = Info
-	UseMessageBoxForFatal bool     = true
+	UseMessageBoxForFatal bool = true
+
+	root       = newFilterHandler()
+	defaultLog = &Logger{logger: slog.New(root)}
+	// rePackageMsg matches "package: message" messages, package names are like pageant, tls-socket or agentContext
+	rePackageMsg = regexp.MustCompile(`(?s)^([A-Za-z][A-Za-z0-9_-]*): (.*)$`)
 )
 
-func Fatalf(format string, v ...any) {
-	str := fmt.Sprintf(format, v...)
-	outputDebugString(str)
+func init() {
+	// Until configured, log everything to stderr
+	SetSinks(NewStderrSink())
+}
+
+// Logger logs printf style messages with key/value fields
+type Logger struct {
+	logger *slog.Logger
+}
+
+// With returns a logger adding the key/value fields to each message, see KEY_PACKAGE, KEY_LISTENER and KEY_CONNECTION
+func With(args ...any) *Logger {
+	return defaultLog.With(args...)
+}
+
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{logger: l.logger.With(args...)}
+}
+
+// Slog returns the underlying slog logger
+func (l *Logger) Slog() *slog.Logger {
+	return l.logger
+}
+
+func (l *Logger) log(level slog.Level, format string, v ...any) {
+	if !l.logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, v...)
+	msg = strings.TrimSuffix(msg, "\n")
+
+	// Messages are written "package: message", make the package a field for per-subsystem levels
+	if match := rePackageMsg.FindStringSubmatch(msg); match != nil && l == defaultLog {
+		l.logger.Log(context.Background(), level, match[2], KEY_PACKAGE, match[1])
+		return
+	}
+	l.logger.Log(context.Background(), level, msg)
+}
+
+func (l *Logger) Debugf(format string, v ...any) {
+	l.log(Debug, format, v...)
+}
+
+func (l *Logger) Infof(format string, v ...any) {
+	l.log(Info, format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...any) {
+	l.log(Warn, format, v...)
+}
+
+func (l *Logger) Errorf(format string, v ...any) {
+	l.log(Error, format, v...)
+}
+
+// Alertf logs an error and shows it in a message box unless UseMessageBoxForFatal is false
+func Alertf(format string, v ...any) {
+	defaultLog.log(Error, format, v...)
 	if UseMessageBoxForFatal {
-		messageBox(str)
+		messageBox(fmt.Sprintf(format, v...))
 	}
-	log.Print(str)
+}
+
+// Exitf is Alertf followed by an exit with the given status code
+func Exitf(code int, format string, v ...any) {
+	Alertf(format, v...)
+	Close()
+	os.Exit(code)
+}
+
+// Fatalf is Exitf with status code 1
+func Fatalf(format string, v ...any) {
+	Exitf(1, format, v...)
 }
 
 func Errorf(format string, v ...any) {
-	if Level <= Error {
-		log.Printf("ERROR: "+format, v...)
-	}
-	outputDebugString(fmt.Sprintf(format, v...))
+	defaultLog.log(Error, format, v...)
+}
+
+func Warnf(format string, v ...any) {
+	defaultLog.log(Warn, format, v...)
 }
 
 func Infof(format string, v ...any) {
-	if Level <= Info {
-		log.Printf("info:  "+format, v...)
-	}
-	outputDebugString(fmt.Sprintf(format, v...))
+	defaultLog.log(Info, format, v...)
 }
 
 func Debugf(format string, v ...any) {
-	if Level <= Debug {
-		log.Printf("debug: "+format, v...)
-	}
-	outputDebugString(fmt.Sprintf(format, v...))
+	defaultLog.log(Debug, format, v...)
 }
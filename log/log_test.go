@@ -0,0 +1,102 @@
+package log
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// captureLogs writes the logs to the returned buffer until the end of the test, with the levels of spec
+func captureLogs(t *testing.T, spec string) *bytes.Buffer {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	SetSinks(textSink(&buffer, nil))
+
+	root.levels.lock.Lock()
+	level, subsystems := root.levels.level, root.levels.subsystems
+	root.levels.level, root.levels.subsystems = Info, map[string]slog.Level{}
+	root.levels.lock.Unlock()
+
+	t.Cleanup(func() {
+		SetSinks(NewStderrSink())
+		root.levels.lock.Lock()
+		root.levels.level, root.levels.subsystems = level, subsystems
+		root.levels.lock.Unlock()
+	})
+
+	if err := ParseLevels(spec); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	buffer := captureLogs(t, "info,tls-socket=debug,pageant=debug,agentContext=error")
+
+	Debugf("%s: tls debug", "tls-socket")
+	Debugf("%s: pageant debug", "pageant")
+	Debugf("%s: ssh debug", "ssh-tunnel")
+	Infof("%s: ssh info", "ssh-tunnel")
+	Infof("agentContext: context info")
+	Errorf("agentContext: context error")
+	Debugf("no package debug")
+	Infof("no package info")
+	With(KEY_PACKAGE, "tls-socket").Debugf("tls logger debug")
+	With(KEY_PACKAGE, "ssh-tunnel").Debugf("ssh logger debug")
+
+	output := buffer.String()
+	for _, want := range []string{"tls debug", "pageant debug", "ssh info", "context error", "no package info", "tls logger debug"} {
+		if !strings.Contains(output, "msg=\""+want+"\"") {
+			t.Errorf("%q not logged:\n%s", want, output)
+		}
+	}
+	for _, unwanted := range []string{"ssh debug", "context info", "no package debug", "ssh logger debug"} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("%q logged:\n%s", unwanted, output)
+		}
+	}
+	if !strings.Contains(output, "package=tls-socket") {
+		t.Errorf("package field missing:\n%s", output)
+	}
+}
+
+func TestPackageMessage(t *testing.T) {
+	tests := []struct {
+		msg     string
+		pkg     string
+		message string
+	}{
+		{"pageant: stopping", "pageant", "stopping"},
+		{"tls-socket: listening on :7422", "tls-socket", "listening on :7422"},
+		{"agentContext: listener pipe: running", "agentContext", "listener pipe: running"},
+		{"key_filter: refusing", "key_filter", "refusing"},
+		{"multi: first line\nsecond line", "multi", "first line\nsecond line"},
+		{"no package here", "", ""},
+		{"-leading: hyphen", "", ""},
+		{"two words: message", "", ""},
+		{"pageant:missing space", "", ""},
+	}
+
+	for _, test := range tests {
+		match := rePackageMsg.FindStringSubmatch(test.msg)
+		if test.pkg == "" {
+			if match != nil {
+				t.Errorf("%q matched as package %q", test.msg, match[1])
+			}
+			continue
+		}
+		if match == nil || match[1] != test.pkg || match[2] != test.message {
+			t.Errorf("%q = %q, want package %q and message %q", test.msg, match, test.pkg, test.message)
+		}
+	}
+}
+
+func TestParseLevelsError(t *testing.T) {
+	captureLogs(t, "")
+
+	if err := ParseLevels("info,pageant=verbose"); err == nil {
+		t.Error("bad level accepted")
+	}
+}
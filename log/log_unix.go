@@ -2,5 +2,8 @@
 
 package log
 
-func outputDebugString(s string) {}
-func messageBox(s string)        {}
+func messageBox(s string) {}
+
+func platformSinks() []Sink {
+	return nil
+}
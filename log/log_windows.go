@@ -1,6 +1,8 @@
 package log
 
 import (
+	"errors"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -18,6 +20,22 @@ func outputDebugString(s string) {
 	}
 }
 
+// debugStringWriter sends each record to OutputDebugString, readable with DebugView when there is no console
+type debugStringWriter struct{}
+
+func (debugStringWriter) Write(p []byte) (int, error) {
+	outputDebugString(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func platformSinks() []Sink {
+	return []Sink{textSink(debugStringWriter{}, nil)}
+}
+
+func NewSyslogSink() (Sink, error) {
+	return Sink{}, errors.New("syslog is not available on Windows")
+}
+
 func messageBox(msg string) {
 	titleUnicode, _ := syscall.UTF16PtrFromString("ssh-agent-bridge")
 	msgUnicode, _ := syscall.UTF16PtrFromString(msg)
@@ -0,0 +1,75 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// recordHandler flattens records to a message and a list of key/value fields for sinks like syslog and journald.
+// Keys of grouped attributes are joined with dots.
+type recordHandler struct {
+	emit   func(level slog.Level, msg string, fields []slog.Attr) error
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *recordHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *recordHandler) Handle(ctx context.Context, record slog.Record) error {
+	fields := append([]slog.Attr(nil), h.attrs...)
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = appendFlat(fields, h.prefix, attr)
+		return true
+	})
+	return h.emit(record.Level, record.Message, fields)
+}
+
+func (h *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, attr := range attrs {
+		clone.attrs = appendFlat(clone.attrs, h.prefix, attr)
+	}
+	return &clone
+}
+
+func (h *recordHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+func appendFlat(fields []slog.Attr, prefix string, attr slog.Attr) []slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if attr.Key != "" {
+			groupPrefix += attr.Key + "."
+		}
+		for _, child := range attr.Value.Group() {
+			fields = appendFlat(fields, groupPrefix, child)
+		}
+		return fields
+	}
+	if attr.Key == "" {
+		return fields
+	}
+	return append(fields, slog.Attr{Key: prefix + attr.Key, Value: attr.Value})
+}
+
+// formatText returns "msg key=value ..." for sinks without structured fields
+func formatText(msg string, fields []slog.Attr) string {
+	var builder strings.Builder
+	builder.WriteString(msg)
+	for _, field := range fields {
+		fmt.Fprintf(&builder, " %s=%q", field.Key, field.Value.String())
+	}
+	return builder.String()
+}
@@ -0,0 +1,119 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Names of the sinks accepted by OpenSink besides file paths
+const (
+	SINK_STDERR   = "stderr"
+	SINK_SYSLOG   = "syslog"
+	SINK_JOURNALD = "journald"
+)
+
+// Log files are rotated when they reach this size, keeping this number of old files
+const (
+	DEFAULT_LOG_FILE_MAX_SIZE  = 10 * 1024 * 1024
+	DEFAULT_LOG_FILE_MAX_FILES = 5
+)
+
+// Sink is a destination of log records, records given to a sink were already filtered by level
+type Sink struct {
+	Handler slog.Handler
+	// Closer is closed when the sink is replaced, can be nil
+	Closer io.Closer
+}
+
+// textSink formats records as key=value text
+func textSink(w io.Writer, closer io.Closer) Sink {
+	return Sink{
+		Handler: slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		Closer:  closer,
+	}
+}
+
+func NewStderrSink() Sink {
+	return textSink(os.Stderr, nil)
+}
+
+// NewFileSink appends to a log file rotated when it reaches maxSize bytes
+func NewFileSink(path string, maxSize int64, maxFiles int) (Sink, error) {
+	file, err := openRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return Sink{}, err
+	}
+	return textSink(file, file), nil
+}
+
+// OpenSink opens a sink by name, one of SINK_STDERR, SINK_SYSLOG, SINK_JOURNALD or a file path
+func OpenSink(name string) (Sink, error) {
+	switch name {
+	case SINK_STDERR:
+		return NewStderrSink(), nil
+	case SINK_SYSLOG:
+		return NewSyslogSink()
+	case SINK_JOURNALD:
+		return NewJournaldSink()
+	default:
+		return NewFileSink(name, DEFAULT_LOG_FILE_MAX_SIZE, DEFAULT_LOG_FILE_MAX_FILES)
+	}
+}
+
+// OpenSinks opens a comma-separated list of sinks, see OpenSink, and replaces the current sinks
+func OpenSinks(names string) error {
+	var sinks []Sink
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		sink, err := OpenSink(name)
+		if err != nil {
+			closeSinks(sinks)
+			return fmt.Errorf("log: can't open %s: %w", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	SetSinks(sinks...)
+	return nil
+}
+
+// SetSinks replaces the sinks, platform sinks like OutputDebugString on Windows are always added
+func SetSinks(sinks ...Sink) {
+	sinks = append(sinks, platformSinks()...)
+
+	root.levels.lock.Lock()
+	previous := root.levels.sinks
+	root.levels.sinks = sinks
+	root.levels.lock.Unlock()
+
+	closeSinks(previous)
+}
+
+// Close closes the sinks, messages are still logged to stderr afterwards
+func Close() error {
+	root.levels.lock.Lock()
+	previous := root.levels.sinks
+	root.levels.sinks = []Sink{NewStderrSink()}
+	root.levels.lock.Unlock()
+
+	return closeSinks(previous)
+}
+
+func closeSinks(sinks []Sink) error {
+	var errs []error
+	for _, sink := range sinks {
+		if sink.Closer != nil {
+			if err := sink.Closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
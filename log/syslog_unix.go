@@ -0,0 +1,34 @@
+//go:build !windows
+
+package log
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+// NewSyslogSink writes to the local syslog daemon
+func NewSyslogSink() (Sink, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "ssh-agent-bridge")
+	if err != nil {
+		return Sink{}, err
+	}
+
+	handler := &recordHandler{
+		emit: func(level slog.Level, msg string, fields []slog.Attr) error {
+			text := formatText(msg, fields)
+			switch {
+			case level >= Error:
+				return writer.Err(text)
+			case level >= Warn:
+				return writer.Warning(text)
+			case level >= Info:
+				return writer.Info(text)
+			default:
+				return writer.Debug(text)
+			}
+		},
+	}
+
+	return Sink{Handler: handler, Closer: writer}, nil
+}
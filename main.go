@@ -1,73 +1,112 @@
 package main
 
 import (
-	_ "embed"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
-	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/amurzeau/ssh-agent-bridge/agent"
-	"github.com/amurzeau/ssh-agent-bridge/agent/cygwinUnixSocket"
-	"github.com/amurzeau/ssh-agent-bridge/agent/namedPipe"
-	"github.com/amurzeau/ssh-agent-bridge/agent/pageant"
-	"github.com/amurzeau/ssh-agent-bridge/agent/pageantPipe"
-	"github.com/amurzeau/ssh-agent-bridge/agent/wslUnixSocket"
+	"github.com/amurzeau/ssh-agent-bridge/agent/assuanSocket"
+	"github.com/amurzeau/ssh-agent-bridge/agent/certificates"
+	"github.com/amurzeau/ssh-agent-bridge/agent/common"
+	"github.com/amurzeau/ssh-agent-bridge/agent/containerSocket"
+	"github.com/amurzeau/ssh-agent-bridge/agent/destinationConstraints"
+	"github.com/amurzeau/ssh-agent-bridge/agent/extensions"
+	"github.com/amurzeau/ssh-agent-bridge/agent/hostIdentities"
+	"github.com/amurzeau/ssh-agent-bridge/agent/identityCache"
+	"github.com/amurzeau/ssh-agent-bridge/agent/identityOrder"
+	"github.com/amurzeau/ssh-agent-bridge/agent/keyFilter"
+	"github.com/amurzeau/ssh-agent-bridge/agent/policy"
+	"github.com/amurzeau/ssh-agent-bridge/agent/readOnly"
+	"github.com/amurzeau/ssh-agent-bridge/agent/sshTunnel"
+	"github.com/amurzeau/ssh-agent-bridge/agent/tlsSocket"
+	"github.com/amurzeau/ssh-agent-bridge/agent/trace"
+	"github.com/amurzeau/ssh-agent-bridge/config"
+	"github.com/amurzeau/ssh-agent-bridge/daemon"
 	"github.com/amurzeau/ssh-agent-bridge/log"
-
-	"github.com/getlantern/systray"
+	"github.com/amurzeau/ssh-agent-bridge/status"
 )
 
-//go:embed assets/oxygen-status-wallet-open.ico
-var assetsOxygenStatusWalletOpen []byte
-
 var (
 	argFrom                 *string
 	argTo                   *string
 	argPipePath             *string
 	argCygwinUnixSocketPath *string
 	argWslUnixSocketPath    *string
+	argAssuanSocketPath     *string
+	argEnforceSessionBind   *bool
+	argInterceptConstraints *bool
+	argTlsListen            *string
+	argTlsConnect           *string
+	argTlsConfig            tlsSocket.Config
+	argSshConfig            sshTunnel.Config
+	argContainerDir         *string
+	argNoTray               *bool
+	argPidFile              *string
+	argIdleTimeout          *time.Duration
+	argTrace                *string
+	argIdentityCacheTTL     *time.Duration
+
+	// traceRecorder records queries when --trace is given
+	traceRecorder *trace.Recorder
+
+	// containers configured in the configuration file
+	containers []string
 
 	agentContext = agent.CreateAgent()
+	statusModel  *status.Model
+
+	// exitCode is set by stopWithExitCode
+	exitCode int32 = EXIT_OK
 )
 
-var sshAgentFromMap = map[string]func(*agent.AgentContext){
-	"pipe": func(ctx *agent.AgentContext) {
-		namedPipe.ServePipe(*argPipePath, ctx)
-	},
-	"cygwin": func(ctx *agent.AgentContext) {
-		cygwinUnixSocket.ServeUnixSocket(*argCygwinUnixSocketPath, ctx)
-	},
-	"wsl": func(ctx *agent.AgentContext) {
-		wslUnixSocket.ServeWslUnixSocket(*argWslUnixSocketPath, ctx)
+// Process exit codes
+const (
+	EXIT_OK               = 0
+	EXIT_ERROR            = 1
+	EXIT_USAGE            = 2
+	EXIT_UPSTREAM_FAILED  = 3
+	EXIT_LISTENERS_FAILED = 4
+)
+
+// Endpoints available on all platforms, platform specific ones are added by endpoints_*.go
+var sshAgentFromMap = map[string]agent.ServeFunction{
+	tlsSocket.EndpointName: func(ctx *agent.AgentContext) error {
+		return tlsSocket.ServeTls(*argTlsListen, &argTlsConfig, ctx)
 	},
-	"pageant": func(ctx *agent.AgentContext) {
-		pageant.ServePageant(ctx)
+	containerSocket.EndpointName: func(ctx *agent.AgentContext) error {
+		return containerSocket.ServeContainers(*argContainerDir, containers, ctx)
 	},
-	"pageant-pipe": func(ctx *agent.AgentContext) {
-		pageantPipe.ServePageantPipe(ctx)
+	assuanSocket.EndpointName: func(ctx *agent.AgentContext) error {
+		return assuanSocket.ServeAssuanSocket(*argAssuanSocketPath, ctx)
 	},
 }
 
+// listenerAuthSock is the SSH_AUTH_SOCK value clients use to connect to a listener
+type listenerAuthSock struct {
+	path func() string
+	// targets are the client environments able to use this socket, see --for of the env command
+	targets []string
+}
+
+// SSH_AUTH_SOCK of listeners, added by endpoints_*.go
+var listenerAuthSocks = map[string]listenerAuthSock{}
+
 var sshAgentToMap = map[string]func(*agent.AgentContext) error{
-	"pipe": func(ctx *agent.AgentContext) error {
-		return namedPipe.ClientPipe(*argPipePath, ctx)
-	},
-	"cygwin": func(ctx *agent.AgentContext) error {
-		return cygwinUnixSocket.ClientUnixSocket(*argCygwinUnixSocketPath, ctx)
+	tlsSocket.EndpointName: func(ctx *agent.AgentContext) error {
+		return tlsSocket.ClientTls(*argTlsConnect, &argTlsConfig, ctx)
 	},
-	"wsl": func(ctx *agent.AgentContext) error {
-		return wslUnixSocket.ClientWslUnixSocket(*argWslUnixSocketPath, ctx)
+	sshTunnel.EndpointName: func(ctx *agent.AgentContext) error {
+		return sshTunnel.ClientSshTunnel(&argSshConfig, ctx)
 	},
-	"pageant": func(ctx *agent.AgentContext) error {
-		return pageant.ClientPageant(ctx)
-	},
-	"pageant-pipe": func(ctx *agent.AgentContext) error {
-		return pageantPipe.ClientPageantPipe(ctx)
+	assuanSocket.EndpointName: func(ctx *agent.AgentContext) error {
+		return assuanSocket.ClientAssuanSocket(*argAssuanSocketPath, ctx)
 	},
 }
 
@@ -81,6 +120,15 @@ func keys[T any, Key comparable](m map[Key]T) []Key {
 	return keys
 }
 
+func contains[T comparable](l []T, item T) bool {
+	for _, other := range l {
+		if other == item {
+			return true
+		}
+	}
+	return false
+}
+
 func remove[T comparable](l []T, item T) []T {
 	for i, other := range l {
 		if other == item {
@@ -90,23 +138,108 @@ func remove[T comparable](l []T, item T) []T {
 	return l
 }
 
-var reCygwinTmpDir = regexp.MustCompile(`^/tmp`)
-var reCygwinDriveDir = regexp.MustCompile(`^(/cygdrive)?/([a-z])/`)
+// configureAgent adds the query processing middlewares to agentContext
+func configureAgent(cfg *config.Config) error {
+	agentContext.Use(statusModel.Middleware)
+
+	if cfg.Policy != nil {
+		accessPolicy, err := policy.New(*cfg.Policy)
+		if err != nil {
+			return err
+		}
+		agentContext.Use(accessPolicy.Middleware)
+	}
+
+	listeners := map[string]config.ListenerConfig{}
+	for name, listener := range cfg.Listeners {
+		if _, ok := sshAgentFromMap[name]; !ok {
+			return fmt.Errorf("config: unknown listener %s, available: %s",
+				name,
+				strings.Join(keys(sshAgentFromMap), ", "))
+		}
+		listeners[name] = listener
+	}
+	for name, listener := range cfg.Containers {
+		if err := containerSocket.CheckContainerName(name); err != nil {
+			return err
+		}
+		if !contains(containers, name) {
+			containers = append(containers, name)
+		}
+		// Containers can't manage the keys of the host unless explicitly allowed
+		if listener.ReadOnly == nil {
+			readOnly := true
+			listener.ReadOnly = &readOnly
+		}
+		listeners[containerSocket.ListenerName(name)] = listener
+	}
+
+	readOnlyFilter := readOnly.New()
+	identityFilter := keyFilter.New()
+	identityOrdering := identityOrder.New()
+	for name, listener := range listeners {
+		if err := identityOrdering.AddListener(name, listener.IdentityOrder, listener.MaxIdentities); err != nil {
+			return err
+		}
+		if listener.IsReadOnly(false) {
+			readOnlyFilter.AddListener(name, listener.SafeExtensions)
+		}
+		if listener.Keys != nil {
+			identityFilter.AddListener(name, listener.Keys, listener.SafeExtensions)
+		}
+	}
+	// Order and limit identities after all filters
+	agentContext.Use(identityOrdering.Middleware)
+
+	// Certificates are listed only if their key is visible after the filters
+	if len(cfg.Certificates) > 0 || cfg.CertificateAuthority != nil {
+		userCertificates, err := certificates.New(cfg.Certificates, cfg.CertificateAuthority)
+		if err != nil {
+			return err
+		}
+		agentContext.Use(userCertificates.Middleware)
+	}
+	agentContext.Use(readOnlyFilter.Middleware)
+	agentContext.Use(identityFilter.Middleware)
 
-func convertCygwinPathToWindows(path string) string {
-	tmpPath := os.TempDir()
+	hostIdentitySelection, err := hostIdentities.New(cfg.HostIdentities)
+	if err != nil {
+		return err
+	}
+	agentContext.Use(hostIdentitySelection.Middleware)
 
-	nativePath := path
-	nativePath = reCygwinTmpDir.ReplaceAllLiteralString(nativePath, tmpPath)
-	nativePath = reCygwinDriveDir.ReplaceAllString(nativePath, "$2:/")
+	agentExtensions := extensions.New()
+	agentExtensions.EnforceSessionBind = *argEnforceSessionBind
+	agentContext.Use(agentExtensions.Middleware)
 
-	if path != nativePath {
-		log.Debugf("converting cygwin path from %s to %s",
-			path,
-			nativePath)
+	keyDestinationConstraints, err := destinationConstraints.New(cfg.DestinationConstraints)
+	if err != nil {
+		return err
+	}
+	keyDestinationConstraints.InterceptAddedConstraints = *argInterceptConstraints
+	agentContext.Use(keyDestinationConstraints.Middleware)
+
+	// Cache the upstream answer, other middlewares filter it for each listener
+	cache := identityCache.New(*argIdentityCacheTTL, func() string { return agentContext.Upstream().Name })
+	for name, listener := range listeners {
+		if listener.NoIdentityCache {
+			cache.Bypass(name)
+		}
 	}
+	agentContext.OnUpstreamChange(func(status agent.UpstreamStatus) { cache.Invalidate() })
+	agentContext.Use(cache.Middleware)
+
+	// Record queries as they are sent to the upstream agent, after all other middlewares
+	if *argTrace != "" {
+		traceRecorder, err = trace.NewRecorder(*argTrace)
+		if err != nil {
+			return err
+		}
+		agentContext.Use(traceRecorder.Middleware)
+	}
+	agentContext.Use(statusModel.UpstreamMiddleware)
 
-	return nativePath
+	return nil
 }
 
 func main() {
@@ -121,23 +254,128 @@ func main() {
 
 	argPipePath = flag.String("pipe", `\\.\pipe\openssh-ssh-agent`, "path to the pipe to use for pipe mode")
 	argCygwinUnixSocketPath = flag.String("cygwin-socket", os.Getenv("SSH_AUTH_SOCK"), "path to the ssh-agent unix socket for cygwin-ssh-agent mode")
-	argWslUnixSocketPath = flag.String("wsl-socket", os.Getenv("SSH_AUTH_SOCK"), "path to the WSL ssh-agent unix socket for wsl-ssh-agent mode")
-
+	argWslUnixSocketPath = flag.String("wsl-socket", os.Getenv("SSH_AUTH_SOCK"), "path to the WSL ssh-agent unix socket for wsl-ssh-agent mode, a Windows path or a /mnt/x/ path")
+	argAssuanSocketPath = flag.String("assuan-socket", "", "path to the libassuan socket file for assuan mode, like the gpg-agent ssh socket shown by gpgconf --list-dirs agent-ssh-socket")
+	argCygwinRoot = flag.String("cygwin-root", "", "Cygwin or MSYS installation directory whose etc/fstab is used to convert paths, for example C:\\cygwin64")
+	argWslDistro = flag.String("wsl-distro", "", "WSL distribution name, used to convert WSL paths outside of /mnt to \\\\wsl$\\distro paths")
+
+	argTlsListen = flag.String("tls-listen", "", "address to listen on for tls mode, for example 0.0.0.0:7422")
+	argTlsConnect = flag.String("tls-connect", "", "address of the upstream agent for tls mode, for example workstation:7422")
+	flag.StringVar(&argTlsConfig.CertFile, "tls-cert", "", "PEM certificate file used by tls mode")
+	flag.StringVar(&argTlsConfig.KeyFile, "tls-key", "", "PEM private key file of --tls-cert")
+	flag.StringVar(&argTlsConfig.CAFile, "tls-ca", "", "PEM CA certificates used to verify the peer in tls mode")
+	argTlsPins := flag.String("tls-pin", "", "comma-separated list of SHA256 fingerprints of accepted peer certificates in tls mode")
+
+	flag.StringVar(&argSshConfig.Destination, "ssh-destination", "", "[user@]host[:port] of the remote host running the upstream agent for ssh mode")
+	argSshIdentities := flag.String("ssh-identity", "", "comma-separated list of private key files used to connect in ssh mode")
+	flag.StringVar(&argSshConfig.KnownHostsFile, "ssh-known-hosts", "", "known_hosts file used to check the remote host key in ssh mode (default ~/.ssh/known_hosts)")
+	flag.StringVar(&argSshConfig.RemoteSocket, "ssh-agent-socket", "", "path of the agent socket on the remote host for ssh mode (default to SSH_AUTH_SOCK of a remote login shell)")
+
+	argContainerDir = flag.String("container-dir", "", "directory where a socket is created for each container configured in the configuration file, for container mode")
+
+	argConfig := flag.String("config", "", "path to a JSON configuration file")
+	argEnforceSessionBind = flag.Bool("enforce-session-bind", false, "refuse signatures for a session other than the one bound with session-bind@openssh.com")
+	argInterceptConstraints = flag.Bool("intercept-destination-constraints", false, "accept keys added with destination constraints (ssh-add -h), they are enforced by the bridge only and lost when it restarts")
+	flag.DurationVar(&agentContext.ShutdownGracePeriod, "shutdown-grace", agent.DEFAULT_SHUTDOWN_GRACE_PERIOD, "time given to in-flight queries to complete when exiting")
 	argDebug := flag.Bool("debug", false, "enable debug logs")
 	argNoGuiError := flag.Bool("no-gui-error", false, "don't show a message box for fatal error")
+	argLogFile := flag.String("log-file", "", "comma-separated list of log destinations: stderr, syslog, journald (Linux) or a file path, rotated at 10MB (default stderr)")
+	argLogLevel := flag.String("log-level", "", "comma-separated list of log levels: debug, info, warn or error, for all logs or for a package like pageant=debug")
+	argNoTray = flag.Bool("no-tray", false, "run without tray icon, stop with SIGINT or SIGTERM")
+	argPidFile = flag.String("pid-file", "", "write the process id to this file")
+	argIdleTimeout = flag.Duration("idle-timeout", 0, "in headless mode, exit when no client is connected for this duration, for systemd socket activation")
+	argIdentityCacheTTL = flag.Duration("identity-cache-ttl", 0, "answer identity requests from a cache of the upstream agent answer for this duration, 0 to disable")
+	argTrace = flag.String("trace", "", "append each query sent to the upstream agent and its reply to this file, with secrets redacted, see the replay command")
+
+	// The env command takes the same arguments to find the listeners
+	envCommand := len(os.Args) > 1 && os.Args[1] == "env"
+	replayCommand := len(os.Args) > 1 && os.Args[1] == "replay"
+	if envCommand {
+		argShell := flag.String("shell", defaultEnvShell(), fmt.Sprintf("env command: shell syntax to print, available: %s", strings.Join(keys(envShells), ", ")))
+		argFor := flag.String("for", "", fmt.Sprintf("env command: environment of the clients, available: %s (default depends on --shell)", strings.Join(envTargets, ", ")))
+		flag.CommandLine.Parse(os.Args[2:])
+
+		envArgs = &envArguments{shell: *argShell, target: *argFor}
+	} else if replayCommand {
+		// The trace file comes first: replay TRACE --to ...
+		args := os.Args[2:]
+		tracePath := ""
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			tracePath, args = args[0], args[1:]
+		}
+		flag.CommandLine.Parse(args)
+		if tracePath == "" {
+			tracePath = flag.Arg(0)
+		}
 
-	flag.Parse()
+		replayArgs = &replayArguments{tracePath: tracePath}
+	} else {
+		flag.Parse()
+	}
+
+	if *argTlsPins != "" {
+		argTlsConfig.Pins = strings.Split(*argTlsPins, ",")
+	}
+
+	if *argSshIdentities != "" {
+		argSshConfig.IdentityFiles = strings.Split(*argSshIdentities, ",")
+	}
 
 	if *argDebug {
-		log.Level = log.Debug
+		log.SetLevel(log.Debug)
+	}
+
+	if *argLogLevel != "" {
+		if err := log.ParseLevels(*argLogLevel); err != nil {
+			log.Exitf(EXIT_USAGE, "%v", err)
+		}
 	}
 
-	if *argNoGuiError {
+	if *argLogFile != "" {
+		if err := log.OpenSinks(*argLogFile); err != nil {
+			log.Exitf(EXIT_USAGE, "%v", err)
+		}
+	}
+
+	if *argNoGuiError || *argNoTray || !trayAvailable || envCommand || replayCommand {
 		log.UseMessageBoxForFatal = false
 	}
 
-	if *argFrom == "" {
-		log.Fatalf("--from is required, see help with --help")
+	activatedFiles, err := daemon.ActivationFiles()
+	if err != nil {
+		log.Exitf(EXIT_USAGE, "%v", err)
+	}
+	common.SetActivatedFiles(activatedFiles)
+
+	activatedListeners := activatedListenerNames(activatedFiles)
+	if *argFrom == "" && len(activatedListeners) > 0 {
+		// Listen on the sockets passed by systemd by default
+		*argFrom = strings.Join(activatedListeners, ",")
+	}
+
+	if envCommand && *argFrom == "" {
+		*argFrom = "all"
+	}
+
+	if *argFrom == "" && !replayCommand {
+		log.Exitf(EXIT_USAGE, "--from is required, see help with --help")
+	}
+
+	statusModel = status.New(*argTo)
+	statusModel.Attach(&agentContext)
+	agentContext.SetUpstream(*argTo)
+
+	cfg := &config.Config{}
+	if *argConfig != "" {
+		var err error
+		cfg, err = config.Load(*argConfig)
+		if err != nil {
+			log.Exitf(EXIT_ERROR, "%v", err)
+		}
+	}
+
+	if err := configureAgent(cfg); err != nil {
+		log.Exitf(EXIT_ERROR, "%v", err)
 	}
 
 	// By default, listen on every possible supported endpoint except the one used as upstream agent
@@ -147,60 +385,79 @@ func main() {
 		*argFrom = strings.Join(fromKeys, ",")
 	}
 
-	// Convert cygwin/msys paths to native Windows path
+	if err := loadCygwinMounts(); err != nil {
+		log.Exitf(EXIT_ERROR, "%v", err)
+	}
+
+	*argAssuanSocketPath = expandEnv(*argAssuanSocketPath)
+
+	// Convert cygwin/msys and WSL paths to native Windows path
 	if runtime.GOOS == "windows" {
-		*argCygwinUnixSocketPath = convertCygwinPathToWindows(*argCygwinUnixSocketPath)
-		*argWslUnixSocketPath = convertCygwinPathToWindows(*argWslUnixSocketPath)
+		var err error
+		if *argCygwinUnixSocketPath, err = convertCygwinPathToWindows(*argCygwinUnixSocketPath); err != nil {
+			log.Exitf(EXIT_USAGE, "--cygwin-socket: %v", err)
+		}
+		if *argWslUnixSocketPath, err = convertWslPathToWindows(*argWslUnixSocketPath); err != nil {
+			log.Exitf(EXIT_USAGE, "--wsl-socket: %v", err)
+		}
 	}
 
-	systray.Run(onReady, onExit)
-}
+	if envCommand {
+		os.Exit(runEnv(envArgs))
+	}
 
-func onReady() {
-	systray.SetIcon(assetsOxygenStatusWalletOpen)
-	systray.SetTitle("SSH Agent Bridge")
-	systray.SetTooltip("SSH Agent Bridge")
-	mExit := systray.AddMenuItem("Exit", "Exit SSH Agent Bridge")
-
-	go func() {
-		<-mExit.ClickedCh
-		agentContext.Stop()
-		<-mExit.ClickedCh
-		log.Debugf("agentContext: hard exit")
-		os.Exit(0)
-	}()
-
-	go func() {
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		<-sigs
-		agentContext.Stop()
-		<-sigs
-		log.Debugf("agentContext: hard exit")
-		os.Exit(0)
-	}()
-
-	go func() {
-		<-agentContext.Done()
-		agentContext.Wait()
-		systray.Quit()
-	}()
+	if replayCommand {
+		os.Exit(runReplay(replayArgs))
+	}
 
-	// Listen on all requested endpoints
-	fromValues := strings.Split(strings.ReplaceAll(*argFrom, " ", ""), ",")
+	// Show SSH_AUTH_SOCK values as seen by the first client environment of each listener in the tray
+	for _, from := range fromEndpoints() {
+		authSock, ok := listenerAuthSocks[from]
+		if !ok || len(authSock.targets) == 0 {
+			continue
+		}
+		if path, err := envPathConversions[authSock.targets[0]](authSock.path()); err == nil {
+			statusModel.SetAuthSock(from, path)
+		}
+	}
 
-	for _, from := range fromValues {
+	if *argPidFile != "" {
+		if err := daemon.WritePidFile(*argPidFile); err != nil {
+			log.Exitf(EXIT_ERROR, "%v", err)
+		}
+	}
+
+	if *argNoTray || !trayAvailable {
+		runDaemon()
+	} else {
+		runTray()
+	}
+
+	if *argPidFile != "" {
+		daemon.RemovePidFile(*argPidFile)
+	}
+
+	if traceRecorder != nil {
+		traceRecorder.Close()
+	}
+
+	log.Close()
+	os.Exit(int(atomic.LoadInt32(&exitCode)))
+}
+
+// startAgent starts the listeners and the upstream agent
+func startAgent() {
+	// Listen on all requested endpoints
+	for _, from := range fromEndpoints() {
 		if serverHandler, ok := sshAgentFromMap[from]; ok {
 			log.Infof("Handling ssh agent queries from %s", from)
 
-			agentContext.Go(func() {
-				serverHandler(&agentContext)
-			})
+			agentContext.Serve(from, serverHandler)
 		} else {
-			log.Fatalf("Bad --from value %s, available: %s",
+			log.Alertf("Bad --from value %s, available: %s",
 				from,
 				strings.Join(keys(sshAgentFromMap), ", "))
-			agentContext.Stop()
+			stopWithExitCode(EXIT_USAGE)
 		}
 	}
 
@@ -210,18 +467,70 @@ func onReady() {
 		agentContext.Go(func() {
 			err := clientHandler(&agentContext)
 			if err != nil {
-				log.Fatalf("error with upstream agent: %v", err)
-				agentContext.Stop()
+				log.Alertf("error with upstream agent: %v", err)
+				stopWithExitCode(EXIT_UPSTREAM_FAILED)
 			}
 		})
 	} else {
-		log.Fatalf("Bad --to value %s, available: %s",
+		log.Alertf("Bad --to value %s, available: %s",
 			*argTo,
 			strings.Join(keys(sshAgentToMap), ", "))
-		agentContext.Stop()
+		stopWithExitCode(EXIT_USAGE)
+	}
+}
+
+// handleSignals stops gracefully on the first SIGINT or SIGTERM, and exits immediately on the second one
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	agentContext.Stop()
+	<-sigs
+	log.Debugf("agentContext: hard exit")
+	if traceRecorder != nil {
+		traceRecorder.Close()
+	}
+
+	log.Close()
+	os.Exit(int(atomic.LoadInt32(&exitCode)))
+}
+
+// stopWithExitCode stops the agent, the process exits with the code of the first failure
+func stopWithExitCode(code int32) {
+	atomic.CompareAndSwapInt32(&exitCode, EXIT_OK, code)
+	agentContext.Stop()
+}
+
+// activatedListenerNames returns the listeners of the sockets passed by systemd,
+// and adds activated containers missing from the configuration file
+func activatedListenerNames(files map[string]*os.File) []string {
+	var names []string
+	for activationName := range files {
+		name := common.ListenerName(activationName)
+
+		if container := strings.TrimPrefix(name, containerSocket.EndpointName+":"); container != name {
+			if err := containerSocket.CheckContainerName(container); err != nil {
+				log.Errorf("%v", err)
+				continue
+			}
+			if !contains(containers, container) {
+				containers = append(containers, container)
+			}
+			name = containerSocket.EndpointName
+		} else if _, ok := sshAgentFromMap[name]; !ok {
+			log.Errorf("socket %s passed by systemd doesn't match any listener, available: %s",
+				activationName,
+				strings.Join(keys(sshAgentFromMap), ", "))
+			continue
+		}
+
+		if !contains(names, name) {
+			names = append(names, name)
+		}
 	}
+	return names
 }
 
-func onExit() {
-	os.Exit(0)
+func fromEndpoints() []string {
+	return strings.Split(strings.ReplaceAll(*argFrom, " ", ""), ",")
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/amurzeau/ssh-agent-bridge/paths"
+)
+
+var (
+	argCygwinRoot *string
+	argWslDistro  *string
+
+	// cygwinMounts is the mount table of --cygwin-root, nil to use the Cygwin and MSYS defaults
+	cygwinMounts *paths.MountTable
+)
+
+func loadCygwinMounts() error {
+	if *argCygwinRoot == "" {
+		return nil
+	}
+
+	table, err := paths.LoadMountTable(expandEnv(*argCygwinRoot), os.TempDir())
+	if err != nil {
+		return err
+	}
+	cygwinMounts = table
+
+	return nil
+}
+
+// cygwinMountTable returns the mount table used for target, ENV_FOR_CYGWIN or ENV_FOR_MSYS
+func cygwinMountTable(target string) *paths.MountTable {
+	if cygwinMounts != nil {
+		return cygwinMounts
+	}
+	if target == ENV_FOR_CYGWIN {
+		return paths.CygwinMountTable()
+	}
+	return paths.MsysMountTable(os.TempDir())
+}
+
+func expandEnv(path string) string {
+	return paths.ExpandEnv(path, os.LookupEnv)
+}
+
+// convertCygwinPathToWindows converts a Cygwin or MSYS path to a native Windows path,
+// both /cygdrive/c/ and /c/ forms are accepted unless --cygwin-root is given
+func convertCygwinPathToWindows(path string) (string, error) {
+	path = expandEnv(path)
+	if path == "" || paths.IsWindowsAbs(path) {
+		return path, nil
+	}
+
+	var nativePath string
+	var err error
+	for _, target := range []string{ENV_FOR_MSYS, ENV_FOR_CYGWIN} {
+		nativePath, err = cygwinMountTable(target).ToWindows(path)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w, use a Windows path or --cygwin-root", err)
+	}
+
+	log.Debugf("converting cygwin path from %s to %s", path, nativePath)
+
+	return nativePath, nil
+}
+
+// convertWslPathToWindows converts a WSL path to a native Windows path
+func convertWslPathToWindows(path string) (string, error) {
+	path = expandEnv(path)
+	if path == "" || paths.IsWindowsAbs(path) {
+		return path, nil
+	}
+
+	nativePath, err := paths.DefaultWsl(*argWslDistro).ToWindows(path)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("converting WSL path from %s to %s", path, nativePath)
+
+	return nativePath, nil
+}
@@ -0,0 +1,217 @@
+package paths
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Mount maps a POSIX mount point of a Cygwin or MSYS installation to a Windows directory
+type Mount struct {
+	Posix   string
+	Windows string
+}
+
+// MountTable describes how a Cygwin or MSYS installation maps POSIX paths to Windows paths
+type MountTable struct {
+	// CygdrivePrefix is the directory of drive letters, "/cygdrive" for Cygwin and "/" for MSYS
+	CygdrivePrefix string
+	Mounts         []Mount
+}
+
+// CygwinMountTable returns the default mount table of Cygwin, without the installation mounts
+func CygwinMountTable() *MountTable {
+	return &MountTable{CygdrivePrefix: "/cygdrive"}
+}
+
+// MsysMountTable returns the default mount table of MSYS2 and Git for Windows, without the installation mounts.
+// /tmp is the user temporary directory.
+func MsysMountTable(tempDir string) *MountTable {
+	table := &MountTable{CygdrivePrefix: "/"}
+	table.AddMount("/tmp", tempDir)
+	return table
+}
+
+// AddMount adds or replaces a mount point
+func (t *MountTable) AddMount(posix string, windows string) {
+	posix = join(posix, "")
+	windows = strings.TrimSuffix(toSlash(windows), "/")
+
+	for i, mount := range t.Mounts {
+		if mount.Posix == posix {
+			t.Mounts[i].Windows = windows
+			return
+		}
+	}
+	t.Mounts = append(t.Mounts, Mount{Posix: posix, Windows: windows})
+
+	// Longest mount points first so nested mounts match before their parent
+	sort.SliceStable(t.Mounts, func(i, j int) bool { return len(t.Mounts[i].Posix) > len(t.Mounts[j].Posix) })
+}
+
+// LoadMountTable reads the mount table of the Cygwin or MSYS installation in root from root/etc/fstab
+func LoadMountTable(root string, tempDir string) (*MountTable, error) {
+	fstabPath := strings.TrimSuffix(toSlash(root), "/") + "/etc/fstab"
+
+	file, err := os.Open(fstabPath)
+	if err != nil {
+		return nil, fmt.Errorf("paths: can't open %s: %w", fstabPath, err)
+	}
+	defer file.Close()
+
+	table, err := ParseFstab(file, root, tempDir)
+	if err != nil {
+		return nil, fmt.Errorf("paths: %s: %w", fstabPath, err)
+	}
+	return table, nil
+}
+
+// ParseFstab reads a Cygwin fstab, the installation root is mounted on /, /usr/bin and /usr/lib like Cygwin does.
+// See https://cygwin.com/cygwin-ug-net/using.html#mount-table
+func ParseFstab(r io.Reader, root string, tempDir string) (*MountTable, error) {
+	table := CygwinMountTable()
+
+	root = strings.TrimSuffix(toSlash(root), "/")
+	table.AddMount("/", root)
+	table.AddMount("/usr/bin", root+"/bin")
+	table.AddMount("/usr/lib", root+"/lib")
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 fields, got %d", line, len(fields))
+		}
+
+		device := unescapeFstab(fields[0])
+		mountPoint := unescapeFstab(fields[1])
+		fsType := fields[2]
+
+		if !strings.HasPrefix(mountPoint, "/") {
+			return nil, fmt.Errorf("line %d: mount point %s is not absolute", line, mountPoint)
+		}
+
+		switch fsType {
+		case "cygdrive":
+			table.CygdrivePrefix = join(mountPoint, "")
+		case "usertemp":
+			table.AddMount(mountPoint, tempDir)
+		default:
+			if !IsWindowsAbs(device) {
+				return nil, fmt.Errorf("line %d: %s is not a Windows path", line, device)
+			}
+			table.AddMount(mountPoint, device)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// unescapeFstab decodes octal escapes like \040 for spaces
+func unescapeFstab(field string) string {
+	var builder strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) && isOctal(field[i+1]) && isOctal(field[i+2]) && isOctal(field[i+3]) {
+			builder.WriteByte((field[i+1]-'0')<<6 | (field[i+2]-'0')<<3 | (field[i+3] - '0'))
+			i += 3
+			continue
+		}
+		builder.WriteByte(field[i])
+	}
+	return builder.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// ToWindows converts a POSIX path of the installation to a Windows path with backslashes.
+// UNC paths are written //server/share. Relative paths only get their separators converted.
+func (t *MountTable) ToWindows(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return FromSlash(path), nil
+	}
+
+	if strings.HasPrefix(path, "//") {
+		return FromSlash(path), nil
+	}
+
+	// Mount points except / have priority over drive letters
+	for _, mount := range t.Mounts {
+		if mount.Posix != "/" && hasPrefix(path, mount.Posix) {
+			return FromSlash(join(mount.Windows, path[len(mount.Posix):])), nil
+		}
+	}
+
+	if drive, rest, ok := t.cutCygdrive(path); ok {
+		return FromSlash(drive + ":" + join("/", rest)), nil
+	}
+
+	for _, mount := range t.Mounts {
+		if mount.Posix == "/" {
+			return FromSlash(join(mount.Windows, path)), nil
+		}
+	}
+
+	return "", fmt.Errorf("paths: %s: %w, it's not under a mount point or %s", path, ErrNotConvertible, t.CygdrivePrefix)
+}
+
+// cutCygdrive splits /cygdrive/c/rest to C and /rest
+func (t *MountTable) cutCygdrive(path string) (drive string, rest string, ok bool) {
+	prefix := strings.TrimSuffix(t.CygdrivePrefix, "/") + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", "", false
+	}
+
+	path = path[len(prefix):]
+	if len(path) == 0 || (len(path) > 1 && path[1] != '/') {
+		return "", "", false
+	}
+
+	drive = driveLetter(path[:1] + ":/")
+	if drive == "" {
+		return "", "", false
+	}
+	return drive, path[1:], true
+}
+
+// FromWindows converts a Windows path to a POSIX path of the installation
+func (t *MountTable) FromWindows(path string) (string, error) {
+	if !IsWindowsAbs(path) {
+		return strings.ReplaceAll(path, `\`, "/"), nil
+	}
+
+	path = toSlash(path)
+	if strings.HasPrefix(path, "//") {
+		return path, nil
+	}
+
+	// Longest Windows directory first
+	mounts := append([]Mount(nil), t.Mounts...)
+	sort.SliceStable(mounts, func(i, j int) bool { return len(mounts[i].Windows) > len(mounts[j].Windows) })
+
+	for _, mount := range mounts {
+		if hasPrefixFold(path, mount.Windows) {
+			return join(mount.Posix, path[len(mount.Windows):]), nil
+		}
+	}
+
+	drive := driveLetter(path)
+	if drive == "" {
+		return "", fmt.Errorf("paths: %s: %w", path, ErrNotConvertible)
+	}
+
+	return join(join(t.CygdrivePrefix, "/"+strings.ToLower(drive)), path[2:]), nil
+}
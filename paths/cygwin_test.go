@@ -0,0 +1,142 @@
+package paths
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testFstab = `# Cygwin fstab
+none /cygdrive cygdrive binary,posix=0,user 0 0
+
+C:/Projects /home/me/projects ntfs binary 0 0
+C:/My\040Documents /docs ntfs binary 0 0
+none /tmp usertemp binary,posix=0 0 0
+`
+
+func TestParseFstab(t *testing.T) {
+	table, err := ParseFstab(strings.NewReader(testFstab), `C:\cygwin64\`, `C:\Users\me\AppData\Local\Temp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if table.CygdrivePrefix != "/cygdrive" {
+		t.Errorf("cygdrive prefix = %q", table.CygdrivePrefix)
+	}
+
+	want := map[string]string{
+		"/":                 "C:/cygwin64",
+		"/usr/bin":          "C:/cygwin64/bin",
+		"/usr/lib":          "C:/cygwin64/lib",
+		"/home/me/projects": "C:/Projects",
+		"/docs":             "C:/My Documents",
+		"/tmp":              "C:/Users/me/AppData/Local/Temp",
+	}
+	if len(table.Mounts) != len(want) {
+		t.Errorf("mounts = %v, want %v", table.Mounts, want)
+	}
+	for i, mount := range table.Mounts {
+		if want[mount.Posix] != mount.Windows {
+			t.Errorf("mount %s = %s, want %s", mount.Posix, mount.Windows, want[mount.Posix])
+		}
+		if i > 0 && len(mount.Posix) > len(table.Mounts[i-1].Posix) {
+			t.Errorf("mount %s is after the shorter %s", mount.Posix, table.Mounts[i-1].Posix)
+		}
+	}
+}
+
+func TestParseFstabErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		fstab string
+	}{
+		{"missing fields", "C:/x /x\n"},
+		{"relative mount point", "C:/x x ntfs binary 0 0\n"},
+		{"not a Windows path", "/x /y ntfs binary 0 0\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseFstab(strings.NewReader(test.fstab), `C:\cygwin64`, `C:\Temp`); err == nil {
+				t.Error("invalid fstab accepted")
+			}
+		})
+	}
+}
+
+func TestMountTableToWindows(t *testing.T) {
+	cygwin, err := ParseFstab(strings.NewReader(testFstab), `C:\cygwin64`, `C:\Temp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msys := MsysMountTable(`C:\Users\me\AppData\Local\Temp`)
+
+	tests := []struct {
+		name  string
+		table *MountTable
+		path  string
+		want  string
+		err   error
+	}{
+		{"cygdrive", cygwin, "/cygdrive/c/Users/me/agent.sock", `C:\Users\me\agent.sock`, nil},
+		{"cygdrive root", cygwin, "/cygdrive/d", `D:\`, nil},
+		{"installation", cygwin, "/home/me/.ssh/agent.sock", `C:\cygwin64\home\me\.ssh\agent.sock`, nil},
+		{"installation root", cygwin, "/", `C:\cygwin64`, nil},
+		{"usr/bin", cygwin, "/usr/bin/ssh", `C:\cygwin64\bin\ssh`, nil},
+		{"nested mount", cygwin, "/home/me/projects/x", `C:\Projects\x`, nil},
+		{"mount boundary", cygwin, "/home/me/projectsx", `C:\cygwin64\home\me\projectsx`, nil},
+		{"escaped mount", cygwin, "/docs/agent.sock", `C:\My Documents\agent.sock`, nil},
+		{"usertemp", cygwin, "/tmp/agent.sock", `C:\Temp\agent.sock`, nil},
+		{"relative", cygwin, "relative/agent.sock", `relative\agent.sock`, nil},
+		{"unc", cygwin, "//server/share/agent.sock", `\\server\share\agent.sock`, nil},
+		{"msys drive", msys, "/c/Users/me/agent.sock", `C:\Users\me\agent.sock`, nil},
+		{"msys tmp", msys, "/tmp/agent.sock", `C:\Users\me\AppData\Local\Temp\agent.sock`, nil},
+		{"msys not a drive", msys, "/home/me/agent.sock", "", ErrNotConvertible},
+		{"cygwin without installation", CygwinMountTable(), "/home/me/agent.sock", "", ErrNotConvertible},
+		{"cygwin without installation, msys path", CygwinMountTable(), "/c/Users", "", ErrNotConvertible},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.table.ToWindows(test.path)
+			if !errors.Is(err, test.err) || got != test.want {
+				t.Errorf("ToWindows(%q) = %q, %v, want %q, %v", test.path, got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestMountTableFromWindows(t *testing.T) {
+	cygwin, err := ParseFstab(strings.NewReader(testFstab), `C:\cygwin64`, `C:\Temp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msys := MsysMountTable(`C:\Users\me\AppData\Local\Temp`)
+
+	tests := []struct {
+		name  string
+		table *MountTable
+		path  string
+		want  string
+	}{
+		{"drive", cygwin, `D:\Users\me\agent.sock`, "/cygdrive/d/Users/me/agent.sock"},
+		{"installation", cygwin, `C:\cygwin64\home\me`, "/home/me"},
+		{"installation ignoring case", cygwin, `c:\CYGWIN64\home\me`, "/home/me"},
+		{"usr/bin", cygwin, `C:\cygwin64\bin\ssh`, "/usr/bin/ssh"},
+		{"nested mount", cygwin, `C:\Projects\x`, "/home/me/projects/x"},
+		{"extended length", cygwin, `\\?\C:\Projects\x`, "/home/me/projects/x"},
+		{"unc", cygwin, `\\server\share\x`, "//server/share/x"},
+		{"relative", cygwin, `relative\x`, "relative/x"},
+		{"msys drive", msys, `C:\Users\me\agent.sock`, "/c/Users/me/agent.sock"},
+		{"msys tmp", msys, `C:\Users\me\AppData\Local\Temp\agent.sock`, "/tmp/agent.sock"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.table.FromWindows(test.path)
+			if err != nil || got != test.want {
+				t.Errorf("FromWindows(%q) = %q, %v, want %q", test.path, got, err, test.want)
+			}
+		})
+	}
+}
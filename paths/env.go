@@ -0,0 +1,50 @@
+package paths
+
+import (
+	"os"
+	"strings"
+)
+
+// ExpandEnv replaces Windows %VAR% and POSIX $VAR or ${VAR} variables using getenv.
+// Undefined %VAR% are kept like cmd does. Values are inserted as is, they are not expanded again.
+func ExpandEnv(path string, getenv func(name string) (string, bool)) string {
+	var builder strings.Builder
+	// literal is the text of path since the last %VAR% value, where $VAR are expanded
+	var literal strings.Builder
+
+	flushLiteral := func() {
+		builder.WriteString(os.Expand(literal.String(), func(name string) string {
+			value, _ := getenv(name)
+			return value
+		}))
+		literal.Reset()
+	}
+
+	rest := path
+	for {
+		start := strings.IndexByte(rest, '%')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start+1:], '%')
+		if end < 0 {
+			break
+		}
+		end += start + 1
+
+		literal.WriteString(rest[:start])
+		if value, ok := getenv(rest[start+1 : end]); ok && end > start+1 {
+			flushLiteral()
+			builder.WriteString(value)
+			rest = rest[end+1:]
+		} else {
+			// Keep the first % and look for a variable starting at the second one
+			literal.WriteByte('%')
+			rest = rest[start+1:]
+		}
+	}
+	literal.WriteString(rest)
+	flushLiteral()
+
+	return builder.String()
+}
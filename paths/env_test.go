@@ -0,0 +1,50 @@
+package paths
+
+import "testing"
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{
+		"USERPROFILE": `C:\Users\me`,
+		"HOME":        "/home/me",
+		"EMPTY":       "",
+		"DOLLAR":      `C:\Users\$HOME`,
+		"PERCENT":     "%HOME%",
+		"BRACES":      "${HOME}",
+	}
+	getenv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{`C:\plain\path`, `C:\plain\path`},
+		{`%USERPROFILE%\.ssh\agent`, `C:\Users\me\.ssh\agent`},
+		{`$HOME/.ssh/agent`, "/home/me/.ssh/agent"},
+		{`${HOME}/.ssh/agent`, "/home/me/.ssh/agent"},
+		{`%USERPROFILE%\$HOME`, `C:\Users\me\/home/me`},
+		{`%EMPTY%x`, "x"},
+		{`$UNDEFINED/x`, "/x"},
+		{`%UNDEFINED%\x`, `%UNDEFINED%\x`},
+		{`100%`, `100%`},
+		{`%%USERPROFILE%`, `%C:\Users\me`},
+		{`%UNDEFINED%USERPROFILE%`, `%UNDEFINEDC:\Users\me`},
+		{`%%`, `%%`},
+		// Values are not expanded again
+		{`%DOLLAR%\x`, `C:\Users\$HOME\x`},
+		{`%BRACES%`, "${HOME}"},
+		{`$PERCENT`, "%HOME%"},
+		{`$HOME%DOLLAR%$HOME`, `/home/meC:\Users\$HOME/home/me`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if got := ExpandEnv(test.path, getenv); got != test.want {
+				t.Errorf("ExpandEnv(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package paths
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"~", home},
+		{"~/.ssh/known_hosts", filepath.Join(home, ".ssh", "known_hosts")},
+		{"/etc/ssh/known_hosts", "/etc/ssh/known_hosts"},
+		{"~other/.ssh", "~other/.ssh"},
+		{"known_hosts", "known_hosts"},
+	}
+
+	for _, test := range tests {
+		got, err := ExpandHome(test.path)
+		if err != nil || got != test.want {
+			t.Errorf("ExpandHome(%q) = %q, %v, want %q", test.path, got, err, test.want)
+		}
+	}
+}
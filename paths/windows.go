@@ -0,0 +1,84 @@
+package paths
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrNotConvertible = errors.New("path can't be converted")
+
+// IsWindowsAbs returns true for paths starting with a drive letter (C:\ or C:/) or UNC paths (\\server\share)
+func IsWindowsAbs(path string) bool {
+	return driveLetter(path) != "" || isUNC(path)
+}
+
+// driveLetter returns the upper case drive letter of an absolute Windows path, or "" if there is none
+func driveLetter(path string) string {
+	if len(path) < 3 || path[1] != ':' || (path[2] != '\\' && path[2] != '/') {
+		return ""
+	}
+
+	letter := path[0]
+	if letter >= 'a' && letter <= 'z' {
+		letter -= 'a' - 'A'
+	}
+	if letter < 'A' || letter > 'Z' {
+		return ""
+	}
+	return string(letter)
+}
+
+func isUNC(path string) bool {
+	return len(path) > 2 && path[0] == '\\' && path[1] == '\\' && path[2] != '\\'
+}
+
+// toSlash returns a Windows path with forward slashes and without \\?\ prefix
+func toSlash(path string) string {
+	path = strings.TrimPrefix(path, `\\?\UNC\`)
+	if strings.HasPrefix(path, `\\?\`) {
+		path = path[len(`\\?\`):]
+	} else if strings.HasPrefix(path, `\\`) {
+		// Keep UNC paths distinct from \\?\ prefixed paths after trimming
+		path = "//" + path[2:]
+	}
+	return strings.ReplaceAll(path, `\`, "/")
+}
+
+// FromSlash returns a Windows path with backslashes
+func FromSlash(path string) string {
+	return strings.ReplaceAll(path, "/", `\`)
+}
+
+// hasPrefixFold returns true if path starts with prefix, ignoring case, on a path component boundary.
+// Both use forward slashes.
+func hasPrefixFold(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if len(path) < len(prefix) || !strings.EqualFold(path[:len(prefix)], prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// hasPrefix is hasPrefixFold for case sensitive POSIX paths
+func hasPrefix(path string, prefix string) bool {
+	if prefix == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// join joins a base path and a rest starting with / or empty
+func join(base string, rest string) string {
+	base = strings.TrimSuffix(base, "/")
+	if rest == "" || rest == "/" {
+		if base == "" {
+			return "/"
+		}
+		return base
+	}
+	return base + rest
+}
@@ -0,0 +1,72 @@
+package paths
+
+import "testing"
+
+func TestIsWindowsAbs(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{`C:\Users`, true},
+		{`c:/Users`, true},
+		{`C:`, false},
+		{`C:Users`, false},
+		{`1:\Users`, false},
+		{`\\server\share`, true},
+		{`\\?\C:\Users`, true},
+		{`\\\x`, false},
+		{`/c/Users`, false},
+		{`Users`, false},
+		{``, false},
+	}
+
+	for _, test := range tests {
+		if got := IsWindowsAbs(test.path); got != test.want {
+			t.Errorf("IsWindowsAbs(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestToSlash(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`C:\Users\me`, "C:/Users/me"},
+		{`\\?\C:\Users`, "C:/Users"},
+		{`\\?\UNC\server\share`, "server/share"},
+		{`\\server\share\x`, "//server/share/x"},
+		{`relative\path`, "relative/path"},
+	}
+
+	for _, test := range tests {
+		if got := toSlash(test.path); got != test.want {
+			t.Errorf("toSlash(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestHasPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+		fold   bool
+	}{
+		{"/usr/bin", "/usr", true, true},
+		{"/usr", "/usr/", true, true},
+		{"/usrx", "/usr", false, false},
+		{"/USR/bin", "/usr", false, true},
+		{"/anything", "/", true, true},
+		{"C:/Users/me", "c:/users", false, true},
+	}
+
+	for _, test := range tests {
+		if got := hasPrefix(test.path, test.prefix); got != test.want {
+			t.Errorf("hasPrefix(%q, %q) = %v, want %v", test.path, test.prefix, got, test.want)
+		}
+		if got := hasPrefixFold(test.path, test.prefix); got != test.fold {
+			t.Errorf("hasPrefixFold(%q, %q) = %v, want %v", test.path, test.prefix, got, test.fold)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package paths
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WSL network share prefixes of the distributions files
+var wslSharePrefixes = []string{"//wsl$/", "//wsl.localhost/"}
+
+// Wsl converts paths of a WSL distribution
+type Wsl struct {
+	// Distro is the distribution name, used for paths outside of Windows drives
+	Distro string
+	// AutomountRoot is the directory of Windows drives, root of [automount] in wsl.conf
+	AutomountRoot string
+}
+
+// DefaultWsl returns the default WSL configuration, drives in /mnt
+func DefaultWsl(distro string) *Wsl {
+	return &Wsl{Distro: distro, AutomountRoot: "/mnt"}
+}
+
+// ToWindows converts a WSL path to a Windows path, /mnt/c/x is C:\x and other paths are in \\wsl$\distro
+func (w *Wsl) ToWindows(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return FromSlash(path), nil
+	}
+
+	table := MountTable{CygdrivePrefix: w.AutomountRoot}
+	if drive, rest, ok := table.cutCygdrive(path); ok {
+		return FromSlash(drive + ":" + join("/", rest)), nil
+	}
+
+	if w.Distro == "" {
+		return "", fmt.Errorf("paths: %s: %w, it's not under %s and the WSL distribution is unknown", path, ErrNotConvertible, w.AutomountRoot)
+	}
+	return FromSlash(join("//wsl$/"+w.Distro, path)), nil
+}
+
+// FromWindows converts a Windows path to a WSL path, C:\x is /mnt/c/x and \\wsl$\distro\x is /x
+func (w *Wsl) FromWindows(path string) (string, error) {
+	if !IsWindowsAbs(path) {
+		return strings.ReplaceAll(path, `\`, "/"), nil
+	}
+
+	path = toSlash(path)
+	for _, prefix := range wslSharePrefixes {
+		if len(path) < len(prefix) || !strings.EqualFold(path[:len(prefix)], prefix) {
+			continue
+		}
+
+		distro, rest, _ := strings.Cut(path[len(prefix):], "/")
+		if w.Distro != "" && !strings.EqualFold(distro, w.Distro) {
+			return "", fmt.Errorf("paths: %s: %w, it's in distribution %s instead of %s", path, ErrNotConvertible, distro, w.Distro)
+		}
+		return "/" + rest, nil
+	}
+
+	if strings.HasPrefix(path, "//") {
+		return "", fmt.Errorf("paths: %s: %w, UNC paths aren't mounted in WSL", path, ErrNotConvertible)
+	}
+
+	return join(join(w.AutomountRoot, "/"+strings.ToLower(driveLetter(path))), path[2:]), nil
+}
@@ -0,0 +1,61 @@
+package paths
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWslToWindows(t *testing.T) {
+	tests := []struct {
+		name string
+		wsl  *Wsl
+		path string
+		want string
+		err  error
+	}{
+		{"drive", DefaultWsl("Ubuntu"), "/mnt/c/Users/me/agent.sock", `C:\Users\me\agent.sock`, nil},
+		{"drive root", DefaultWsl("Ubuntu"), "/mnt/d", `D:\`, nil},
+		{"distribution", DefaultWsl("Ubuntu"), "/home/me/agent.sock", `\\wsl$\Ubuntu\home\me\agent.sock`, nil},
+		{"not a drive", DefaultWsl("Ubuntu"), "/mnt/cd/agent.sock", `\\wsl$\Ubuntu\mnt\cd\agent.sock`, nil},
+		{"automount root", &Wsl{Distro: "Ubuntu", AutomountRoot: "/"}, "/c/Users", `C:\Users`, nil},
+		{"relative", DefaultWsl(""), "relative/agent.sock", `relative\agent.sock`, nil},
+		{"unknown distribution", DefaultWsl(""), "/home/me/agent.sock", "", ErrNotConvertible},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.wsl.ToWindows(test.path)
+			if !errors.Is(err, test.err) || got != test.want {
+				t.Errorf("ToWindows(%q) = %q, %v, want %q, %v", test.path, got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestWslFromWindows(t *testing.T) {
+	tests := []struct {
+		name string
+		wsl  *Wsl
+		path string
+		want string
+		err  error
+	}{
+		{"drive", DefaultWsl("Ubuntu"), `C:\Users\me\agent.sock`, "/mnt/c/Users/me/agent.sock", nil},
+		{"wsl$ share", DefaultWsl("Ubuntu"), `\\wsl$\Ubuntu\home\me`, "/home/me", nil},
+		{"wsl.localhost share", DefaultWsl("Ubuntu"), `\\wsl.localhost\ubuntu\home\me`, "/home/me", nil},
+		{"any distribution", DefaultWsl(""), `\\wsl$\Debian\home\me`, "/home/me", nil},
+		{"other distribution", DefaultWsl("Ubuntu"), `\\wsl$\Debian\home\me`, "", ErrNotConvertible},
+		{"unc", DefaultWsl("Ubuntu"), `\\server\share\x`, "", ErrNotConvertible},
+		{"automount root", &Wsl{AutomountRoot: "/"}, `D:\x`, "/d/x", nil},
+		{"relative", DefaultWsl("Ubuntu"), `relative\x`, "relative/x", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.wsl.FromWindows(test.path)
+			if !errors.Is(err, test.err) || got != test.want {
+				t.Errorf("FromWindows(%q) = %q, %v, want %q, %v", test.path, got, err, test.want, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/agent/trace"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+)
+
+type replayArguments struct {
+	tracePath string
+}
+
+// replayArgs is set when running the replay command
+var replayArgs *replayArguments
+
+// runReplay sends the requests of a trace file recorded with --trace to the --to agent and shows the differences
+// with the recorded replies. It returns EXIT_ERROR if a reply is different.
+func runReplay(args *replayArguments) int {
+	if args.tracePath == "" {
+		log.Errorf("usage: replay TRACE --to ...")
+		return EXIT_USAGE
+	}
+
+	file, err := os.Open(args.tracePath)
+	if err != nil {
+		log.Errorf("can't open trace: %v", err)
+		return EXIT_ERROR
+	}
+	entries, err := trace.ReadEntries(file)
+	file.Close()
+	if err != nil {
+		log.Errorf("%v", err)
+		return EXIT_ERROR
+	}
+
+	clientHandler, ok := sshAgentToMap[*argTo]
+	if !ok {
+		log.Errorf("Bad --to value %s, available: %s", *argTo, strings.Join(keys(sshAgentToMap), ", "))
+		return EXIT_USAGE
+	}
+
+	// Queries are sent to the upstream agent without the middlewares of the bridge, like they were recorded
+	replayContext := agent.CreateAgent()
+	replayContext.SetUpstream(*argTo)
+	replayContext.Go(func() {
+		if err := clientHandler(&replayContext); err != nil {
+			log.Errorf("error with upstream agent: %v", err)
+			replayContext.Stop()
+		}
+	})
+
+	conn := agent.NewConnection("replay", agent.PeerInfo{})
+	results := trace.Replay(entries, func(request []byte) []byte {
+		return replayContext.Query(conn, request).Data
+	})
+
+	replayContext.Stop()
+	replayContext.Wait()
+
+	different := 0
+	for i, result := range results {
+		request := result.Entry.Request.Type
+		if result.Entry.Request.Summary != "" {
+			request += " " + result.Entry.Request.Summary
+		}
+		fmt.Printf("#%d connection %d (%s) %s: %s\n", i+1, result.Entry.Connection, result.Entry.Listener, request, result.Status)
+
+		if result.Status == trace.ReplayDifferent || result.Status == trace.ReplaySameSummary {
+			fmt.Printf("  recorded: %s %s\n", result.Entry.Reply.Type, result.Entry.Reply.Summary)
+			fmt.Printf("  replayed: %s %s\n", result.Reply.Type, result.Reply.Summary)
+		}
+		if result.Status == trace.ReplayDifferent {
+			different++
+		}
+	}
+
+	fmt.Printf("%d requests, %d different\n", len(results), different)
+
+	if different > 0 {
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
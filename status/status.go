@@ -0,0 +1,184 @@
+package status
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+type Health int
+
+const (
+	HealthStarting Health = iota
+	HealthOk
+	HealthFailing
+	HealthStopped
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthStarting:
+		return "starting"
+	case HealthOk:
+		return "ok"
+	case HealthFailing:
+		return "failing"
+	case HealthStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(h))
+	}
+}
+
+// Endpoint is the state of a listener or of the upstream agent
+type Endpoint struct {
+	Name      string
+	Health    Health
+	LastError string
+	Requests  uint64
+	// Enabled is false for listeners disabled by the user
+	Enabled bool
+	// AuthSock is the SSH_AUTH_SOCK value to use this listener, empty if not applicable
+	AuthSock string
+}
+
+func (e Endpoint) String() string {
+	return fmt.Sprintf("%s: %s (%d requests)", e.Name, e.Health, e.Requests)
+}
+
+// Model aggregates the state of the listeners and of the upstream agent, it doesn't depend on any GUI
+type Model struct {
+	mutex     sync.Mutex
+	upstream  Endpoint
+	listeners map[string]*Endpoint
+	observers []func()
+}
+
+func New(upstream string) *Model {
+	return &Model{
+		upstream:  Endpoint{Name: upstream, Enabled: true},
+		listeners: map[string]*Endpoint{},
+	}
+}
+
+// Attach updates the model with the listeners and upstream agent state of ctx
+func (m *Model) Attach(ctx *agent.AgentContext) {
+	ctx.OnListenerChange(m.ListenerChanged)
+	ctx.OnUpstreamChange(m.UpstreamChanged)
+}
+
+// OnChange registers a function called after each change of the model
+func (m *Model) OnChange(observer func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.observers = append(m.observers, observer)
+}
+
+// SetAuthSock sets the SSH_AUTH_SOCK value shown for a listener
+func (m *Model) SetAuthSock(listener string, authSock string) {
+	m.update(func() {
+		m.listener(listener).AuthSock = authSock
+	})
+}
+
+func (m *Model) ListenerChanged(status agent.ListenerStatus) {
+	m.update(func() {
+		listener := m.listener(status.Name)
+		listener.Enabled = !status.Disabled
+
+		switch status.State {
+		case agent.ListenerStarting:
+			listener.Health = HealthStarting
+		case agent.ListenerRunning:
+			listener.Health = HealthOk
+		case agent.ListenerFailed:
+			listener.Health = HealthFailing
+		case agent.ListenerStopped:
+			listener.Health = HealthStopped
+		}
+
+		if status.Err != nil {
+			listener.LastError = status.Err.Error()
+		}
+	})
+}
+
+func (m *Model) UpstreamChanged(status agent.UpstreamStatus) {
+	m.update(func() {
+		if status.Err != nil {
+			m.upstream.Health = HealthFailing
+			m.upstream.LastError = status.Err.Error()
+		} else {
+			m.upstream.Health = HealthOk
+		}
+	})
+}
+
+// Middleware counts the requests of each listener, it must be the first middleware
+func (m *Model) Middleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		m.update(func() {
+			m.listener(conn.Listener).Requests++
+		})
+
+		return next(conn, query)
+	}
+}
+
+// UpstreamMiddleware counts the requests forwarded to the upstream agent, it must be the last middleware
+// so that queries answered or refused by other middlewares are not counted
+func (m *Model) UpstreamMiddleware(next agent.QueryHandler) agent.QueryHandler {
+	return func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		m.update(func() {
+			m.upstream.Requests++
+		})
+
+		return next(conn, query)
+	}
+}
+
+// Upstream returns the state of the upstream agent
+func (m *Model) Upstream() Endpoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.upstream
+}
+
+// Listeners returns the state of all listeners sorted by name
+func (m *Model) Listeners() []Endpoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	listeners := make([]Endpoint, 0, len(m.listeners))
+	for _, listener := range m.listeners {
+		listeners = append(listeners, *listener)
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Name < listeners[j].Name })
+
+	return listeners
+}
+
+// listener returns the state of a listener, creating it if needed, mutex must be held
+func (m *Model) listener(name string) *Endpoint {
+	listener, ok := m.listeners[name]
+	if !ok {
+		listener = &Endpoint{Name: name, Enabled: true}
+		m.listeners[name] = listener
+	}
+	return listener
+}
+
+func (m *Model) update(change func()) {
+	m.mutex.Lock()
+	change()
+	observers := m.observers
+	m.mutex.Unlock()
+
+	for _, observer := range observers {
+		observer()
+	}
+}
@@ -0,0 +1,182 @@
+package status
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+)
+
+func TestListenerChanged(t *testing.T) {
+	failure := errors.New("listen failed")
+
+	tests := []struct {
+		name    string
+		changes []agent.ListenerStatus
+		want    Endpoint
+	}{
+		{
+			name:    "starting",
+			changes: []agent.ListenerStatus{{Name: "pipe", State: agent.ListenerStarting}},
+			want:    Endpoint{Name: "pipe", Health: HealthStarting, Enabled: true},
+		},
+		{
+			name:    "running",
+			changes: []agent.ListenerStatus{{Name: "pipe", State: agent.ListenerRunning}},
+			want:    Endpoint{Name: "pipe", Health: HealthOk, Enabled: true},
+		},
+		{
+			name:    "failed",
+			changes: []agent.ListenerStatus{{Name: "pipe", State: agent.ListenerFailed, Err: failure}},
+			want:    Endpoint{Name: "pipe", Health: HealthFailing, LastError: "listen failed", Enabled: true},
+		},
+		{
+			name: "running again keeps the last error",
+			changes: []agent.ListenerStatus{
+				{Name: "pipe", State: agent.ListenerFailed, Err: failure},
+				{Name: "pipe", State: agent.ListenerRunning},
+			},
+			want: Endpoint{Name: "pipe", Health: HealthOk, LastError: "listen failed", Enabled: true},
+		},
+		{
+			name:    "disabled",
+			changes: []agent.ListenerStatus{{Name: "pipe", State: agent.ListenerStopped, Disabled: true}},
+			want:    Endpoint{Name: "pipe", Health: HealthStopped},
+		},
+		{
+			name: "enabled again",
+			changes: []agent.ListenerStatus{
+				{Name: "pipe", State: agent.ListenerStopped, Disabled: true},
+				{Name: "pipe", State: agent.ListenerStarting},
+			},
+			want: Endpoint{Name: "pipe", Health: HealthStarting, Enabled: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := New("upstream")
+			for _, change := range test.changes {
+				m.ListenerChanged(change)
+			}
+
+			listeners := m.Listeners()
+			if len(listeners) != 1 || listeners[0] != test.want {
+				t.Errorf("listeners = %+v, want %+v", listeners, test.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamChanged(t *testing.T) {
+	m := New("pageant")
+	if upstream := m.Upstream(); upstream.Name != "pageant" || upstream.Health != HealthStarting {
+		t.Errorf("initial upstream = %+v", upstream)
+	}
+
+	m.UpstreamChanged(agent.UpstreamStatus{Name: "pageant", Err: errors.New("pageant not found")})
+	if upstream := m.Upstream(); upstream.Health != HealthFailing || upstream.LastError != "pageant not found" {
+		t.Errorf("upstream after failure = %+v", upstream)
+	}
+
+	m.UpstreamChanged(agent.UpstreamStatus{Name: "pageant"})
+	if upstream := m.Upstream(); upstream.Health != HealthOk || upstream.LastError != "pageant not found" {
+		t.Errorf("upstream after success = %+v", upstream)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New("upstream")
+	upstream := m.UpstreamMiddleware(func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		return agent.AGENT_MESSAGE_SUCCESS_REPLY
+	})
+	// Queries from pipe are answered without the upstream agent, like a refusal or a cache hit
+	handler := m.Middleware(func(conn *agent.Connection, query []byte) agent.AgentMessageReply {
+		if conn.Listener == "pipe" {
+			return agent.AGENT_MESSAGE_ERROR_REPLY
+		}
+		return upstream(conn, query)
+	})
+
+	query := agent.NewAgentMessage(agent.SSH_AGENTC_REQUEST_IDENTITIES)
+	for _, listener := range []string{"wsl", "pipe", "wsl"} {
+		handler(agent.NewConnection(listener, agent.PeerInfo{}), query)
+	}
+
+	listeners := m.Listeners()
+	if len(listeners) != 2 || listeners[0].Name != "pipe" || listeners[0].Requests != 1 ||
+		listeners[1].Name != "wsl" || listeners[1].Requests != 2 {
+		t.Errorf("listeners = %v, want pipe with 1 request and wsl with 2", listeners)
+	}
+	if upstream := m.Upstream(); upstream.Requests != 2 {
+		t.Errorf("upstream requests = %d, want 2", upstream.Requests)
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	m := New("upstream")
+
+	var seen []string
+	m.OnChange(func() {
+		// Observers are called without the lock held and can read the model
+		for _, listener := range m.Listeners() {
+			seen = append(seen, listener.AuthSock)
+		}
+	})
+
+	m.SetAuthSock("pipe", `\\.\pipe\openssh-ssh-agent`)
+	if len(seen) != 1 || seen[0] != `\\.\pipe\openssh-ssh-agent` {
+		t.Errorf("observer saw %q", seen)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	ctx := agent.CreateAgent()
+	m := New("test")
+	m.Attach(&ctx)
+
+	changed := make(chan struct{}, 100)
+	m.OnChange(func() { changed <- struct{}{} })
+
+	waitHealth := func(get func() Endpoint, health Health) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for get().Health != health {
+			select {
+			case <-changed:
+			case <-deadline:
+				t.Fatalf("%+v, want %s", get(), health)
+			}
+		}
+	}
+	listener := func() Endpoint {
+		for _, listener := range m.Listeners() {
+			if listener.Name == "fake" {
+				return listener
+			}
+		}
+		return Endpoint{}
+	}
+
+	ctx.Serve("fake", func(ctx *agent.AgentContext) error {
+		ctx.ListenerReady("fake")
+		<-ctx.ListenerDone("fake")
+		return nil
+	})
+	waitHealth(listener, HealthOk)
+
+	ctx.UpstreamResult(nil)
+	waitHealth(m.Upstream, HealthOk)
+	ctx.UpstreamResult(errors.New("upstream unreachable"))
+	waitHealth(m.Upstream, HealthFailing)
+
+	ctx.DisableListener("fake")
+	waitHealth(listener, HealthStopped)
+	if listener().Enabled {
+		t.Error("disabled listener is enabled")
+	}
+
+	ctx.Stop()
+	ctx.Wait()
+}
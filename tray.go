@@ -0,0 +1,210 @@
+//go:build !notray
+
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/amurzeau/ssh-agent-bridge/agent"
+	"github.com/amurzeau/ssh-agent-bridge/log"
+	"github.com/amurzeau/ssh-agent-bridge/status"
+
+	"github.com/atotto/clipboard"
+	"github.com/getlantern/systray"
+)
+
+//go:embed assets/oxygen-status-wallet-open.ico
+var assetsOxygenStatusWalletOpen []byte
+
+//go:embed assets/oxygen-status-wallet-open-disabled.ico
+var assetsOxygenStatusWalletOpenDisabled []byte
+
+// trayAvailable is false when built with the notray tag
+const trayAvailable = true
+
+func runTray() {
+	systray.Run(onReady, onExit)
+}
+
+func onReady() {
+	systray.SetIcon(assetsOxygenStatusWalletOpen)
+	systray.SetTitle("SSH Agent Bridge")
+	systray.SetTooltip("SSH Agent Bridge")
+	newTrayStatusMenu(statusModel, &agentContext)
+	systray.AddSeparator()
+	mExit := systray.AddMenuItem("Exit", "Exit SSH Agent Bridge")
+
+	go func() {
+		<-mExit.ClickedCh
+		agentContext.Stop()
+		<-mExit.ClickedCh
+		log.Debugf("agentContext: hard exit")
+		os.Exit(EXIT_OK)
+	}()
+
+	go handleSignals()
+
+	go func() {
+		<-agentContext.Done()
+		agentContext.Wait()
+		systray.Quit()
+	}()
+
+	startAgent()
+}
+
+func onExit() {
+}
+
+// trayStatusMenu shows the state of the listeners and of the upstream agent in the tray menu
+type trayStatusMenu struct {
+	model *status.Model
+	ctx   *agent.AgentContext
+
+	mutex           sync.Mutex
+	menu            *systray.MenuItem
+	upstream        *systray.MenuItem
+	upstreamError   *systray.MenuItem
+	listeners       map[string]*trayListenerItems
+	upstreamFailing bool
+}
+
+type trayListenerItems struct {
+	item         *systray.MenuItem
+	enabled      *systray.MenuItem
+	copyAuthSock *systray.MenuItem
+	lastError    *systray.MenuItem
+}
+
+func newTrayStatusMenu(model *status.Model, ctx *agent.AgentContext) *trayStatusMenu {
+	t := &trayStatusMenu{
+		model:     model,
+		ctx:       ctx,
+		listeners: map[string]*trayListenerItems{},
+	}
+
+	t.menu = systray.AddMenuItem("Status", "State of the upstream agent and listeners")
+	t.upstream = t.menu.AddSubMenuItem("", "Upstream agent")
+	t.upstreamError = t.upstream.AddSubMenuItem("", "Last error of the upstream agent")
+	t.upstreamError.Disable()
+
+	model.OnChange(t.refresh)
+	t.refresh()
+
+	return t
+}
+
+func (t *trayStatusMenu) refresh() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	upstream := t.model.Upstream()
+	t.upstream.SetTitle("Upstream " + upstream.String())
+	setErrorItem(t.upstreamError, upstream.LastError)
+
+	listeners := t.model.Listeners()
+	for _, listener := range listeners {
+		items, ok := t.listeners[listener.Name]
+		if !ok {
+			items = t.addListener(listener.Name)
+		}
+
+		items.item.SetTitle(listener.String())
+		if listener.Enabled {
+			items.enabled.Check()
+		} else {
+			items.enabled.Uncheck()
+		}
+		if listener.AuthSock != "" {
+			items.copyAuthSock.SetTooltip(listener.AuthSock)
+			items.copyAuthSock.Show()
+		} else {
+			items.copyAuthSock.Hide()
+		}
+		setErrorItem(items.lastError, listener.LastError)
+	}
+
+	upstreamFailing := upstream.Health == status.HealthFailing
+	if upstreamFailing != t.upstreamFailing {
+		t.upstreamFailing = upstreamFailing
+		if upstreamFailing {
+			systray.SetIcon(assetsOxygenStatusWalletOpenDisabled)
+		} else {
+			systray.SetIcon(assetsOxygenStatusWalletOpen)
+		}
+	}
+
+	systray.SetTooltip(trayTooltip(upstream, listeners))
+}
+
+func (t *trayStatusMenu) addListener(name string) *trayListenerItems {
+	items := &trayListenerItems{}
+
+	items.item = t.menu.AddSubMenuItem(name, "Listener "+name)
+	items.enabled = items.item.AddSubMenuItemCheckbox("Enabled", "Accept connections on "+name, true)
+	items.copyAuthSock = items.item.AddSubMenuItem("Copy SSH_AUTH_SOCK for "+name, "")
+	items.lastError = items.item.AddSubMenuItem("", "Last error of "+name)
+	items.lastError.Disable()
+
+	t.listeners[name] = items
+
+	go func() {
+		for range items.enabled.ClickedCh {
+			var err error
+			if items.enabled.Checked() {
+				err = t.ctx.DisableListener(name)
+			} else {
+				err = t.ctx.EnableListener(name)
+			}
+			if err != nil {
+				log.Errorf("%v", err)
+			}
+		}
+	}()
+
+	go func() {
+		for range items.copyAuthSock.ClickedCh {
+			for _, listener := range t.model.Listeners() {
+				if listener.Name != name {
+					continue
+				}
+				if err := clipboard.WriteAll(listener.AuthSock); err != nil {
+					log.Errorf("can't copy SSH_AUTH_SOCK for %s to the clipboard: %v", name, err)
+				}
+			}
+		}
+	}()
+
+	return items
+}
+
+func setErrorItem(item *systray.MenuItem, lastError string) {
+	if lastError == "" {
+		item.Hide()
+		return
+	}
+	item.SetTitle("Last error: " + lastError)
+	item.Show()
+}
+
+func trayTooltip(upstream status.Endpoint, listeners []status.Endpoint) string {
+	if upstream.Health == status.HealthFailing {
+		return fmt.Sprintf("SSH Agent Bridge - upstream %s unreachable", upstream.Name)
+	}
+
+	var failed []string
+	for _, listener := range listeners {
+		if listener.Health == status.HealthFailing {
+			failed = append(failed, listener.Name)
+		}
+	}
+
+	if len(failed) == 0 {
+		return "SSH Agent Bridge"
+	}
+	return fmt.Sprintf("SSH Agent Bridge - failing: %s", strings.Join(failed, ", "))
+}
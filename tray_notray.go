@@ -0,0 +1,9 @@
+//go:build notray
+
+package main
+
+// trayAvailable is false when built with the notray tag
+const trayAvailable = false
+
+func runTray() {
+}